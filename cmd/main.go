@@ -1,12 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"github.com/montanaflynn/stats"
+	"github.com/gin-gonic/gin"
+	"github.com/twuillemin/gargote/pkg/abort"
+	"github.com/twuillemin/gargote/pkg/compare"
+	"github.com/twuillemin/gargote/pkg/dashboard"
 	"github.com/twuillemin/gargote/pkg/db"
-	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/distributed"
+	"github.com/twuillemin/gargote/pkg/export"
+	"github.com/twuillemin/gargote/pkg/histogram"
 	"github.com/twuillemin/gargote/pkg/loader"
+	"github.com/twuillemin/gargote/pkg/prometheus"
+	"github.com/twuillemin/gargote/pkg/sink"
+	"github.com/twuillemin/gargote/pkg/statistics"
+	"github.com/twuillemin/gargote/pkg/store"
+	"github.com/twuillemin/gargote/pkg/stream"
+	"github.com/twuillemin/gargote/pkg/threshold"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,12 +33,17 @@ import (
 
 func main() {
 
-	if len(os.Args) != 2 {
-		log.Fatal("gargote need the script file name as argument")
+	// The subcommand is optional, "run" being the default one
+	arguments := os.Args[1:]
+	command := "run"
+	if len(arguments) > 0 {
+		switch arguments[0] {
+		case "run", "compare", "runs", "serve", "worker":
+			command = arguments[0]
+			arguments = arguments[1:]
+		}
 	}
 
-	fileName := os.Args[1]
-
 	log.SetFormatter(&log.TextFormatter{
 		DisableColors: false,
 		FullTimestamp: false,
@@ -28,6 +51,81 @@ func main() {
 
 	log.SetLevel(log.WarnLevel)
 
+	gin.SetMode(gin.ReleaseMode)
+
+	switch command {
+	case "compare":
+		compareRuns(arguments)
+	case "runs":
+		listRuns(arguments)
+	case "serve":
+		serve(arguments)
+	case "worker":
+		work(arguments)
+	default:
+		run(arguments)
+	}
+}
+
+func run(arguments []string) {
+
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gargote [run] [options] file.yaml\n")
+		flags.PrintDefaults()
+	}
+
+	outputFileName := flags.String("out", "", "export the results to a file: .json or .csv")
+	junitFileName := flags.String("junit", "", "export the results to a JUnit XML file")
+	junitLevelName := flags.String("junit-level", "stage", "the level reported as JUnit testcase: stage or action")
+	htmlFileName := flags.String("html", "", "export the results to a self-contained HTML report")
+	metricsAddress := flags.String("metrics", "", "publish live Prometheus metrics on this address, for example :9090")
+	influxAddress := flags.String("influx", "", "stream the results to InfluxDB: udp://host:port or the URL of the HTTP write endpoint")
+	influxToken := flags.String("influx-token", "", "the token used to authenticate to InfluxDB over HTTP")
+	statsDAddress := flags.String("statsd", "", "stream the results to StatsD on this address, for example localhost:8125")
+	statsDPrefix := flags.String("statsd-prefix", "gargote", "the prefix of the StatsD metrics")
+	samplesFileName := flags.String("samples", "", "write each finished action to a file as soon as it is finished, as JSON lines")
+	verbose := flags.Bool("verbose", false, "display each finished action")
+	fullScreen := flags.Bool("dashboard", false, "display a full screen dashboard during the test, if the output is a terminal")
+	baselineName := flags.String("baseline", "", "fail the run if it regresses compared to this run: a JSON export, a stored run ID, latest or previous")
+	maxRegressionValue := flags.String("max-regression", "10%", "the accepted degradation of the p95 of each action compared to the baseline")
+	maxErrorIncreaseValue := flags.String("max-error-increase", "1%", "the accepted increase of the error rate of each action compared to the baseline, in percentage points")
+	storeDirectory := flags.String("store", store.DefaultDirectory, "the directory where the run is stored, empty to not store it")
+	numberOfWorkers := flags.Int("workers", 0, "distribute the test to this number of workers instead of running it locally")
+	listenAddress := flags.String("listen", "127.0.0.1:7000", "the address on which the workers register, when the test is distributed, only local by default as the workers receive the whole test")
+	workersToken := flags.String("token", os.Getenv("GARGOTE_TOKEN"), "the token required from the workers, GARGOTE_TOKEN by default")
+	flags.Parse(arguments)
+
+	junitLevel, err := export.ParseJUnitLevel(*junitLevelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flags.NArg() != 1 {
+		log.Fatal("gargote need the script file name as argument")
+	}
+
+	fileName := flags.Arg(0)
+
+	maxRegression, err := compare.ParseTolerance(*maxRegressionValue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxErrorIncrease, err := compare.ParseTolerance(*maxErrorIncreaseValue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Read the baseline before the run, as the run is stored once finished
+	var baseline *export.Results
+	if len(*baselineName) > 0 {
+		baseline, err = loadResults(*storeDirectory, *baselineName)
+		if err != nil {
+			log.Fatalf("unable to read the baseline due to %v", err)
+		}
+	}
+
 	log.Info("Starting...")
 
 	// Load test scenario
@@ -42,73 +140,416 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Display load during test
-	quitDisplayLoadChannel := make(chan struct{})
-	go displayLoad(quitDisplayLoadChannel)
+	// Prepare the thresholds
+	thresholds, err := threshold.ParseAll(*test)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop the test at the first signal, keeping the results of what was completed. The signals are caught before
+	// anything else starts, so that an early signal is not lost.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	interruptChannel := make(chan os.Signal, 1)
+	go handleSignals(signals, interruptChannel, cancel)
+
+	// Wait for the workers before starting anything, so that the test is not aborted while waiting
+	var coordinator *distributed.Coordinator
+	if *numberOfWorkers > 0 {
+		coordinatorCtx, stopCoordinator := context.WithCancel(context.Background())
+		defer stopCoordinator()
+
+		if err := distributed.CheckSplit(*test, *numberOfWorkers); err != nil {
+			log.Fatal(err)
+		}
+
+		if len(*workersToken) == 0 && !isLocalAddress(*listenAddress) {
+			log.Warnf("the coordinator listens on %v without --token: anyone reaching it can read the test and send results", *listenAddress)
+		}
+
+		coordinator = distributed.NewCoordinator(*numberOfWorkers, *workersToken)
+		if err := coordinator.Serve(coordinatorCtx, *listenAddress); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Waiting for %v worker(s) on %v\n", *numberOfWorkers, *listenAddress)
+		if err := coordinator.WaitForWorkers(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Abort the test as soon as a threshold can not be respected anymore, when it runs for too long or when an abort
+	// condition is met. Only the first reason is kept. The reason is logged, so that it is kept until the dashboard is
+	// closed.
+	abortChannel := make(chan string, 1)
+	abortTest := func(reason string) {
+		log.Warnf("Aborting the test, %v", reason)
+		select {
+		case abortChannel <- reason:
+		default:
+		}
+		cancel()
+	}
+
+	thresholdMonitor := threshold.NewMonitor(thresholds, *test)
+	go thresholdMonitor.Watch(ctx, func(breach threshold.Result) {
+		abortTest("threshold irrecoverably breached: " + breach.String())
+	})
+
+	monitor := abort.NewMonitor(*test)
+	go monitor.Watch(ctx, abortTest)
+
+	// The results are always stored in the database, and may also be sent to other destinations
+	sinks := []sink.ResultSink{sink.NewMemDB(), thresholdMonitor, monitor}
+
+	if len(*samplesFileName) > 0 {
+		fileSink, err := sink.NewFile(*samplesFileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, fileSink)
+	}
+
+	// The actions displayed by --verbose would break the full screen dashboard
+	interactive := *fullScreen && dashboard.IsTerminal(os.Stdout)
+	if *verbose {
+		if interactive {
+			log.Warn("--verbose is ignored while the dashboard is displayed")
+		} else {
+			sinks = append(sinks, sink.NewConsole(*test, os.Stdout))
+		}
+	}
 
-	// Run the tests
-	err = runner.RunTest(*test)
+	// Publish the metrics during the test
+	if len(*metricsAddress) > 0 {
+		metricsCtx, stopMetrics := context.WithCancel(context.Background())
+		defer stopMetrics()
+
+		exporter := prometheus.NewExporter(*test)
+		sinks = append(sinks, exporter)
+		if err := prometheus.Serve(metricsCtx, *metricsAddress, exporter); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Stream the results during the test
+	if len(*influxAddress) > 0 {
+		influxSink, err := stream.NewInfluxSink(*test, *influxAddress, *influxToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, influxSink)
+	}
+
+	if len(*statsDAddress) > 0 {
+		statsDSink, err := stream.NewStatsDSink(*test, *statsDAddress, *statsDPrefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, statsDSink)
+	}
+
+	// Display the progress during the test, full screen only if requested and possible
+	progress := dashboard.New(*test)
+	sinks = append(sinks, progress)
+
+	// The output of the runner would break the full screen dashboard, so it is written once the dashboard is closed
+	var runnerOutput bytes.Buffer
+	if interactive {
+		runner.SetOutput(&runnerOutput)
+	}
+
+	dashboardCtx, stopDashboard := context.WithCancel(context.Background())
+	dashboardDone := make(chan struct{})
+	go func() {
+		progress.Run(dashboardCtx, os.Stdout, interactive)
+		close(dashboardDone)
+	}()
+
+	// Run the tests, locally or on the workers
+	start := time.Now()
+	resultSink := sink.NewMulti(sinks...)
+	if coordinator != nil {
+		err = coordinator.Run(ctx, *test, resultSink)
+		start = coordinator.StartTime()
+	} else {
+		err = runner.RunTest(ctx, *test, resultSink)
+	}
+	elapsed := time.Since(start)
+	stopDashboard()
+	<-dashboardDone
+	runnerOutput.WriteTo(os.Stdout)
+	if closeErr := resultSink.Close(); closeErr != nil {
+		log.Warnf("unable to close the results destinations due to %v", closeErr)
+	}
 	if err != nil {
 		log.Errorf("Tests finished with error: %v", err)
-		return
+		os.Exit(1)
 	}
 
 	log.Info("Finished successfully...\n")
 
-	quitDisplayLoadChannel <- struct{}{}
+	cancel()
+
+	report, err := statistics.Compute(*test, elapsed)
+	if err != nil {
+		log.Fatalf("error while computing statistics: %v", err)
+	}
+
+	displayResults(report)
+	displayTimeSeries()
+
+	thresholdResults := threshold.Evaluate(thresholds, report)
+	passed := displayThresholds(thresholdResults)
+
+	if baseline != nil {
+		passed = checkBaseline(baseline, report, maxRegression, maxErrorIncrease) && passed
+	}
+
+	// A run stopped before its end fails, as its results are partial
+	abortReason := ""
+	select {
+	case abortReason = <-abortChannel:
+	case received := <-interruptChannel:
+		abortReason = fmt.Sprintf("interrupted by a signal (%v)", received)
+	default:
+	}
+
+	if len(abortReason) > 0 {
+		fmt.Printf("The test was aborted, %v: the results are partial\n", abortReason)
+		passed = false
+	}
+
+	if len(*storeDirectory) > 0 {
+		saveRun(*storeDirectory, fileName, *test, report, thresholdResults, abortReason, start, elapsed)
+	}
+
+	if len(*outputFileName) > 0 {
+		if err := export.ToFile(*outputFileName, report); err != nil {
+			log.Errorf("error while exporting the results: %v", err)
+		}
+	}
+
+	if len(*junitFileName) > 0 {
+		if err := export.ToJUnitFile(*junitFileName, *test, junitLevel); err != nil {
+			log.Errorf("error while exporting the JUnit report: %v", err)
+		}
+	}
+
+	if len(*htmlFileName) > 0 {
+		if err := export.ToHTMLFile(*htmlFileName, *test, report, thresholdResults); err != nil {
+			log.Errorf("error while exporting the HTML report: %v", err)
+		}
+	}
 
-	displayResults(*test)
+	if !passed {
+		os.Exit(1)
+	}
 }
 
-func displayLoad(quitChannel chan struct{}) {
+// handleSignals interrupts the test when a SIGINT or a SIGTERM is received, so that the tests already started are
+// stopped and their results are still reported. A second signal exits immediately, without any results.
+//
+// Params:
+//  - signals: the channel notified of the signals, before the run starts
+//  - interruptChannel: the channel receiving the first signal
+//  - cancel: the function cancelling the context of the run
+func handleSignals(signals <-chan os.Signal, interruptChannel chan<- os.Signal, cancel context.CancelFunc) {
 
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+	received := <-signals
+	log.Warnf("Interrupting the test (%v), the tests already started are stopped. Interrupt again to exit immediately.", received)
+	interruptChannel <- received
+	cancel()
 
-	for {
-		select {
-		case <-ticker.C:
-			fmt.Printf("%v / %v\n", runner.GetCurrentNumberOfRunningTests(), runner.GetMaximumNumberOfRunningTests())
-			//fmt.Printf("%v\n", runner.GetCurrentNumberOfRunningTests())
-		case <-quitChannel:
-			return
+	<-signals
+	fmt.Printf("Exiting without results\n")
+	os.Exit(1)
+}
+
+func displayResults(report *statistics.Report) {
+
+	fmt.Printf("Test: %v, %v\n", report.TestName, getStatistics(report.Statistics))
+	fmt.Printf("All actions: %v\n", getStatistics(report.AllActions))
+
+	for _, scenario := range report.Scenarios {
+		fmt.Printf("Scenario: %v (weight %v), %v\n", scenario.Name, scenario.Weight, getStatistics(scenario.Statistics))
+	}
+
+	for _, stage := range report.Stages {
+		fmt.Printf("Stage: %v, %v\n", stage.FullName(), getStatistics(stage.Statistics))
+
+		for _, action := range stage.Actions {
+			fmt.Printf("URL: %v, %v\n", action.URL, getStatistics(action.Statistics))
+			displayHistogram(action.Histogram)
+			displayTimings(action.Timings)
+			displayFailures(action.Statistics)
 		}
 	}
 }
 
-func displayResults(test definition.Test) {
+func displayTimings(timings *statistics.TimingStatistics) {
+
+	fmt.Printf(
+		"    Connections: new: %v, reused: %v\n",
+		timings.NbNewConnections,
+		timings.NbReusedConnections)
+
+	phases := []struct {
+		name      string
+		durations *histogram.Histogram
+	}{
+		{"DNS lookup", timings.DNS},
+		{"TCP connect", timings.Connect},
+		{"TLS handshake", timings.TLS},
+		{"Time to first byte", timings.TimeToFirstByte},
+		{"Content transfer", timings.Transfer},
+	}
+
+	for _, phase := range phases {
+		if phase.durations.Count() == 0 {
+			continue
+		}
+
+		fmt.Printf(
+			"    %-18s: count: %v, mean: %v, p50: %v, p95: %v, max: %v\n",
+			phase.name,
+			phase.durations.Count(),
+			toMilliseconds(time.Duration(phase.durations.Mean())),
+			toMilliseconds(time.Duration(phase.durations.Percentile(50))),
+			toMilliseconds(time.Duration(phase.durations.Percentile(95))),
+			toMilliseconds(time.Duration(phase.durations.Max())))
+	}
+}
+
+func displayFailures(data statistics.Statistics) {
+
+	if data.NbFailure == 0 {
+		return
+	}
+
+	categories := make([]string, 0, len(data.FailuresByCategory))
+	for category, count := range data.FailuresByCategory {
+		categories = append(categories, fmt.Sprintf("%v: %v", category.ToString(), count))
+	}
+	sort.Strings(categories)
+
+	fmt.Printf("    Failures: %v\n", strings.Join(categories, ", "))
+
+	// Display the most frequent messages
+	messages := make([]string, 0, len(data.FailuresByMessage))
+	for message := range data.FailuresByMessage {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return data.FailuresByMessage[messages[i]] > data.FailuresByMessage[messages[j]]
+	})
+
+	for i := 0; i < len(messages) && i < 5; i++ {
+		fmt.Printf("      %6v x %v\n", data.FailuresByMessage[messages[i]], messages[i])
+	}
+}
+
+func displayTimeSeries() {
 
-	results, err := db.GetAllRequests()
+	buckets, err := db.GetTimeSeries(1 * time.Second)
 	if err != nil {
-		log.Errorf("error while retrieving results: %v", err)
+		log.Errorf("error while retrieving time series: %v", err)
+		return
+	}
+
+	if len(buckets) == 0 {
 		return
 	}
 
-	for requestID, requestResult := range results {
-		url := test.Stages[requestID.StageIndex].Actions[requestID.ActionIndex].Query.URL
-		fmt.Printf("URL: %v, Fail: %v, Success: %v, Stats:[%v]\n", url, requestResult.NbFailure, len(requestResult.SuccessNanoTimes), getStatistics(requestResult.SuccessNanoTimes))
+	fmt.Printf("Time series (by second):\n")
+	fmt.Printf("    %8s %10s %8s %8s %10s %10s %10s\n", "time", "requests", "errors", "active", "p50", "p95", "p99")
+
+	for _, bucket := range buckets {
+		fmt.Printf(
+			"    %7vs %10v %8v %8v %10v %10v %10v\n",
+			(bucket.StartTimeNano-buckets[0].StartTimeNano)/int64(time.Second),
+			bucket.NbRequests,
+			bucket.NbFailures,
+			bucket.ActiveTests,
+			toMilliseconds(time.Duration(bucket.Durations.Percentile(50))),
+			toMilliseconds(time.Duration(bucket.Durations.Percentile(95))),
+			toMilliseconds(time.Duration(bucket.Durations.Percentile(99))))
 	}
 }
 
-func getStatistics(rawData []int) string {
+func displayThresholds(results []threshold.Result) bool {
 
-	// Get the data in milliseconds (drop nano)
-	data := make([]float64, len(rawData))
-	for i, d := range rawData {
-		data[i] = float64(int(d/1000)) / 1000.0
+	allPassed := true
+	for _, result := range results {
+		fmt.Printf("Threshold %v\n", result)
+		allPassed = allPassed && result.Passed
 	}
 
-	min, _ := stats.Min(data)
-	max, _ := stats.Max(data)
-	mean, _ := stats.Mean(data)
-	median, _ := stats.Median(data)
-	variance, _ := stats.StandardDeviation(data)
+	return allPassed
+}
+
+func checkBaseline(baseline *export.Results, report *statistics.Report, maxRegression float64, maxErrorIncrease float64) bool {
+
+	current, err := export.NewResults(report, false)
+	if err != nil {
+		log.Errorf("error while comparing with the baseline: %v", err)
+		return false
+	}
+
+	comparison := compare.Compare(baseline, current, maxRegression, maxErrorIncrease, []compare.Metric{compare.P95, compare.ErrorRate})
+
+	regressions := comparison.Regressions()
+	if len(regressions) == 0 {
+		fmt.Printf("Baseline PASSED: no regression above %.2f%% or %.2f percentage points of errors\n", maxRegression*100.0, maxErrorIncrease*100.0)
+		return true
+	}
+
+	for _, regression := range regressions {
+		fmt.Printf("Baseline FAILED: %v\n", regression)
+	}
+
+	return false
+}
+
+func getStatistics(data statistics.Statistics) string {
 
 	return fmt.Sprintf(
-		"min: %v, max: %v, mean: %v, median: %v, variance: %v",
-		min,
-		max,
-		mean,
-		median,
-		variance)
+		"Fail: %v, Success: %v, Throughput: %.2f/s, Stats:[min: %v, max: %v, mean: %v, stddev: %v, p50: %v, p90: %v, p95: %v, p99: %v, p99.9: %v]",
+		data.NbFailure,
+		data.NbSuccess,
+		data.Throughput,
+		toMilliseconds(data.Min),
+		toMilliseconds(data.Max),
+		toMilliseconds(data.Mean),
+		toMilliseconds(data.StdDev),
+		toMilliseconds(data.P50),
+		toMilliseconds(data.P90),
+		toMilliseconds(data.P95),
+		toMilliseconds(data.P99),
+		toMilliseconds(data.P999))
+}
+
+func displayHistogram(durations *histogram.Histogram) {
+
+	bins := durations.Bins(10)
+
+	var maxCount int64
+	for _, bin := range bins {
+		if bin.Count > maxCount {
+			maxCount = bin.Count
+		}
+	}
+
+	for _, bin := range bins {
+		bar := strings.Repeat("#", int(bin.Count*40/maxCount))
+		fmt.Printf("    %10v - %10v ms | %-40s %v\n", toMilliseconds(time.Duration(bin.From)), toMilliseconds(time.Duration(bin.To)), bar, bin.Count)
+	}
+}
+
+// toMilliseconds returns the duration in milliseconds (drop nano)
+func toMilliseconds(duration time.Duration) float64 {
+	return float64(int(duration.Nanoseconds()/1000)) / 1000.0
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/compare"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/export"
+	"github.com/twuillemin/gargote/pkg/statistics"
+	"github.com/twuillemin/gargote/pkg/store"
+	"github.com/twuillemin/gargote/pkg/threshold"
+)
+
+func saveRun(directory string, fileName string, test definition.Test, report *statistics.Report, thresholdResults []threshold.Result, abortReason string, start time.Time, elapsed time.Duration) {
+
+	runStore, err := store.Open(directory)
+	if err != nil {
+		log.Errorf("error while storing the run: %v", err)
+		return
+	}
+
+	results, err := export.NewResults(report, true)
+	if err != nil {
+		log.Errorf("error while storing the run: %v", err)
+		return
+	}
+
+	id, err := runStore.Save(&store.Run{
+		FileName:       fileName,
+		DefinitionHash: store.HashDefinition(test),
+		StartTimeNano:  start.UnixNano(),
+		EndTimeNano:    start.Add(elapsed).UnixNano(),
+		Definition:     test,
+		Results:        results,
+		AbortReason:    abortReason,
+	})
+	if err != nil {
+		log.Errorf("error while storing the run: %v", err)
+		return
+	}
+
+	html, err := export.ToHTML(test, report, thresholdResults)
+	if err == nil {
+		err = runStore.SaveReport(id, html)
+	}
+	if err != nil {
+		log.Errorf("error while storing the HTML report of the run: %v", err)
+	}
+
+	fmt.Printf("Run stored as %v\n", id)
+}
+
+func listRuns(arguments []string) {
+
+	flags := flag.NewFlagSet("runs", flag.ExitOnError)
+	storeDirectory := flags.String("store", store.DefaultDirectory, "the directory where the runs are stored")
+	flags.Parse(arguments)
+
+	runStore, err := store.Open(*storeDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runs, err := runStore.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%-20s %-20s %-12s %10s %10s %10s  %s\n", "id", "start", "definition", "duration", "runs", "failures", "test")
+	for _, run := range runs {
+
+		// The hash may be empty or shortened if the definition could not be converted or if the file was edited
+		hash := run.DefinitionHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+
+		// The runs stopped before their end are flagged, as their results are partial
+		aborted := ""
+		if len(run.AbortReason) > 0 {
+			aborted = ", aborted: " + run.AbortReason
+		}
+
+		fmt.Printf(
+			"%-20s %-20s %-12s %10v %10v %10v  %s (%s%s)\n",
+			run.ID,
+			time.Unix(0, run.StartTimeNano).Format("2006-01-02 15:04:05"),
+			hash,
+			time.Duration(run.EndTimeNano-run.StartTimeNano).Round(time.Millisecond),
+			run.Results.Test.NbSuccess+run.Results.Test.NbFailure,
+			run.Results.Test.NbFailure,
+			run.Results.TestName,
+			run.FileName,
+			aborted)
+	}
+}
+
+func compareRuns(arguments []string) {
+
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gargote compare [options] baseline current\n")
+		fmt.Fprintf(flags.Output(), "The runs are given by their ID in the store, latest, previous or the name of a JSON export.\n")
+		flags.PrintDefaults()
+	}
+	storeDirectory := flags.String("store", store.DefaultDirectory, "the directory where the runs are stored")
+	toleranceValue := flags.String("tolerance", "10%", "the accepted degradation of the durations, relatively to the baseline")
+	errorToleranceValue := flags.String("error-tolerance", "1%", "the accepted increase of the error rate, in percentage points")
+	metricsValue := flags.String("metrics", "p95,p99,error_rate", "the metrics checked for regression: mean, p50, p95, p99, error_rate")
+	flags.Parse(arguments)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	tolerance, err := compare.ParseTolerance(*toleranceValue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	errorTolerance, err := compare.ParseTolerance(*errorToleranceValue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metrics, err := compare.ParseMetrics(*metricsValue)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	baseline, err := loadResults(*storeDirectory, flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	current, err := loadResults(*storeDirectory, flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	comparison := compare.Compare(baseline, current, tolerance, errorTolerance, metrics)
+	displayComparison(comparison)
+
+	if comparison.HasRegression() {
+		os.Exit(1)
+	}
+}
+
+// loadResults reads the results of a run, either from a JSON export or from the store
+func loadResults(directory string, name string) (*export.Results, error) {
+
+	if info, err := os.Stat(name); err == nil && !info.IsDir() {
+		return export.FromFile(name)
+	}
+
+	runStore, err := store.Open(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := runStore.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return run.Results, nil
+}
+
+func displayComparison(comparison *compare.Comparison) {
+
+	fmt.Printf("Tolerance: %.2f%%, error rate: %.2f percentage points\n", comparison.Tolerance*100.0, comparison.ErrorRateTolerance*100.0)
+
+	for _, action := range comparison.Actions {
+
+		fmt.Printf("Stage: %v, Action: %v\n", action.FullStageName(), action.ActionName)
+
+		if action.Baseline == nil {
+			fmt.Printf("    not in the baseline\n")
+			continue
+		}
+		if action.Current == nil {
+			fmt.Printf("    not in the current run\n")
+			continue
+		}
+
+		for _, delta := range action.Deltas {
+			fmt.Printf(
+				"    %-10s %14s -> %14s %10s",
+				delta.Metric,
+				delta.Metric.FormatValue(delta.Baseline),
+				delta.Metric.FormatValue(delta.Current),
+				delta.FormatChange())
+			if delta.Regression {
+				fmt.Printf("  REGRESSION")
+			}
+			fmt.Printf("\n")
+		}
+	}
+
+	regressions := comparison.Regressions()
+	if len(regressions) == 0 {
+		fmt.Printf("No regression\n")
+		return
+	}
+
+	fmt.Printf("%v regression(s):\n", len(regressions))
+	for _, regression := range regressions {
+		fmt.Printf("    %v\n", regression)
+	}
+}
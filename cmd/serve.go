@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/server"
+	"github.com/twuillemin/gargote/pkg/store"
+)
+
+func serve(arguments []string) {
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	address := flags.String("address", "127.0.0.1:8080", "the address to listen to, only local by default as anyone reaching the server can start a load test")
+	directory := flags.String("dir", ".", "the directory of the test files that can be started")
+	storeDirectory := flags.String("store", store.DefaultDirectory, "the directory where the runs are stored")
+	token := flags.String("token", os.Getenv("GARGOTE_TOKEN"), "the token required to access the server, GARGOTE_TOKEN by default")
+	flags.Parse(arguments)
+
+	runStore, err := store.Open(*storeDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(*token) == 0 && !isLocalAddress(*address) {
+		log.Warnf("the server listens on %v without --token: anyone reaching it can start a load test", *address)
+	}
+
+	gargoteServer, err := server.New(*directory, runStore, *token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Gargote is listening on %v\n", *address)
+
+	if err := gargoteServer.Router().Run(*address); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// isLocalAddress returns true if the address only listens on the loopback interface
+func isLocalAddress(address string) bool {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
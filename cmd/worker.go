@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/distributed"
+)
+
+func work(arguments []string) {
+
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	coordinatorURL := flags.String("coordinator", "http://localhost:7000", "the URL of the coordinator")
+	name := flags.String("name", "", "the name of the worker, the host name by default")
+	once := flags.Bool("once", false, "exit after executing a single test")
+	token := flags.String("token", os.Getenv("GARGOTE_TOKEN"), "the token expected by the coordinator, GARGOTE_TOKEN by default")
+	flags.Parse(arguments)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop the test at the first signal, the results already obtained being still sent to the coordinator
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go handleSignals(signals, make(chan os.Signal, 1), cancel)
+
+	worker := distributed.NewWorker(*coordinatorURL, *name, *token)
+	if err := worker.Run(ctx, *once); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
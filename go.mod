@@ -5,7 +5,6 @@ go 1.12
 require (
 	github.com/gin-gonic/gin v1.4.0
 	github.com/hashicorp/go-memdb v1.0.3
-	github.com/montanaflynn/stats v0.5.0
 	github.com/sirupsen/logrus v1.4.2
 	gopkg.in/yaml.v3 v3.0.0-20190502103701-55513cacd4ae
 )
@@ -0,0 +1,188 @@
+package abort
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+// second holds the results of the actions finished during a single second
+type second struct {
+	unixSecond  int64
+	nbSuccess   int64
+	nbFailure   int64
+	nbResponses int64
+}
+
+// Monitor checks, while a Test is running, its maximum duration and its abort conditions. It receives the results as a
+// sink and must be given to the runner, usually through a sink.Multi. The results are counted when they are received,
+// so that the results of the workers of a distributed test do not depend on their clocks.
+type Monitor struct {
+	sink.Base
+	mutex                 sync.Mutex
+	conditions            definition.AbortConditions
+	maximumDuration       time.Duration
+	firstAction           time.Time
+	window                []second
+	nbConsecutiveFailures uint
+	triggered             chan string
+}
+
+// NewMonitor creates a new Monitor for a Test
+//
+// Params:
+//  - test: the Test that will be run
+//
+// Return the new Monitor
+func NewMonitor(test definition.Test) *Monitor {
+	return &Monitor{
+		conditions:      test.AbortConditions,
+		maximumDuration: time.Duration(test.MaximumDuration) * time.Second,
+		window:          make([]second, test.AbortConditions.Window),
+		triggered:       make(chan string, 1),
+	}
+}
+
+// ActionFinished records the result of an action
+func (monitor *Monitor) ActionFinished(entry *db.ActionEntry) {
+
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	now := time.Now()
+	if monitor.firstAction.IsZero() {
+		monitor.firstAction = now
+	}
+
+	if len(monitor.window) > 0 {
+		bucket := monitor.getSecond(now.Unix())
+		if entry.Success {
+			bucket.nbSuccess++
+		} else {
+			bucket.nbFailure++
+		}
+		if entry.StatusCode > 0 {
+			bucket.nbResponses++
+		}
+	}
+
+	if monitor.conditions.ConsecutiveFailures > 0 {
+		if entry.Success {
+			monitor.nbConsecutiveFailures = 0
+		} else {
+			monitor.nbConsecutiveFailures++
+			if monitor.nbConsecutiveFailures == monitor.conditions.ConsecutiveFailures {
+				monitor.trigger(fmt.Sprintf("%v consecutive failures", monitor.nbConsecutiveFailures))
+			}
+		}
+	}
+}
+
+// Watch periodically checks, while a Test is running, its maximum duration and its abort conditions. As soon as one
+// of them is met, the onAbort function is called and the watch stops.
+//
+// Params:
+//  - ctx: the context of the run. The watch stops when the context is done
+//  - onAbort: the function called with the reason of the abort
+func (monitor *Monitor) Watch(ctx context.Context, onAbort func(reason string)) {
+
+	if monitor.maximumDuration == 0 && len(monitor.window) == 0 && monitor.conditions.ConsecutiveFailures == 0 {
+		return
+	}
+
+	// Without maximum duration, the deadline is never reached
+	var deadline <-chan time.Time
+	if monitor.maximumDuration > 0 {
+		timer := time.NewTimer(monitor.maximumDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deadline:
+			onAbort(fmt.Sprintf("maximum duration of %v reached", monitor.maximumDuration))
+			return
+
+		case reason := <-monitor.triggered:
+			onAbort(reason)
+			return
+
+		case now := <-ticker.C:
+			if reason := monitor.check(now); len(reason) > 0 {
+				onAbort(reason)
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trigger asks the watch to abort the run. Only the first reason is kept.
+func (monitor *Monitor) trigger(reason string) {
+	select {
+	case monitor.triggered <- reason:
+	default:
+	}
+}
+
+// check returns the reason to abort the run because of the results of the window ending at the given time, or an
+// empty string if the run can continue
+func (monitor *Monitor) check(now time.Time) string {
+
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	windowDuration := time.Duration(len(monitor.window)) * time.Second
+	if len(monitor.window) == 0 || monitor.firstAction.IsZero() || now.Sub(monitor.firstAction) < windowDuration {
+		return ""
+	}
+
+	var nbSuccess, nbFailure, nbResponses int64
+	for i := range monitor.window {
+		bucket := &monitor.window[i]
+		if bucket.unixSecond > now.Unix()-int64(len(monitor.window)) && bucket.unixSecond <= now.Unix() {
+			nbSuccess += bucket.nbSuccess
+			nbFailure += bucket.nbFailure
+			nbResponses += bucket.nbResponses
+		}
+	}
+
+	if nbSuccess+nbFailure == 0 {
+		return ""
+	}
+
+	if monitor.conditions.Unreachable && nbResponses == 0 {
+		return fmt.Sprintf("target unreachable during the last %v", windowDuration)
+	}
+
+	errorRate := 100 * float64(nbFailure) / float64(nbSuccess+nbFailure)
+	if monitor.conditions.ErrorRate > 0 && errorRate > monitor.conditions.ErrorRate {
+		return fmt.Sprintf("error rate of %.2f%% during the last %v, above %v%%", errorRate, windowDuration, monitor.conditions.ErrorRate)
+	}
+
+	return ""
+}
+
+// getSecond returns the bucket of the given second, resetting it if it holds an older second
+func (monitor *Monitor) getSecond(unixSecond int64) *second {
+
+	bucket := &monitor.window[unixSecond%int64(len(monitor.window))]
+	if bucket.unixSecond != unixSecond {
+		*bucket = second{
+			unixSecond: unixSecond,
+		}
+	}
+
+	return bucket
+}
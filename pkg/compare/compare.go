@@ -0,0 +1,323 @@
+package compare
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/export"
+)
+
+// Metric is a metric of an action that can be compared between two runs
+type Metric string
+
+const (
+	// Mean is the mean duration of the action
+	Mean Metric = "mean"
+	// P50 is the median duration of the action
+	P50 Metric = "p50"
+	// P95 is the 95th percentile of the duration of the action
+	P95 Metric = "p95"
+	// P99 is the 99th percentile of the duration of the action
+	P99 Metric = "p99"
+	// ErrorRate is the ratio of failed executions of the action
+	ErrorRate Metric = "error_rate"
+)
+
+// AllMetrics are all the metrics compared, in the order they are displayed
+var AllMetrics = []Metric{Mean, P50, P95, P99, ErrorRate}
+
+// Delta is the difference of a metric between the baseline and the current run
+type Delta struct {
+	Metric   Metric
+	Baseline float64
+	Current  float64
+	// Change is the change of the metric, positive when the metric is worse. It is relative to the baseline for the
+	// durations and absolute, in percentage points, for the error rate. It is NaN if the baseline duration is zero,
+	// as the baseline has no successful execution to compare to.
+	Change float64
+	// Regression is true if the metric is checked and is worse than the tolerance allows
+	Regression bool
+}
+
+// ActionComparison is the comparison of an action between the baseline and the current run
+type ActionComparison struct {
+	ScenarioName string
+	StageName    string
+	ActionName   string
+	// Baseline is nil if the action was not in the baseline
+	Baseline *export.ActionSummary
+	// Current is nil if the action is not in the current run
+	Current *export.ActionSummary
+	Deltas  []Delta
+}
+
+// Comparison is the comparison of all the actions of two runs
+type Comparison struct {
+	Tolerance          float64
+	ErrorRateTolerance float64
+	Actions            []*ActionComparison
+}
+
+// Compare compares the actions of two runs. The actions are matched by the names of their scenario, if any, of their
+// stage and their own name, so that the definition of the test can change between the runs. A metric is a regression
+// if it is worse than in the baseline by more than the tolerance, relatively to the baseline for the durations and in
+// percentage points for the error rate, so that a baseline without failure does not make any failure a regression.
+//
+// Params:
+//  - baseline: the results of the reference run
+//  - current: the results of the run to check
+//  - tolerance: the accepted relative degradation of the durations, for example 0.1 for 10%
+//  - errorRateTolerance: the accepted increase of the error rate, for example 0.01 for 1 percentage point
+//  - checked: the metrics checked for regression
+//
+// Return the comparison
+func Compare(baseline *export.Results, current *export.Results, tolerance float64, errorRateTolerance float64, checked []Metric) *Comparison {
+
+	comparison := &Comparison{
+		Tolerance:          tolerance,
+		ErrorRateTolerance: errorRateTolerance,
+		Actions:            make([]*ActionComparison, 0),
+	}
+
+	isChecked := make(map[Metric]bool, len(checked))
+	for _, metric := range checked {
+		isChecked[metric] = true
+	}
+
+	type actionKey struct {
+		scenarioName string
+		stageName    string
+		actionName   string
+	}
+
+	// Start with the actions of the current run, so that they are displayed in the order of the current test
+	byKey := make(map[actionKey]*ActionComparison)
+
+	for _, stage := range current.Stages {
+		for i := range stage.Actions {
+			key := actionKey{stage.Scenario, stage.Name, stage.Actions[i].Name}
+			if _, ok := byKey[key]; ok {
+				continue
+			}
+			actionComparison := &ActionComparison{
+				ScenarioName: stage.Scenario,
+				StageName:    stage.Name,
+				ActionName:   stage.Actions[i].Name,
+				Current:      &stage.Actions[i],
+			}
+			byKey[key] = actionComparison
+			comparison.Actions = append(comparison.Actions, actionComparison)
+		}
+	}
+
+	for _, stage := range baseline.Stages {
+		for i := range stage.Actions {
+			key := actionKey{stage.Scenario, stage.Name, stage.Actions[i].Name}
+			actionComparison, ok := byKey[key]
+			if !ok {
+				actionComparison = &ActionComparison{
+					ScenarioName: stage.Scenario,
+					StageName:    stage.Name,
+					ActionName:   stage.Actions[i].Name,
+				}
+				byKey[key] = actionComparison
+				comparison.Actions = append(comparison.Actions, actionComparison)
+			}
+			if actionComparison.Baseline == nil {
+				actionComparison.Baseline = &stage.Actions[i]
+			}
+		}
+	}
+
+	for _, actionComparison := range comparison.Actions {
+
+		if actionComparison.Baseline == nil || actionComparison.Current == nil {
+			continue
+		}
+
+		for _, metric := range AllMetrics {
+
+			delta := Delta{
+				Metric:   metric,
+				Baseline: getValue(&actionComparison.Baseline.Summary, metric),
+				Current:  getValue(&actionComparison.Current.Summary, metric),
+			}
+
+			switch {
+			case metric == ErrorRate:
+				delta.Change = delta.Current - delta.Baseline
+				delta.Regression = isChecked[metric] && delta.Change > errorRateTolerance
+			case delta.Baseline == delta.Current:
+				delta.Change = 0
+			case delta.Baseline == 0:
+				// Without any successful execution in the baseline, there is no duration to compare to
+				delta.Change = math.NaN()
+			default:
+				delta.Change = (delta.Current - delta.Baseline) / delta.Baseline
+				delta.Regression = isChecked[metric] && delta.Change > tolerance
+			}
+
+			actionComparison.Deltas = append(actionComparison.Deltas, delta)
+		}
+	}
+
+	return comparison
+}
+
+// HasRegression returns true if at least one checked metric of one action is a regression
+//
+// Return true if there is a regression
+func (comparison *Comparison) HasRegression() bool {
+
+	for _, action := range comparison.Actions {
+		for _, delta := range action.Deltas {
+			if delta.Regression {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Regressions returns a description of each regression, for example "Basic / Get user: p95 +25.00% (12ms -> 15ms)"
+//
+// Return the descriptions of the regressions
+func (comparison *Comparison) Regressions() []string {
+
+	regressions := make([]string, 0)
+	for _, action := range comparison.Actions {
+		for _, delta := range action.Deltas {
+			if delta.Regression {
+				regressions = append(
+					regressions,
+					fmt.Sprintf(
+						"%s / %s: %s %s (%s -> %s)",
+						action.FullStageName(),
+						action.ActionName,
+						delta.Metric,
+						delta.FormatChange(),
+						delta.Metric.FormatValue(delta.Baseline),
+						delta.Metric.FormatValue(delta.Current)))
+			}
+		}
+	}
+
+	return regressions
+}
+
+// FullStageName returns the name of the stage of the action, prefixed by its scenario if any
+func (action *ActionComparison) FullStageName() string {
+	return definition.FullStageName(action.ScenarioName, action.StageName)
+}
+
+// FormatChange returns the change as a percentage, for example "+12.50%", or in percentage points for the error
+// rate, for example "+1.50pp"
+//
+// Return the formatted change
+func (delta Delta) FormatChange() string {
+
+	if math.IsNaN(delta.Change) {
+		return "n/a"
+	}
+
+	if delta.Metric == ErrorRate {
+		return fmt.Sprintf("%+.2fpp", delta.Change*100.0)
+	}
+
+	return fmt.Sprintf("%+.2f%%", delta.Change*100.0)
+}
+
+// FormatValue returns a value of the metric with its unit: milliseconds for the durations and percentage for the
+// error rate
+//
+// Params:
+//  - value: the value of the metric
+//
+// Return the formatted value
+func (metric Metric) FormatValue(value float64) string {
+
+	if metric == ErrorRate {
+		return fmt.Sprintf("%.2f%%", value*100.0)
+	}
+
+	return fmt.Sprintf("%.3fms", value/1000000.0)
+}
+
+// ParseMetrics converts a comma separated list of metrics, such as "p95,error_rate"
+//
+// Params:
+//  - value: the list of metrics
+//
+// Return the metrics or an error if a metric is unknown
+func ParseMetrics(value string) ([]Metric, error) {
+
+	metrics := make([]Metric, 0)
+	for _, name := range strings.Split(value, ",") {
+
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+
+		found := false
+		for _, metric := range AllMetrics {
+			if string(metric) == name {
+				metrics = append(metrics, metric)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("the metric '%s' is unknown, expected one of mean, p50, p95, p99 or error_rate", name)
+		}
+	}
+
+	return metrics, nil
+}
+
+// ParseTolerance converts a tolerance given as a percentage, such as "10%", or as a ratio, such as "0.1"
+//
+// Params:
+//  - value: the tolerance
+//
+// Return the tolerance as a ratio or an error if the value is not valid
+func ParseTolerance(value string) (float64, error) {
+
+	value = strings.TrimSpace(value)
+
+	divider := 1.0
+	if strings.HasSuffix(value, "%") {
+		value = strings.TrimSuffix(value, "%")
+		divider = 100.0
+	}
+
+	tolerance, err := strconv.ParseFloat(value, 64)
+	if err != nil || tolerance < 0 {
+		return 0, fmt.Errorf("the tolerance '%s' is not valid, expected a percentage such as '10%%' or a ratio such as '0.1'", value)
+	}
+
+	return tolerance / divider, nil
+}
+
+func getValue(summary *export.Summary, metric Metric) float64 {
+
+	switch metric {
+	case Mean:
+		return float64(summary.MeanNano)
+	case P50:
+		return float64(summary.P50Nano)
+	case P95:
+		return float64(summary.P95Nano)
+	case P99:
+		return float64(summary.P99Nano)
+	case ErrorRate:
+		return summary.ErrorRate
+	}
+
+	return 0
+}
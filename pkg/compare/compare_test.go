@@ -0,0 +1,67 @@
+package compare
+
+import (
+	"testing"
+
+	"github.com/twuillemin/gargote/pkg/export"
+)
+
+// newResults creates the results of a run with a single action
+func newResults(p95Nano int64, errorRate float64) *export.Results {
+	return &export.Results{
+		Stages: []export.StageSummary{
+			{
+				Name: "stage",
+				Actions: []export.ActionSummary{
+					{
+						Name:    "action",
+						Summary: export.Summary{P95Nano: p95Nano, ErrorRate: errorRate},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestCompare(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		baselineP95       int64
+		baselineErrorRate float64
+		currentP95        int64
+		currentErrorRate  float64
+		regression        bool
+		changes           map[Metric]string
+	}{
+		{"same values", 100, 0.02, 100, 0.02, false, map[Metric]string{P95: "+0.00%", ErrorRate: "+0.00pp"}},
+		{"duration within the tolerance", 100, 0, 109, 0, false, map[Metric]string{P95: "+9.00%"}},
+		{"duration above the tolerance", 100, 0, 120, 0, true, map[Metric]string{P95: "+20.00%"}},
+		{"first failures within the tolerance", 100, 0, 100, 0.005, false, map[Metric]string{ErrorRate: "+0.50pp"}},
+		{"first failures above the tolerance", 100, 0, 100, 0.05, true, map[Metric]string{ErrorRate: "+5.00pp"}},
+		{"error rate doubled within the tolerance", 100, 0.002, 100, 0.004, false, map[Metric]string{ErrorRate: "+0.20pp"}},
+		{"no successful execution in the baseline", 0, 1, 100, 0, false, map[Metric]string{P95: "n/a", ErrorRate: "-100.00pp"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			comparison := Compare(
+				newResults(test.baselineP95, test.baselineErrorRate),
+				newResults(test.currentP95, test.currentErrorRate),
+				0.1,
+				0.01,
+				[]Metric{P95, ErrorRate})
+
+			if comparison.HasRegression() != test.regression {
+				t.Errorf("expected a regression to be %v, got %v", test.regression, comparison.Regressions())
+			}
+
+			for _, delta := range comparison.Actions[0].Deltas {
+				if expected, ok := test.changes[delta.Metric]; ok && delta.FormatChange() != expected {
+					t.Errorf("%v: expected a change of %v, got %v", delta.Metric, expected, delta.FormatChange())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/histogram"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+const (
+	// windowSeconds is the duration, in seconds, of the rolling window used for the rates and the percentiles
+	windowSeconds = 10
+	// recentFailuresCount is the number of failures displayed
+	recentFailuresCount = 5
+	// maximumLogLines is the number of log lines kept while the full screen dashboard is displayed
+	maximumLogLines = 1000
+	// maximumMessageLength is the maximum length of the failure messages displayed
+	maximumMessageLength = 80
+
+	interactiveRefresh = 500 * time.Millisecond
+	plainRefresh       = 2 * time.Second
+)
+
+// ANSI escape sequences used by the full screen dashboard
+const (
+	enterAlternateScreen = "\x1b[?1049h\x1b[?25l"
+	leaveAlternateScreen = "\x1b[?25h\x1b[?1049l"
+	moveHome             = "\x1b[H"
+	clearEndOfLine       = "\x1b[K"
+	clearEndOfScreen     = "\x1b[J"
+)
+
+// second holds the results of an action during a single second
+type second struct {
+	unixSecond int64
+	nbSuccess  int64
+	nbFailure  int64
+	durations  *histogram.Histogram
+}
+
+// actionState holds the results of an action: the totals since the start and the rolling window
+type actionState struct {
+	stageName  string
+	actionName string
+	nbSuccess  int64
+	nbFailure  int64
+	window     [windowSeconds]second
+}
+
+// failure is a recent failure of an action
+type failure struct {
+	time       time.Time
+	stageName  string
+	actionName string
+	category   db.ErrorCategory
+	message    string
+}
+
+// Dashboard displays the progress of a test while it is running. It receives the results as a sink and must be
+// given to the runner, usually through a sink.Multi.
+type Dashboard struct {
+	sink.Base
+	mutex          sync.Mutex
+	test           definition.Test
+	start          time.Time
+	nbStarted      int64
+	nbFinished     int64
+	maximumActive  int64
+	actions        map[[2]int]*actionState
+	recentFailures []failure
+}
+
+// New creates a new Dashboard for a Test
+//
+// Params:
+//  - test: the Test that will be run
+//
+// Return the new Dashboard
+func New(test definition.Test) *Dashboard {
+	return &Dashboard{
+		test:    test,
+		start:   time.Now(),
+		actions: make(map[[2]int]*actionState),
+	}
+}
+
+// IsTerminal returns true if the file is a terminal, in which case the full screen dashboard can be displayed
+//
+// Params:
+//  - file: the file, usually os.Stdout
+//
+// Return true if the file is a terminal
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// TestStarted counts the started runs of the test
+func (dashboard *Dashboard) TestStarted(*db.TestEntry) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	dashboard.nbStarted++
+	if active := dashboard.nbStarted - dashboard.nbFinished; active > dashboard.maximumActive {
+		dashboard.maximumActive = active
+	}
+}
+
+// TestFinished counts the finished runs of the test
+func (dashboard *Dashboard) TestFinished(*db.TestEntry) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	dashboard.nbFinished++
+}
+
+// ActionFinished records the result of an action
+func (dashboard *Dashboard) ActionFinished(entry *db.ActionEntry) {
+
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	key := [2]int{entry.StageIndex, entry.ActionIndex}
+
+	state, ok := dashboard.actions[key]
+	if !ok {
+		stageName, actionName := sink.GetNames(dashboard.test, entry)
+		state = &actionState{
+			stageName:  stageName,
+			actionName: actionName,
+		}
+		dashboard.actions[key] = state
+	}
+
+	endTime := time.Unix(0, int64(entry.TimeNano+entry.DurationNano))
+	bucket := state.getSecond(endTime.Unix())
+
+	if entry.Success {
+		state.nbSuccess++
+		bucket.nbSuccess++
+		bucket.durations.Record(int64(entry.DurationNano))
+		return
+	}
+
+	state.nbFailure++
+	bucket.nbFailure++
+
+	dashboard.recentFailures = append(dashboard.recentFailures, failure{
+		time:       endTime,
+		stageName:  state.stageName,
+		actionName: state.actionName,
+		category:   entry.ErrorCategory,
+		message:    entry.ErrorMessage,
+	})
+	if len(dashboard.recentFailures) > recentFailuresCount {
+		dashboard.recentFailures = dashboard.recentFailures[1:]
+	}
+}
+
+// getSecond returns the bucket of the rolling window for a second, resetting it if it holds an older second
+func (state *actionState) getSecond(unixSecond int64) *second {
+
+	bucket := &state.window[unixSecond%windowSeconds]
+	if bucket.unixSecond != unixSecond || bucket.durations == nil {
+		*bucket = second{
+			unixSecond: unixSecond,
+			durations:  histogram.New(),
+		}
+	}
+
+	return bucket
+}
+
+// windowTotals returns the results of the rolling window ending at the given second
+func (state *actionState) windowTotals(now int64) (int64, int64, *histogram.Histogram) {
+
+	var nbSuccess, nbFailure int64
+	durations := histogram.New()
+
+	for i := range state.window {
+		bucket := &state.window[i]
+		if bucket.durations == nil || bucket.unixSecond <= now-windowSeconds || bucket.unixSecond > now {
+			continue
+		}
+		nbSuccess += bucket.nbSuccess
+		nbFailure += bucket.nbFailure
+		durations.Merge(bucket.durations)
+	}
+
+	return nbSuccess, nbFailure, durations
+}
+
+// Run displays the dashboard until the context is done. A last display is done before returning, so that the final
+// state is visible.
+//
+// When interactive is true, the dashboard is displayed full screen and refreshed twice a second. As the logs would
+// break the display, they are kept in memory and written to their original destination once the dashboard is
+// closed. Otherwise, a single line summarizing the progress is written every 2 seconds, which is suitable for CI logs.
+//
+// Params:
+//  - ctx: the context of the dashboard
+//  - writer: where the dashboard is written, usually os.Stdout
+//  - interactive: true for the full screen dashboard
+func (dashboard *Dashboard) Run(ctx context.Context, writer io.Writer, interactive bool) {
+
+	refresh := plainRefresh
+	if interactive {
+		refresh = interactiveRefresh
+
+		logs := &logBuffer{}
+		logOutput := log.StandardLogger().Out
+		log.SetOutput(logs)
+
+		fmt.Fprint(writer, enterAlternateScreen)
+		defer func() {
+			fmt.Fprint(writer, leaveAlternateScreen)
+			log.SetOutput(logOutput)
+			logs.writeTo(logOutput)
+		}()
+	}
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			dashboard.display(writer, interactive)
+		case <-ctx.Done():
+			if !interactive {
+				dashboard.display(writer, interactive)
+			}
+			return
+		}
+	}
+}
+
+func (dashboard *Dashboard) display(writer io.Writer, interactive bool) {
+
+	if !interactive {
+		fmt.Fprintln(writer, dashboard.Summary())
+		return
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(moveHome)
+	for _, line := range dashboard.Lines() {
+		buffer.WriteString(line)
+		buffer.WriteString(clearEndOfLine)
+		buffer.WriteString("\n")
+	}
+	buffer.WriteString(clearEndOfScreen)
+
+	writer.Write(buffer.Bytes())
+}
+
+// Summary returns a single line summarizing the progress of the test
+//
+// Return the summary
+func (dashboard *Dashboard) Summary() string {
+
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	now := time.Now()
+	nbSuccess, nbFailure, durations := dashboard.windowTotals(now.Unix())
+
+	return fmt.Sprintf(
+		"[%6vs] runs: %v started, %v finished | active: %v (max %v) | %.1f req/s | errors: %s | p95: %v",
+		int(now.Sub(dashboard.start).Seconds()),
+		dashboard.formatStarted(),
+		dashboard.nbFinished,
+		dashboard.nbStarted-dashboard.nbFinished,
+		dashboard.maximumActive,
+		dashboard.rate(now, nbSuccess+nbFailure),
+		formatErrorRate(nbSuccess, nbFailure),
+		formatDuration(durations.Percentile(95)))
+}
+
+// Lines returns the lines of the full screen dashboard
+//
+// Return the lines
+func (dashboard *Dashboard) Lines() []string {
+
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	now := time.Now()
+	nbSuccess, nbFailure, _ := dashboard.windowTotals(now.Unix())
+
+	var totalSuccess, totalFailure int64
+	for _, state := range dashboard.actions {
+		totalSuccess += state.nbSuccess
+		totalFailure += state.nbFailure
+	}
+
+	lines := []string{
+		fmt.Sprintf("Gargote - %s", dashboard.test.TestName),
+		"",
+		fmt.Sprintf("Elapsed:      %v", now.Sub(dashboard.start).Round(time.Second)),
+		fmt.Sprintf("Runs:         %v started, %v finished", dashboard.formatStarted(), dashboard.nbFinished),
+		fmt.Sprintf("Active users: %v (max %v)", dashboard.nbStarted-dashboard.nbFinished, dashboard.maximumActive),
+		fmt.Sprintf("Requests:     %v, %.1f req/s (last %vs)", totalSuccess+totalFailure, dashboard.rate(now, nbSuccess+nbFailure), windowSeconds),
+		fmt.Sprintf("Errors:       %v, %s (last %vs)", totalFailure, formatErrorRate(nbSuccess, nbFailure), windowSeconds),
+		"",
+		fmt.Sprintf("%-40s %8s %8s %8s %10s %10s %10s", fmt.Sprintf("Action (last %vs)", windowSeconds), "req/s", "errors", "total", "p50", "p95", "p99"),
+	}
+
+	for stageIndex, stage := range dashboard.test.Stages {
+		for actionIndex := range stage.Actions {
+
+			state, ok := dashboard.actions[[2]int{stageIndex, actionIndex}]
+			if !ok {
+				continue
+			}
+
+			actionSuccess, actionFailure, durations := state.windowTotals(now.Unix())
+
+			lines = append(lines, fmt.Sprintf(
+				"%-40s %8.1f %8s %8v %10v %10v %10v",
+				truncate(state.stageName+" / "+state.actionName, 40),
+				dashboard.rate(now, actionSuccess+actionFailure),
+				formatErrorRate(actionSuccess, actionFailure),
+				state.nbSuccess+state.nbFailure,
+				formatDuration(durations.Percentile(50)),
+				formatDuration(durations.Percentile(95)),
+				formatDuration(durations.Percentile(99))))
+		}
+	}
+
+	lines = append(lines, "", "Recent failures:")
+	if len(dashboard.recentFailures) == 0 {
+		lines = append(lines, "  none")
+	}
+	for i := len(dashboard.recentFailures) - 1; i >= 0; i-- {
+		recent := dashboard.recentFailures[i]
+		lines = append(lines, fmt.Sprintf(
+			"  %s %s / %s [%s] %s",
+			recent.time.Format("15:04:05"),
+			recent.stageName,
+			recent.actionName,
+			recent.category.ToString(),
+			truncate(recent.message, maximumMessageLength)))
+	}
+
+	return lines
+}
+
+// windowTotals returns the results of all the actions in the rolling window ending at the given second
+func (dashboard *Dashboard) windowTotals(now int64) (int64, int64, *histogram.Histogram) {
+
+	var nbSuccess, nbFailure int64
+	durations := histogram.New()
+
+	for _, state := range dashboard.actions {
+		actionSuccess, actionFailure, actionDurations := state.windowTotals(now)
+		nbSuccess += actionSuccess
+		nbFailure += actionFailure
+		durations.Merge(actionDurations)
+	}
+
+	return nbSuccess, nbFailure, durations
+}
+
+// rate returns the number of requests by second in the rolling window, which may be shorter at the start of the test
+func (dashboard *Dashboard) rate(now time.Time, count int64) float64 {
+
+	window := now.Sub(dashboard.start).Seconds()
+	if window > windowSeconds {
+		window = windowSeconds
+	}
+	if window < 1 {
+		window = 1
+	}
+
+	return float64(count) / window
+}
+
+// formatStarted returns the number of started tests, with the expected number of tests if it is known
+func (dashboard *Dashboard) formatStarted() string {
+
+	expected := dashboard.test.Swarm.ExpectedNumberOfRuns()
+	if expected == 0 {
+		return fmt.Sprintf("%v", dashboard.nbStarted)
+	}
+
+	return fmt.Sprintf("%v/%v", dashboard.nbStarted, expected)
+}
+
+func formatErrorRate(nbSuccess int64, nbFailure int64) string {
+	if nbSuccess+nbFailure == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", float64(nbFailure)*100.0/float64(nbSuccess+nbFailure))
+}
+
+func formatDuration(durationNano int64) string {
+	if durationNano == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", float64(durationNano)/float64(time.Millisecond))
+}
+
+func truncate(value string, length int) string {
+	value = strings.Replace(value, "\n", " ", -1)
+	if len(value) <= length {
+		return value
+	}
+	return value[:length-3] + "..."
+}
+
+// logBuffer keeps the last log lines written while the full screen dashboard is displayed
+type logBuffer struct {
+	mutex   sync.Mutex
+	lines   [][]byte
+	dropped int
+}
+
+func (buffer *logBuffer) Write(data []byte) (int, error) {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.lines = append(buffer.lines, append([]byte(nil), data...))
+	if len(buffer.lines) > maximumLogLines {
+		buffer.lines = buffer.lines[1:]
+		buffer.dropped++
+	}
+
+	return len(data), nil
+}
+
+func (buffer *logBuffer) writeTo(writer io.Writer) {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if buffer.dropped > 0 {
+		fmt.Fprintf(writer, "... %v older log line(s) dropped\n", buffer.dropped)
+	}
+	for _, line := range buffer.lines {
+		writer.Write(line)
+	}
+}
@@ -1,22 +1,173 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/hashicorp/go-memdb"
+	"strings"
+	"sync"
 )
 
-// db is the pointer to the in memory database
+// db is the pointer to the in memory database. As it is replaced by CreateDatabase while it may be read, for example
+// by a server displaying the previous run, it is only accessed through getDatabase and under dbMutex.
 var db *memdb.MemDB
+var dbMutex sync.RWMutex
 
-// ActionEntry is the format of the data for recording the execution of a single action
+// ErrorCategory defines the reason for which an action failed
+type ErrorCategory int
+
+const (
+	// NoError is for actions that did not fail
+	NoError ErrorCategory = iota
+	// NetworkError is for actions that failed while sending the query or reading the response
+	NetworkError
+	// TimeoutError is for actions whose query timed out
+	TimeoutError
+	// StatusError is for actions whose response has an unexpected status code
+	StatusError
+	// HeaderError is for actions whose response has unexpected headers
+	HeaderError
+	// BodyError is for actions whose response has an unexpected body
+	BodyError
+	// CaptureError is for actions whose response could not be captured
+	CaptureError
+	// TemplateError is for actions whose query could not be prepared
+	TemplateError
+)
+
+var errorCategoryToString = map[ErrorCategory]string{
+	NoError:       "none",
+	NetworkError:  "network",
+	TimeoutError:  "timeout",
+	StatusError:   "status",
+	HeaderError:   "header",
+	BodyError:     "body",
+	CaptureError:  "capture",
+	TemplateError: "template",
+}
+
+var errorCategoryToID = map[string]ErrorCategory{
+	"none":     NoError,
+	"network":  NetworkError,
+	"timeout":  TimeoutError,
+	"status":   StatusError,
+	"header":   HeaderError,
+	"body":     BodyError,
+	"capture":  CaptureError,
+	"template": TemplateError,
+}
+
+// ToString returns the string representation of an ErrorCategory
+func (category ErrorCategory) ToString() string {
+	return errorCategoryToString[category]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (category ErrorCategory) MarshalJSON() ([]byte, error) {
+	return json.Marshal(errorCategoryToString[category])
+}
+
+// UnmarshalJSON unmarshals a quoted json string to the enum value
+func (category *ErrorCategory) UnmarshalJSON(data []byte) error {
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("the error category is expected to be a string")
+	}
+
+	c, ok := errorCategoryToID[value]
+	if !ok {
+		return fmt.Errorf("the error category '%s' is unknown", value)
+	}
+
+	// Copy the value
+	*category = c
+
+	return nil
+}
+
+// HTTPTimings is the duration of each phase of the HTTP request of an action. The phases that did not occur, for
+// example the DNS lookup and the connection when a connection is reused, have a duration of 0.
+type HTTPTimings struct {
+	DNSNano             int  `json:"dns_nano"`
+	ConnectNano         int  `json:"connect_nano"`
+	TLSNano             int  `json:"tls_nano"`
+	TimeToFirstByteNano int  `json:"time_to_first_byte_nano"`
+	TransferNano        int  `json:"transfer_nano"`
+	ConnectionReused    bool `json:"connection_reused"`
+}
+
+// FailureDetails holds the request and the response of a failed action. Depending on when the action failed, the
+// response may not be available. The bodies are truncated and the headers that may hold credentials are redacted.
+type FailureDetails struct {
+	RequestMethod   string              `json:"request_method,omitempty"`
+	RequestURL      string              `json:"request_url,omitempty"`
+	RequestHeaders  map[string][]string `json:"request_headers,omitempty"`
+	RequestBody     string              `json:"request_body,omitempty"`
+	ResponseStatus  string              `json:"response_status,omitempty"`
+	ResponseHeaders map[string][]string `json:"response_headers,omitempty"`
+	ResponseBody    string              `json:"response_body,omitempty"`
+}
+
+// redactedValue replaces the values of the sensitive headers
+const redactedValue = "[REDACTED]"
+
+// sensitiveHeaderWords are the words that make a header sensitive, as it may hold credentials
+var sensitiveHeaderWords = []string{"auth", "cookie", "token", "key", "secret", "password", "session", "signature"}
+
+// RedactHeaders returns a copy of the headers in which the values of the headers that may hold credentials, such as
+// Authorization, Cookie, Set-Cookie or X-Api-Key, are replaced
+//
+// Params:
+//  - headers: the headers
+//
+// Return the redacted headers
+func RedactHeaders(headers map[string][]string) map[string][]string {
+
+	if headers == nil {
+		return nil
+	}
+
+	redacted := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		redacted[name] = values
+		lowerName := strings.ToLower(name)
+		for _, word := range sensitiveHeaderWords {
+			if strings.Contains(lowerName, word) {
+				redacted[name] = []string{redactedValue}
+				break
+			}
+		}
+	}
+
+	return redacted
+}
+
+// ActionEntry is the format of the data for recording the execution of a single action. TimeNano is the Unix time,
+// in nanoseconds, at which the action started.
 type ActionEntry struct {
-	TestIndex    int
-	StageIndex   int
-	TryNumber    int
-	ActionIndex  int
-	TimeNano     int
-	DurationNano int
-	Success      bool
+	TestIndex     int           `json:"test_index"`
+	StageIndex    int           `json:"stage_index"`
+	TryNumber     int           `json:"try_number"`
+	ActionIndex   int           `json:"action_index"`
+	TimeNano      int           `json:"time_nano"`
+	DurationNano  int           `json:"duration_nano"`
+	Success       bool          `json:"success"`
+	StatusCode    int           `json:"status_code"`
+	ErrorCategory ErrorCategory `json:"error_category"`
+	ErrorMessage  string        `json:"error_message,omitempty"`
+	HTTPTimings
+	FailureDetails *FailureDetails `json:"failure_details,omitempty"`
+}
+
+// TestEntry is the format of the data for recording the execution of a single run of a test. TestEntry are recorded
+// when the test starts, with an EndTimeNano of 0, and updated when the test ends. The times are Unix times in
+// nanoseconds.
+type TestEntry struct {
+	TestIndex     int
+	StartTimeNano int
+	EndTimeNano   int
 }
 
 // CreateDatabase initializes the in memory database
@@ -48,7 +199,17 @@ func CreateDatabase() error {
 					"time_index": {
 						Name:    "time_index",
 						Unique:  false,
-						Indexer: &memdb.IntFieldIndex{Field: "TimeNano"},
+						Indexer: &timeFieldIndex{Field: "TimeNano"},
+					},
+				},
+			},
+			"test": {
+				Name: "test",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.IntFieldIndex{Field: "TestIndex"},
 					},
 				},
 			},
@@ -61,21 +222,34 @@ func CreateDatabase() error {
 		return err
 	}
 
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
 	db = newDatabase
 	return nil
 }
 
+// getDatabase returns the current database, nil if it was not created
+func getDatabase() *memdb.MemDB {
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	return db
+}
+
 // Insert inserts a new list of entries in the database
 //
 // Return an error if the database can not be initialized
 func Insert(actions []*ActionEntry) error {
 
-	if db == nil {
+	database := getDatabase()
+	if database == nil {
 		return errors.New("the database was not created prior to calling Insert")
 	}
 
 	// Create a write transaction
-	txn := db.Txn(true)
+	txn := database.Txn(true)
 
 	for _, action := range actions {
 		if err := txn.Insert("action", action); err != nil {
@@ -90,6 +264,30 @@ func Insert(actions []*ActionEntry) error {
 	return nil
 }
 
+// InsertTest inserts or updates the entry of a single run of a test
+//
+// Return an error if the database can not be initialized
+func InsertTest(test *TestEntry) error {
+
+	database := getDatabase()
+	if database == nil {
+		return errors.New("the database was not created prior to calling InsertTest")
+	}
+
+	// Create a write transaction
+	txn := database.Txn(true)
+
+	if err := txn.Insert("test", test); err != nil {
+		txn.Abort()
+		return err
+	}
+
+	// Commit the transaction
+	txn.Commit()
+
+	return nil
+}
+
 // RequestID is the identifier of an HTTP request made during the test. All the same requests done during multiple Test
 // or if the Stage is run another time after a failure have the same id.
 type RequestID struct {
@@ -108,8 +306,13 @@ type RequestResults struct {
 // Return the requests or an error if something went wrong
 func GetAllRequests() (map[RequestID]*RequestResults, error) {
 
+	database := getDatabase()
+	if database == nil {
+		return nil, errors.New("the database was not created prior to calling GetAllRequests")
+	}
+
 	// Create read-only transaction
-	txn := db.Txn(false)
+	txn := database.Txn(false)
 	defer txn.Abort()
 
 	// Get an iterator over all actions
@@ -156,3 +359,65 @@ func GetAllRequests() (map[RequestID]*RequestResults, error) {
 
 	return result, nil
 }
+
+// ForEachAction calls the given function for each action entry recorded in the database. The entries are given in no
+// particular order and must not be modified.
+//
+// Params:
+//  - callback: the function called for each entry
+//
+// Return an error if something went wrong
+func ForEachAction(callback func(action *ActionEntry)) error {
+
+	database := getDatabase()
+	if database == nil {
+		return errors.New("the database was not created prior to calling ForEachAction")
+	}
+
+	// Create read-only transaction
+	txn := database.Txn(false)
+	defer txn.Abort()
+
+	// Get an iterator over all actions
+	it, err := txn.Get("action", "id")
+	if err != nil {
+		return err
+	}
+
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		callback(obj.(*ActionEntry))
+	}
+
+	return nil
+}
+
+// ForEachTest calls the given function for each test entry recorded in the database. The entries are given in no
+// particular order and must not be modified.
+//
+// Params:
+//  - callback: the function called for each entry
+//
+// Return an error if something went wrong
+func ForEachTest(callback func(test *TestEntry)) error {
+
+	database := getDatabase()
+	if database == nil {
+		return errors.New("the database was not created prior to calling ForEachTest")
+	}
+
+	// Create read-only transaction
+	txn := database.Txn(false)
+	defer txn.Abort()
+
+	// Get an iterator over all tests
+	it, err := txn.Get("test", "id")
+	if err != nil {
+		return err
+	}
+
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		callback(obj.(*TestEntry))
+	}
+
+	return nil
+}
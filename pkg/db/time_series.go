@@ -0,0 +1,169 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/histogram"
+)
+
+// timeFieldIndex is an index on an int field holding a time. Contrary to memdb.IntFieldIndex, the values are encoded
+// in big endian so that the iteration on the index is done in chronological order. Negative values are not supported.
+type timeFieldIndex struct {
+	Field string
+}
+
+// FromObject extracts the index value from an object
+func (index *timeFieldIndex) FromObject(obj interface{}) (bool, []byte, error) {
+
+	value := reflect.Indirect(reflect.ValueOf(obj))
+
+	fieldValue := value.FieldByName(index.Field)
+	if !fieldValue.IsValid() || fieldValue.Kind() != reflect.Int {
+		return false, nil, fmt.Errorf("field '%s' for %#v is not a valid int", index.Field, obj)
+	}
+
+	return true, encodeTime(fieldValue.Int()), nil
+}
+
+// FromArgs builds the index value from a time given as an int
+func (index *timeFieldIndex) FromArgs(args ...interface{}) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, errors.New("must provide only a single argument")
+	}
+
+	value, ok := args[0].(int)
+	if !ok {
+		return nil, fmt.Errorf("argument must be an int: %#v", args[0])
+	}
+
+	return encodeTime(int64(value)), nil
+}
+
+func encodeTime(value int64) []byte {
+	if value < 0 {
+		value = 0
+	}
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(value))
+	return buffer
+}
+
+// TimeBucket holds the results of the actions started during a period of time
+type TimeBucket struct {
+	StartTimeNano int64
+	NbRequests    int
+	NbFailures    int
+	ActiveTests   int
+	Durations     *histogram.Histogram
+}
+
+// GetTimeSeries returns the results of the actions grouped by their starting time in consecutive buckets, from the
+// first started action to the last one. The durations are only recorded for successful actions. The number of active
+// tests is the number of tests that were running at some point during the bucket.
+//
+// Params:
+//  - bucketDuration: the duration of each bucket, for example 1 second
+//
+// Return the buckets in chronological order, or an error if something went wrong
+func GetTimeSeries(bucketDuration time.Duration) ([]*TimeBucket, error) {
+
+	database := getDatabase()
+	if database == nil {
+		return nil, errors.New("the database was not created prior to calling GetTimeSeries")
+	}
+
+	if bucketDuration <= 0 {
+		return nil, errors.New("the duration of the buckets must be positive")
+	}
+
+	bucketNano := bucketDuration.Nanoseconds()
+
+	// Create read-only transaction
+	txn := database.Txn(false)
+	defer txn.Abort()
+
+	// Get an iterator over all actions, in chronological order
+	it, err := txn.Get("action", "time_index")
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]*TimeBucket, 0)
+	var firstTimeNano int64
+
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		action := obj.(*ActionEntry)
+
+		if len(buckets) == 0 {
+			firstTimeNano = int64(action.TimeNano) - int64(action.TimeNano)%bucketNano
+		}
+
+		// Add the buckets up to the one of the action
+		bucketIndex := int((int64(action.TimeNano) - firstTimeNano) / bucketNano)
+		for len(buckets) <= bucketIndex {
+			buckets = append(buckets, &TimeBucket{
+				StartTimeNano: firstTimeNano + int64(len(buckets))*bucketNano,
+				Durations:     histogram.New(),
+			})
+		}
+
+		bucket := buckets[bucketIndex]
+		bucket.NbRequests++
+		if action.Success {
+			bucket.Durations.Record(int64(action.DurationNano))
+		} else {
+			bucket.NbFailures++
+		}
+	}
+
+	if len(buckets) == 0 {
+		return buckets, nil
+	}
+
+	// Count the active tests with the difference of active tests between each bucket
+	tests, err := txn.Get("test", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	differences := make([]int, len(buckets)+1)
+	lastBucket := int64(len(buckets) - 1)
+	nowNano := time.Now().UnixNano()
+
+	for obj := tests.Next(); obj != nil; obj = tests.Next() {
+		test := obj.(*TestEntry)
+
+		endTimeNano := int64(test.EndTimeNano)
+		if endTimeNano == 0 {
+			endTimeNano = nowNano
+		}
+
+		first := (int64(test.StartTimeNano) - firstTimeNano) / bucketNano
+		last := (endTimeNano - firstTimeNano) / bucketNano
+		if last < 0 || first > lastBucket {
+			continue
+		}
+		if first < 0 {
+			first = 0
+		}
+		if last > lastBucket {
+			last = lastBucket
+		}
+
+		differences[first]++
+		differences[last+1]--
+	}
+
+	active := 0
+	for i, bucket := range buckets {
+		active += differences[i]
+		bucket.ActiveTests = active
+	}
+
+	return buckets, nil
+}
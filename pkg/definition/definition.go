@@ -2,6 +2,8 @@ package definition
 
 import (
 	"errors"
+	"math"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -26,21 +28,138 @@ const (
 	HEAD
 )
 
-// Test is the structure of a test. The test is the higher level object. A Test is compose of various Stages.
+// Test is the structure of a test. The test is the higher level object. A Test is compose of various Stages. If a
+// RequestRate is given, the requests of all the actions of all the runs of the Test are paced so that this number of
+// requests by second is never exceeded. If a MaximumDuration (in seconds) is given, the run is aborted once it is
+// elapsed, and it is also aborted as soon as one of the AbortConditions is met.
 type Test struct {
-	TestName               string  `yaml:"test_name"`
-	ContinueOnStageFailure bool    `yaml:"continue_on_stage_failure,omitempty"`
-	Stages                 []Stage `yaml:"stages"`
-	Swarm                  Swarm   `yaml:"swarm,omitempty"`
+	TestName               string          `yaml:"test_name"`
+	ContinueOnStageFailure bool            `yaml:"continue_on_stage_failure,omitempty"`
+	Stages                 []Stage         `yaml:"stages"`
+	Swarm                  Swarm           `yaml:"swarm,omitempty"`
+	Thresholds             []Threshold     `yaml:"thresholds,omitempty"`
+	RequestRate            uint            `yaml:"request_rate,omitempty"`
+	Scenarios              []Scenario      `yaml:"scenarios,omitempty"`
+	MaximumDuration        uint            `yaml:"max_duration,omitempty"`
+	AbortConditions        AbortConditions `yaml:"abort_conditions,omitempty"`
 }
 
-// Swarm is the structure defining the startup options
+// AbortConditions are the conditions stopping a run early, to protect the target from a test going wrong. The run is
+// aborted as soon as one of them is met:
+//  - ErrorRate: the percentage of failed actions during the last Window seconds is above this value
+//  - ConsecutiveFailures: this number of actions failed in a row
+//  - Unreachable: during the last Window seconds, no action received a response from the target
+//
+// The conditions on the Window are only checked once the Window is elapsed since the first action.
+type AbortConditions struct {
+	ErrorRate           float64 `yaml:"error_rate,omitempty"`
+	Window              uint    `yaml:"window,omitempty"`
+	ConsecutiveFailures uint    `yaml:"consecutive_failures,omitempty"`
+	Unreachable         bool    `yaml:"unreachable,omitempty"`
+}
+
+// Scenario is one of the alternative paths of a Test. When a Test has scenarios, each run of the Test (each virtual
+// user in the closed model) executes only the stages of one scenario, the scenarios being chosen in proportion of
+// their Weight. The stages of a scenario are either given directly or read from the File of another Test. Once
+// loaded, the stages of all the scenarios are moved to the stages of the Test, each Stage giving the name of its
+// Scenario.
+type Scenario struct {
+	Name   string  `yaml:"scenario_name"`
+	Weight uint    `yaml:"weight"`
+	File   string  `yaml:"file,omitempty"`
+	Stages []Stage `yaml:"stages,omitempty"`
+}
+
+// Swarm is the structure defining the startup options. By default, the swarm follows an open model: NumberOfRuns
+// tests are started at CreationRate tests by second, whatever the number of tests already running, which can be
+// limited by MaximumConcurrency. If a Duration (in seconds) is given, the tests are started at CreationRate during the
+// Duration. If Phases are given, the tests are started following each phase in turn. In both cases, NumberOfRuns is
+// optional and limits the number of tests started.
+//
+// If VirtualUsers is given, the swarm follows a closed model instead: the virtual users are started at CreationRate
+// (or all at once if it is not given) and each one runs the test in a loop, waiting for the ThinkTime between two
+// runs, for the given number of Iterations and / or during the Duration. With a Pacing (in milliseconds), each
+// iteration of a user takes at least this duration, the user waiting after the think time if needed.
+//
+// In the open model, the Arrival gives how the starts of the tests are spread: at regular intervals (UniformArrival,
+// the default) or randomly, as independent users would arrive (PoissonArrival).
 type Swarm struct {
-	NumberOfRuns uint `yaml:"number_of_runs"`
-	CreationRate uint `yaml:"creation_rate"`
+	NumberOfRuns       uint      `yaml:"number_of_runs,omitempty"`
+	CreationRate       uint      `yaml:"creation_rate,omitempty"`
+	Duration           uint      `yaml:"duration,omitempty"`
+	Phases             []Phase   `yaml:"phases,omitempty"`
+	MaximumConcurrency uint      `yaml:"max_concurrency,omitempty"`
+	VirtualUsers       uint      `yaml:"virtual_users,omitempty"`
+	Iterations         uint      `yaml:"iterations,omitempty"`
+	ThinkTime          ThinkTime `yaml:"think_time,omitempty"`
+	Pacing             uint      `yaml:"pacing,omitempty"`
+	Arrival            string    `yaml:"arrival,omitempty"`
+}
+
+// StageIndexes returns the indexes of the stages of a Scenario of the Test
+//
+// Params:
+//  - scenarioName: the name of the scenario, or an empty string for a Test without scenarios
+//
+// Return the indexes of the stages
+func (test Test) StageIndexes(scenarioName string) []int {
+
+	indexes := make([]int, 0, len(test.Stages))
+	for stageIndex, stage := range test.Stages {
+		if stage.Scenario == scenarioName {
+			indexes = append(indexes, stageIndex)
+		}
+	}
+
+	return indexes
+}
+
+// FullName returns the name of the Stage, prefixed by the name of its Scenario if any, so that the stages of
+// different scenarios can have the same name
+func (stage Stage) FullName() string {
+	return FullStageName(stage.Scenario, stage.Name)
+}
+
+// FullStageName returns the name of a stage, prefixed by the name of its scenario if any, for example
+// "Browse / Get user"
+//
+// Params:
+//  - scenarioName: the name of the scenario of the stage, empty if the test has no scenarios
+//  - stageName: the name of the stage
+//
+// Return the full name of the stage
+func FullStageName(scenarioName string, stageName string) string {
+	if len(scenarioName) == 0 {
+		return stageName
+	}
+	return scenarioName + " / " + stageName
+}
+
+// Phase is a period of a Swarm during which the creation rate goes linearly from CreationRate to TargetRate (both in
+// tests by second). If CreationRate is not given, the phase starts at the rate the previous phase ended with. If
+// TargetRate is not given, the rate is constant during the phase. This allows to describe ramps (only TargetRate),
+// plateaus and spikes (only CreationRate).
+type Phase struct {
+	Name         string `yaml:"phase_name,omitempty"`
+	Duration     uint   `yaml:"duration"`
+	CreationRate *uint  `yaml:"creation_rate,omitempty"`
+	TargetRate   *uint  `yaml:"target_rate,omitempty"`
+}
+
+// Threshold is a pass/fail criterion evaluated against the results of the Test. The expression is a metric, a
+// comparison operator and a limit, for example "p95 < 300ms", "error_rate < 1%" or "throughput > 50 rps". The
+// threshold can be restricted to a Scenario, a Stage and / or an Action, otherwise it applies to all the actions of
+// the Test.
+type Threshold struct {
+	Expression  string `yaml:"threshold"`
+	Scenario    string `yaml:"scenario,omitempty"`
+	StageName   string `yaml:"stage_name,omitempty"`
+	ActionName  string `yaml:"action_name,omitempty"`
+	AbortOnFail bool   `yaml:"abort_on_fail,omitempty"`
 }
 
-// Stage is a logical partition inside a Test. A Stage is composed of various Actions.
+// Stage is a logical partition inside a Test. A Stage is composed of various Actions. If the Test has scenarios,
+// Scenario is the name of the scenario the Stage belongs to.
 type Stage struct {
 	Name                    string   `yaml:"stage_name"`
 	MaximumRetries          uint     `yaml:"max_retries,omitempty"`
@@ -48,13 +167,35 @@ type Stage struct {
 	DelayAfter              uint     `yaml:"delay_after,omitempty"`
 	ContinueOnActionFailure bool     `yaml:"continue_on_action_failure,omitempty"`
 	Actions                 []Action `yaml:"actions"`
+	Scenario                string   `yaml:"scenario,omitempty"`
 }
 
-// Action is a single query/response to a REST service. Each Action is composed of one Query and One Response.
+// Action is a single query/response to a REST service. Each Action is composed of one Query and One Response. If a
+// RequestRate is given, the requests of the Action in all the runs of the Test are paced so that this number of
+// requests by second is never exceeded. If a ThinkTime is given, the run waits for it after the Action succeeded.
 type Action struct {
-	Name     string   `yaml:"action_name"`
-	Query    Query    `yaml:"query"`
-	Response Response `yaml:"response"`
+	Name        string    `yaml:"action_name"`
+	Query       Query     `yaml:"query"`
+	Response    Response  `yaml:"response"`
+	RequestRate uint      `yaml:"request_rate,omitempty"`
+	ThinkTime   ThinkTime `yaml:"think_time,omitempty"`
+}
+
+// ThinkTime is a random delay simulating the time a user takes before the next request. The delay follows the
+// Distribution, all the values being in milliseconds:
+//  - FixedDistribution: the delay is always Duration
+//  - UniformDistribution: the delay is between Minimum and Maximum
+//  - NormalDistribution: the delay has a mean of Duration and a standard deviation of StdDev
+//  - ExponentialDistribution: the delay has a mean of Duration
+//
+// The delay is never negative and, if a Maximum is given, never greater than the Maximum. In YAML, a think time can
+// also be given as a single number, for a fixed delay.
+type ThinkTime struct {
+	Distribution string `yaml:"distribution,omitempty"`
+	Duration     uint   `yaml:"duration,omitempty"`
+	Minimum      uint   `yaml:"min,omitempty"`
+	Maximum      uint   `yaml:"max,omitempty"`
+	StdDev       uint   `yaml:"std_dev,omitempty"`
 }
 
 // Query is the query executed against a REST service.
@@ -89,6 +230,28 @@ type Capture struct {
 	BodyText string            `yaml:"body_text,omitempty"`
 }
 
+const (
+	// FixedDistribution is for think times that are always the same
+	FixedDistribution = "fixed"
+	// UniformDistribution is for think times uniformly distributed between a minimum and a maximum
+	UniformDistribution = "uniform"
+	// NormalDistribution is for think times following a normal distribution
+	NormalDistribution = "normal"
+	// ExponentialDistribution is for think times following an exponential distribution
+	ExponentialDistribution = "exponential"
+)
+
+// DefaultAbortWindow is the number of seconds on which the abort conditions are checked, if not given
+const DefaultAbortWindow = 10
+
+const (
+	// UniformArrival starts the tests of a swarm at regular intervals
+	UniformArrival = "uniform"
+	// PoissonArrival starts the tests of a swarm at random intervals, following a Poisson process with the creation
+	// rate of the swarm
+	PoissonArrival = "poisson"
+)
+
 var toString = map[Method]string{
 	GET:     "GET",
 	PUT:     "PUT",
@@ -109,6 +272,123 @@ var toID = map[string]Method{
 	"HEAD":    HEAD,
 }
 
+// IsClosedModel returns if the Swarm is made of virtual users running the test in a loop
+func (swarm Swarm) IsClosedModel() bool {
+	return swarm.VirtualUsers > 0
+}
+
+// IsLimitedByDuration returns if the number of tests started by the Swarm is given by its duration, rather than by
+// its number of runs or of iterations
+func (swarm Swarm) IsLimitedByDuration() bool {
+	if swarm.IsClosedModel() {
+		return swarm.Iterations == 0
+	}
+	return swarm.Duration > 0 || len(swarm.Phases) > 0
+}
+
+// TotalDuration returns the time during which the Swarm starts tests, or 0 if the Swarm is only limited by its number
+// of runs
+func (swarm Swarm) TotalDuration() time.Duration {
+
+	if len(swarm.Phases) == 0 {
+		return time.Duration(swarm.Duration) * time.Second
+	}
+
+	var total time.Duration
+	for _, phase := range swarm.Phases {
+		total += time.Duration(phase.Duration) * time.Second
+	}
+
+	return total
+}
+
+// ExpectedNumberOfRuns returns the number of tests that the Swarm should start if it is not interrupted, or 0 if it
+// can not be known in advance, as for virtual users running during a duration
+func (swarm Swarm) ExpectedNumberOfRuns() uint {
+
+	if swarm.IsClosedModel() {
+		expected := swarm.VirtualUsers * swarm.Iterations
+		if swarm.NumberOfRuns > 0 && (expected == 0 || swarm.NumberOfRuns < expected) {
+			return swarm.NumberOfRuns
+		}
+		return expected
+	}
+
+	if !swarm.IsLimitedByDuration() {
+		return swarm.NumberOfRuns
+	}
+
+	var expected float64
+	if len(swarm.Phases) == 0 {
+		expected = float64(swarm.CreationRate) * float64(swarm.Duration)
+	} else {
+		for _, phase := range swarm.Phases {
+			from, to := phase.Rates()
+			expected += float64(from+to) / 2.0 * float64(phase.Duration)
+		}
+	}
+
+	if swarm.NumberOfRuns > 0 && float64(swarm.NumberOfRuns) < expected {
+		return swarm.NumberOfRuns
+	}
+
+	return uint(math.Floor(expected))
+}
+
+// MaximumNumberOfRuns returns the maximum number of tests that the Swarm can start, or 0 if there is no limit known
+// in advance. This is the expected number of runs, except for Poisson arrivals during a duration, whose number of runs
+// is random and is only limited by NumberOfRuns.
+func (swarm Swarm) MaximumNumberOfRuns() uint {
+
+	if !swarm.IsClosedModel() && swarm.IsLimitedByDuration() && swarm.Arrival == PoissonArrival {
+		return swarm.NumberOfRuns
+	}
+
+	return swarm.ExpectedNumberOfRuns()
+}
+
+// Rates returns the creation rate at the beginning and at the end of the Phase. The rates not given are considered as
+// being 0, as the loader sets them from the previous phases.
+func (phase Phase) Rates() (uint, uint) {
+
+	var from, to uint
+	if phase.CreationRate != nil {
+		from = *phase.CreationRate
+	}
+	if phase.TargetRate != nil {
+		to = *phase.TargetRate
+	} else {
+		to = from
+	}
+
+	return from, to
+}
+
+// IsZero returns true if the ThinkTime does not make any delay
+func (thinkTime ThinkTime) IsZero() bool {
+	return thinkTime.Duration == 0 && thinkTime.Maximum == 0
+}
+
+// UnmarshalYAML unmarshals a think time given as a single number of milliseconds or as an object
+func (thinkTime *ThinkTime) UnmarshalYAML(node *yaml.Node) error {
+
+	if node.Kind == yaml.ScalarNode {
+		var duration uint
+		if err := node.Decode(&duration); err != nil {
+			return errors.New("the think time is expected to be a number of milliseconds or an object")
+		}
+		*thinkTime = ThinkTime{
+			Distribution: FixedDistribution,
+			Duration:     duration,
+		}
+		return nil
+	}
+
+	// Use another type, so that this function is not called recursively
+	type plainThinkTime ThinkTime
+	return node.Decode((*plainThinkTime)(thinkTime))
+}
+
 // ToString returns the string representation of a Method
 func (method Method) ToString() string {
 	return toString[method]
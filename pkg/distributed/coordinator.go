@@ -0,0 +1,622 @@
+package distributed
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/sink"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// startDelay is the delay given to the workers to receive their assignment before the synchronized start
+	startDelay = 1 * time.Second
+	// assignmentPollTimeout is the maximum duration a worker waits for its assignment in a single query
+	assignmentPollTimeout = 30 * time.Second
+	// workerTimeout is the duration after which a worker that did not send results is considered lost
+	workerTimeout = 30 * time.Second
+)
+
+// remoteWorker is a worker registered to the coordinator
+type remoteWorker struct {
+	id         string
+	name       string
+	assignment chan *assignment
+	// The following fields are only set for the workers taking part in the run
+	position       int
+	numberOfShares int
+	lastSeen       time.Time
+	finished       bool
+}
+
+// Coordinator distributes a test to workers and collects their results. The number of runs and the creation rates of
+// the test are split between the workers, which all start at the same time. Their results are given to the result
+// sink of the coordinator as if the test was run locally, the test indexes of the workers being interleaved so that
+// they stay unique.
+type Coordinator struct {
+	mutex           sync.Mutex
+	expectedWorkers int
+	workers         []*remoteWorker
+	workersByID     map[string]*remoteWorker
+	allRegistered   chan struct{}
+	runID           string
+	resultSink      sink.ResultSink
+	// replays counts the results being given to the result sink, which are waited for before the end of the run
+	replays sync.WaitGroup
+	aborted         bool
+	progress        chan struct{}
+	startTime       time.Time
+	// token is required from the workers if not empty, as the assignments contain the whole definition of the test
+	token string
+}
+
+// NewCoordinator creates a new Coordinator
+//
+// Params:
+//  - expectedWorkers: the number of workers the test is distributed to
+//  - token: the bearer token required from the workers, or an empty string to accept any worker
+//
+// Return the new Coordinator
+func NewCoordinator(expectedWorkers int, token string) *Coordinator {
+	return &Coordinator{
+		expectedWorkers: expectedWorkers,
+		workersByID:     make(map[string]*remoteWorker),
+		allRegistered:   make(chan struct{}),
+		progress:        make(chan struct{}, 1),
+		token:           token,
+	}
+}
+
+// Serve starts an HTTP server on which the workers register and send their results. The server runs until the
+// context is done.
+//
+// Params:
+//  - ctx: the context of the server
+//  - address: the address to listen to, for example ":7000"
+//
+// Return an error if the server can not listen to the address
+func (coordinator *Coordinator) Serve(ctx context.Context, address string) error {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: coordinator.router()}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("the coordinator server stopped due to %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Warnf("unable to close the coordinator server due to %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// router returns the HTTP handler on which the workers register and send their results
+func (coordinator *Coordinator) router() *gin.Engine {
+
+	router := gin.New()
+	router.Use(gin.Recovery())
+	if len(coordinator.token) > 0 {
+		router.Use(coordinator.checkToken)
+	}
+	router.POST("/workers", coordinator.register)
+	router.GET("/workers/:id/assignment", coordinator.getAssignment)
+	router.POST("/workers/:id/results", coordinator.receiveResults)
+
+	return router
+}
+
+// WaitForWorkers waits until the expected number of workers is registered
+//
+// Params:
+//  - ctx: the context. The function returns an error if it is done before all the workers are registered.
+//
+// Return an error if the context is done first
+func (coordinator *Coordinator) WaitForWorkers(ctx context.Context) error {
+
+	select {
+	case <-coordinator.allRegistered:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("only %v worker(s) registered out of %v", coordinator.numberOfWorkers(), coordinator.expectedWorkers)
+	}
+}
+
+// Run distributes the test to the registered workers and waits for their results. When the context is done, the
+// workers are told to stop their tests, and their last results are still collected.
+//
+// Params:
+//  - ctx: the context of the run
+//  - test: the Test to execute
+//  - resultSink: the sink receiving the results of all the workers. It is not closed by the function.
+//
+// Return an error if the workers were not all registered
+func (coordinator *Coordinator) Run(ctx context.Context, test definition.Test, resultSink sink.ResultSink) error {
+
+	select {
+	case <-coordinator.allRegistered:
+	default:
+		return errors.New("the workers are not all registered")
+	}
+
+	coordinator.mutex.Lock()
+	workers := coordinator.workers[:coordinator.expectedWorkers]
+	coordinator.runID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	coordinator.resultSink = resultSink
+	defer coordinator.endRun()
+
+	// Split the test
+	swarms, err := splitSwarm(test.Swarm, len(workers))
+	if err != nil {
+		coordinator.mutex.Unlock()
+		return err
+	}
+	workerTests, err := splitRequestRates(test, len(workers))
+	if err != nil {
+		coordinator.mutex.Unlock()
+		return err
+	}
+	startTime := time.Now().Add(startDelay)
+	coordinator.startTime = startTime
+
+	assignments := make([]*assignment, len(workers))
+	for i, worker := range workers {
+
+		worker.position = i
+		worker.numberOfShares = len(workers)
+		worker.lastSeen = time.Now()
+
+		// A worker without run or without virtual user has nothing to do
+		if hasNothingToRun(test.Swarm, swarms[i]) {
+			log.Warnf("worker %v (%v) has nothing to run, the test has not enough runs or creation rate for all the workers", worker.id, worker.name)
+			worker.finished = true
+			continue
+		}
+
+		workerTest := workerTests[i]
+		workerTest.Swarm = swarms[i]
+
+		data, err := yaml.Marshal(workerTest)
+		if err != nil {
+			coordinator.mutex.Unlock()
+			return err
+		}
+
+		assignments[i] = &assignment{
+			RunID:         coordinator.runID,
+			Definition:    string(data),
+			StartTimeNano: startTime.UnixNano(),
+		}
+
+		fmt.Printf("Worker %v (%v): %v\n", worker.id, worker.name, describeSwarm(swarms[i]))
+	}
+	coordinator.mutex.Unlock()
+
+	for i, worker := range workers {
+		if assignments[i] != nil {
+			worker.assignment <- assignments[i]
+		}
+	}
+
+	// Wait for the results of all the workers. Once the context is done, the workers are only told once to stop, and
+	// the wait continues on their results.
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	done := ctx.Done()
+
+	for {
+		if coordinator.checkFinished(workers) {
+			return nil
+		}
+
+		select {
+		case <-coordinator.progress:
+		case <-ticker.C:
+		case <-done:
+			coordinator.abort()
+			done = nil
+		}
+	}
+}
+
+// StartTime returns the time at which the workers started the test, once Run is called
+//
+// Return the start time
+func (coordinator *Coordinator) StartTime() time.Time {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	return coordinator.startTime
+}
+
+// endRun rejects the results received once the run is over and waits for the results being given to the result sink,
+// so that the result sink is not used after the end of the run
+func (coordinator *Coordinator) endRun() {
+
+	coordinator.mutex.Lock()
+	coordinator.runID = ""
+	coordinator.resultSink = nil
+	coordinator.mutex.Unlock()
+
+	coordinator.replays.Wait()
+}
+
+// checkFinished returns true when all the workers have sent their last results, or are lost
+func (coordinator *Coordinator) checkFinished(workers []*remoteWorker) bool {
+
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	allFinished := true
+	for _, worker := range workers {
+		if worker.finished {
+			continue
+		}
+		if time.Since(worker.lastSeen) > workerTimeout {
+			log.Errorf("worker %v (%v) did not send results for %v, its remaining results are lost", worker.id, worker.name, workerTimeout)
+			worker.finished = true
+			continue
+		}
+		allFinished = false
+	}
+
+	return allFinished
+}
+
+func (coordinator *Coordinator) abort() {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	if !coordinator.aborted {
+		log.Warnf("Asking the workers to stop")
+		coordinator.aborted = true
+	}
+}
+
+func (coordinator *Coordinator) numberOfWorkers() int {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	return len(coordinator.workers)
+}
+
+// checkToken rejects the queries of the workers without the token of the coordinator
+func (coordinator *Coordinator) checkToken(c *gin.Context) {
+
+	authorization := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(coordinator.token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "the token is missing or not valid"})
+		return
+	}
+
+	c.Next()
+}
+
+func (coordinator *Coordinator) register(c *gin.Context) {
+
+	var request registration
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	worker := &remoteWorker{
+		id:         strconv.Itoa(len(coordinator.workers) + 1),
+		name:       request.Name,
+		assignment: make(chan *assignment, 1),
+	}
+
+	coordinator.workers = append(coordinator.workers, worker)
+	coordinator.workersByID[worker.id] = worker
+
+	if len(coordinator.workers) <= coordinator.expectedWorkers {
+		fmt.Printf("Worker %v (%v) registered from %v, %v/%v\n", worker.id, worker.name, c.ClientIP(), len(coordinator.workers), coordinator.expectedWorkers)
+	} else {
+		log.Warnf("worker %v (%v) registered but %v worker(s) are already registered, it will not be used", worker.id, worker.name, coordinator.expectedWorkers)
+	}
+
+	if len(coordinator.workers) == coordinator.expectedWorkers {
+		close(coordinator.allRegistered)
+	}
+
+	c.JSON(http.StatusOK, registrationResponse{WorkerID: worker.id})
+}
+
+func (coordinator *Coordinator) getWorker(c *gin.Context) *remoteWorker {
+
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+
+	worker, ok := coordinator.workersByID[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the worker is not registered"})
+		return nil
+	}
+
+	return worker
+}
+
+func (coordinator *Coordinator) getAssignment(c *gin.Context) {
+
+	worker := coordinator.getWorker(c)
+	if worker == nil {
+		return
+	}
+
+	timer := time.NewTimer(assignmentPollTimeout)
+	defer timer.Stop()
+
+	select {
+	case assigned := <-worker.assignment:
+		c.JSON(http.StatusOK, assigned)
+	case <-timer.C:
+		c.Status(http.StatusNoContent)
+	case <-c.Request.Context().Done():
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func (coordinator *Coordinator) receiveResults(c *gin.Context) {
+
+	worker := coordinator.getWorker(c)
+	if worker == nil {
+		return
+	}
+
+	var request results
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	coordinator.mutex.Lock()
+	if len(request.RunID) == 0 || request.RunID != coordinator.runID {
+		coordinator.mutex.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "the run is not in progress"})
+		return
+	}
+	aborted := coordinator.aborted
+
+	// The last results of a worker may be sent again if their answer was lost, or may arrive after the worker was
+	// considered lost: they are not counted again
+	if worker.finished {
+		coordinator.mutex.Unlock()
+		c.JSON(http.StatusOK, resultsResponse{Abort: aborted})
+		return
+	}
+	worker.lastSeen = time.Now()
+	worker.finished = request.Finished
+	resultSink := coordinator.resultSink
+	position := worker.position
+	numberOfShares := worker.numberOfShares
+	coordinator.replays.Add(1)
+	coordinator.mutex.Unlock()
+
+	// Replay the events, with test indexes unique among the workers
+	for _, received := range request.Events {
+		switch received.Kind {
+
+		case testStartedEvent, testFinishedEvent:
+			if received.Test == nil {
+				continue
+			}
+			received.Test.TestIndex = received.Test.TestIndex*numberOfShares + position
+			if received.Kind == testStartedEvent {
+				resultSink.TestStarted(received.Test)
+			} else {
+				resultSink.TestFinished(received.Test)
+			}
+
+		case stageTriedEvent:
+			for _, action := range received.Actions {
+				action.TestIndex = action.TestIndex*numberOfShares + position
+				resultSink.ActionFinished(action)
+			}
+			var err error
+			if len(received.Error) > 0 {
+				err = errors.New(received.Error)
+			}
+			resultSink.StageTried(received.TestIndex*numberOfShares+position, received.StageIndex, received.TryNumber, received.Actions, err)
+		}
+	}
+
+	coordinator.replays.Done()
+
+	if request.Finished {
+		select {
+		case coordinator.progress <- struct{}{}:
+		default:
+		}
+	}
+
+	c.JSON(http.StatusOK, resultsResponse{Abort: aborted})
+}
+
+// CheckSplit checks that a test can be split between a number of workers, so that a test that can not be distributed
+// is rejected before waiting for the workers
+//
+// Params:
+//  - test: the test to distribute
+//  - numberOfWorkers: the number of workers
+//
+// Return an error if the rates or the concurrency of the test can not be split between the workers
+func CheckSplit(test definition.Test, numberOfWorkers int) error {
+
+	if _, err := splitSwarm(test.Swarm, numberOfWorkers); err != nil {
+		return err
+	}
+
+	_, err := splitRequestRates(test, numberOfWorkers)
+	return err
+}
+
+// splitSwarm splits a swarm in swarms whose sum is the swarm. The number of runs, if any, the creation rates, the
+// number of virtual users and the maximum concurrency are split, the other values being kept. As a zero creation rate
+// would be replaced by the default rate, or would start all the virtual users at once, and a zero maximum concurrency
+// would mean no limit, these values can not be split if they are lower than the number of parts. The rates of the
+// phases are rejected in the same way, so that each part keeps the shape of the phases.
+func splitSwarm(swarm definition.Swarm, numberOfParts int) ([]definition.Swarm, error) {
+
+	if swarm.CreationRate > 0 && swarm.CreationRate < uint(numberOfParts) {
+		return nil, fmt.Errorf("the creation rate of the swarm (%v/s) can not be split between %v workers", swarm.CreationRate, numberOfParts)
+	}
+	if swarm.MaximumConcurrency > 0 && swarm.MaximumConcurrency < uint(numberOfParts) {
+		return nil, fmt.Errorf("the maximum concurrency of the swarm (%v) can not be split between %v workers", swarm.MaximumConcurrency, numberOfParts)
+	}
+	for _, phase := range swarm.Phases {
+		from, to := phase.Rates()
+		if (from > 0 && from < uint(numberOfParts)) || (to > 0 && to < uint(numberOfParts)) {
+			return nil, fmt.Errorf("the rates of the phase %v (from %v/s to %v/s) can not be split between %v workers", phase.Name, from, to, numberOfParts)
+		}
+	}
+
+	swarms := make([]definition.Swarm, numberOfParts)
+
+	numberOfRuns := splitEvenly(swarm.NumberOfRuns, numberOfParts)
+	creationRates := splitEvenly(swarm.CreationRate, numberOfParts)
+	maximumConcurrencies := splitEvenly(swarm.MaximumConcurrency, numberOfParts)
+	virtualUsers := splitEvenly(swarm.VirtualUsers, numberOfParts)
+	for i := range swarms {
+		swarms[i] = definition.Swarm{
+			NumberOfRuns:       numberOfRuns[i],
+			CreationRate:       creationRates[i],
+			Duration:           swarm.Duration,
+			MaximumConcurrency: maximumConcurrencies[i],
+			VirtualUsers:       virtualUsers[i],
+			Iterations:         swarm.Iterations,
+			ThinkTime:          swarm.ThinkTime,
+			Pacing:             swarm.Pacing,
+			Arrival:            swarm.Arrival,
+		}
+	}
+
+	for _, phase := range swarm.Phases {
+		from, to := phase.Rates()
+		fromRates := splitEvenly(from, numberOfParts)
+		toRates := splitEvenly(to, numberOfParts)
+		for i := range swarms {
+			swarms[i].Phases = append(swarms[i].Phases, definition.Phase{
+				Name:         phase.Name,
+				Duration:     phase.Duration,
+				CreationRate: &fromRates[i],
+				TargetRate:   &toRates[i],
+			})
+		}
+	}
+
+	return swarms, nil
+}
+
+// splitRequestRates splits a test in tests whose request rates, of the test and of the actions, sum to those of the
+// test. As a zero would mean no limit, a rate lower than the number of parts can not be split.
+func splitRequestRates(test definition.Test, numberOfParts int) ([]definition.Test, error) {
+
+	tests := make([]definition.Test, numberOfParts)
+
+	if test.RequestRate > 0 && test.RequestRate < uint(numberOfParts) {
+		return nil, fmt.Errorf("the request rate of the test (%v/s) can not be split between %v workers", test.RequestRate, numberOfParts)
+	}
+	testRates := splitEvenly(test.RequestRate, numberOfParts)
+
+	for i := range tests {
+		tests[i] = test
+		tests[i].RequestRate = testRates[i]
+		tests[i].Stages = make([]definition.Stage, len(test.Stages))
+		for stageIndex, stage := range test.Stages {
+			tests[i].Stages[stageIndex] = stage
+			tests[i].Stages[stageIndex].Actions = make([]definition.Action, len(stage.Actions))
+			copy(tests[i].Stages[stageIndex].Actions, stage.Actions)
+		}
+	}
+
+	for stageIndex, stage := range test.Stages {
+		for actionIndex, action := range stage.Actions {
+			if action.RequestRate > 0 && action.RequestRate < uint(numberOfParts) {
+				return nil, fmt.Errorf("the request rate of the action %v (%v/s) can not be split between %v workers", action.Name, action.RequestRate, numberOfParts)
+			}
+			actionRates := splitEvenly(action.RequestRate, numberOfParts)
+			for i := range tests {
+				tests[i].Stages[stageIndex].Actions[actionIndex].RequestRate = actionRates[i]
+			}
+		}
+	}
+
+	return tests, nil
+}
+
+// hasNothingToRun returns if a part of a swarm, as given by splitSwarm, does not start any test
+//
+// Params:
+//  - swarm: the swarm that was split
+//  - part: the part of the swarm
+//
+// Return true if the part does not start any test
+func hasNothingToRun(swarm definition.Swarm, part definition.Swarm) bool {
+
+	// A zero would mean no limit instead of no run
+	if swarm.NumberOfRuns > 0 && part.NumberOfRuns == 0 {
+		return true
+	}
+	if swarm.IsClosedModel() {
+		return part.VirtualUsers == 0
+	}
+
+	return part.ExpectedNumberOfRuns() == 0
+}
+
+// describeSwarm returns a short description of the tests started by a swarm
+func describeSwarm(swarm definition.Swarm) string {
+
+	if swarm.IsClosedModel() {
+		if swarm.Iterations > 0 {
+			return fmt.Sprintf("%v virtual user(s) running %v iteration(s)", swarm.VirtualUsers, swarm.Iterations)
+		}
+		return fmt.Sprintf("%v virtual user(s) during %v", swarm.VirtualUsers, swarm.TotalDuration())
+	}
+
+	if len(swarm.Phases) > 0 {
+		return fmt.Sprintf("%v phase(s) during %v, about %v run(s)", len(swarm.Phases), swarm.TotalDuration(), swarm.ExpectedNumberOfRuns())
+	}
+	if swarm.Duration > 0 {
+		return fmt.Sprintf("%v run(s)/s during %v", swarm.CreationRate, swarm.TotalDuration())
+	}
+
+	return fmt.Sprintf("%v run(s) at %v/s", swarm.NumberOfRuns, swarm.CreationRate)
+}
+
+// splitEvenly splits a value in parts whose sum is the value, the first parts receiving the remainder
+func splitEvenly(value uint, numberOfParts int) []uint {
+
+	parts := make([]uint, numberOfParts)
+	for i := range parts {
+		parts[i] = value / uint(numberOfParts)
+		if uint(i) < value%uint(numberOfParts) {
+			parts[i]++
+		}
+	}
+
+	return parts
+}
@@ -0,0 +1,318 @@
+package distributed
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/loader"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+func TestSplitSwarm(t *testing.T) {
+
+	rate := func(value uint) *uint { return &value }
+
+	swarms := []struct {
+		name          string
+		swarm         definition.Swarm
+		numberOfParts int
+	}{
+		{"runs", definition.Swarm{NumberOfRuns: 11, CreationRate: 5, MaximumConcurrency: 3}, 2},
+		{"duration", definition.Swarm{Duration: 10, CreationRate: 7}, 3},
+		{"virtual users", definition.Swarm{VirtualUsers: 10, Iterations: 3, CreationRate: 4}, 4},
+		{"phases", definition.Swarm{Phases: []definition.Phase{
+			{Duration: 10, CreationRate: rate(0), TargetRate: rate(10)},
+			{Duration: 5, CreationRate: rate(10)},
+			{Duration: 10, CreationRate: rate(10), TargetRate: rate(3)},
+		}}, 3},
+	}
+
+	for _, test := range swarms {
+		t.Run(test.name, func(t *testing.T) {
+
+			parts, err := splitSwarm(test.swarm, test.numberOfParts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != test.numberOfParts {
+				t.Fatalf("expected %v parts, got %v", test.numberOfParts, len(parts))
+			}
+
+			var numberOfRuns, creationRate, maximumConcurrency, virtualUsers uint
+			fromRates := make([]uint, len(test.swarm.Phases))
+			toRates := make([]uint, len(test.swarm.Phases))
+			for _, part := range parts {
+				numberOfRuns += part.NumberOfRuns
+				creationRate += part.CreationRate
+				maximumConcurrency += part.MaximumConcurrency
+				virtualUsers += part.VirtualUsers
+				if part.Duration != test.swarm.Duration || part.Iterations != test.swarm.Iterations {
+					t.Errorf("expected the duration and the iterations to be kept, got %+v", part)
+				}
+				for i, phase := range part.Phases {
+					from, to := phase.Rates()
+					fromRates[i] += from
+					toRates[i] += to
+				}
+			}
+
+			if numberOfRuns != test.swarm.NumberOfRuns || creationRate != test.swarm.CreationRate || maximumConcurrency != test.swarm.MaximumConcurrency || virtualUsers != test.swarm.VirtualUsers {
+				t.Errorf("expected the parts to sum to %+v, got %v runs, %v/s, %v concurrent, %v users", test.swarm, numberOfRuns, creationRate, maximumConcurrency, virtualUsers)
+			}
+			for i, phase := range test.swarm.Phases {
+				if from, to := phase.Rates(); fromRates[i] != from || toRates[i] != to {
+					t.Errorf("phase %v: expected the rates to sum to %v and %v, got %v and %v", i, from, to, fromRates[i], toRates[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitSwarmInvalid(t *testing.T) {
+
+	rate := func(value uint) *uint { return &value }
+
+	swarms := []definition.Swarm{
+		{NumberOfRuns: 10, CreationRate: 2},
+		{VirtualUsers: 10, CreationRate: 1, Iterations: 1},
+		{NumberOfRuns: 10, CreationRate: 10, MaximumConcurrency: 2},
+		{Phases: []definition.Phase{{Duration: 10, CreationRate: rate(0), TargetRate: rate(2)}}},
+	}
+
+	for _, swarm := range swarms {
+		if _, err := splitSwarm(swarm, 3); err == nil {
+			t.Errorf("expected an error when splitting %+v between 3 parts", swarm)
+		}
+	}
+}
+
+// recordingSink keeps the test indexes received by the coordinator
+type recordingSink struct {
+	sink.Base
+	mutex        sync.Mutex
+	testIndexes  []int
+	actionTests  []int
+	stageTriedBy map[int]int
+}
+
+func (recorder *recordingSink) TestStarted(entry *db.TestEntry) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.testIndexes = append(recorder.testIndexes, entry.TestIndex)
+}
+
+func (recorder *recordingSink) ActionFinished(entry *db.ActionEntry) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.actionTests = append(recorder.actionTests, entry.TestIndex)
+}
+
+func (recorder *recordingSink) StageTried(testIndex int, _ int, _ int, _ []*db.ActionEntry, _ error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.stageTriedBy[testIndex]++
+}
+
+// runFakeWorker registers a worker to the coordinator, waits for its assignment and sends the results of all its
+// runs, numbered from 0 as the runner does, without executing them
+func runFakeWorker(ctx context.Context, coordinatorURL string, name string, swarms chan<- definition.Swarm, errs chan<- error) {
+
+	worker := NewWorker(coordinatorURL, name, "")
+
+	var registered registrationResponse
+	if err := worker.post(ctx, "/workers", registration{Name: name}, &registered); err != nil {
+		errs <- err
+		return
+	}
+
+	assigned, err := worker.waitForAssignment(ctx, registered.WorkerID)
+	if err != nil || assigned == nil {
+		errs <- err
+		return
+	}
+
+	test, err := loader.LoadFromData([]byte(assigned.Definition))
+	if err != nil {
+		errs <- err
+		return
+	}
+	swarms <- test.Swarm
+
+	remote := &remoteSink{}
+	for testIndex := 0; testIndex < int(test.Swarm.NumberOfRuns); testIndex++ {
+		entry := &db.TestEntry{TestIndex: testIndex}
+		remote.TestStarted(entry)
+		remote.StageTried(testIndex, 0, 0, []*db.ActionEntry{{TestIndex: testIndex, Success: true}}, nil)
+		remote.TestFinished(entry)
+	}
+
+	worker.sendResults(registered.WorkerID, assigned.RunID, remote, true)
+	errs <- nil
+}
+
+func TestCoordinatorRun(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coordinator := NewCoordinator(2, "")
+	server := httptest.NewServer(coordinator.router())
+	defer server.Close()
+
+	swarms := make(chan definition.Swarm, 2)
+	errs := make(chan error, 2)
+	go runFakeWorker(ctx, server.URL, "worker-1", swarms, errs)
+	go runFakeWorker(ctx, server.URL, "worker-2", swarms, errs)
+
+	if err := coordinator.WaitForWorkers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	test := definition.Test{
+		TestName: "test",
+		Stages: []definition.Stage{
+			{
+				Name:    "stage",
+				Actions: []definition.Action{{Name: "action", Query: definition.Query{URL: "http://localhost/", Method: definition.GET}}},
+			},
+		},
+		Swarm: definition.Swarm{NumberOfRuns: 11, CreationRate: 5},
+	}
+
+	recorder := &recordingSink{stageTriedBy: make(map[int]int)}
+	if err := coordinator.Run(ctx, test, recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The parts of the workers sum to the swarm
+	var numberOfRuns, creationRate uint
+	for i := 0; i < 2; i++ {
+		swarm := <-swarms
+		numberOfRuns += swarm.NumberOfRuns
+		creationRate += swarm.CreationRate
+	}
+	if numberOfRuns != test.Swarm.NumberOfRuns || creationRate != test.Swarm.CreationRate {
+		t.Errorf("expected the workers to run %v runs at %v/s, got %v runs at %v/s", test.Swarm.NumberOfRuns, test.Swarm.CreationRate, numberOfRuns, creationRate)
+	}
+
+	// The merged test indexes are unique, and consistent between the tests, the actions and the stages
+	if len(recorder.testIndexes) != int(test.Swarm.NumberOfRuns) {
+		t.Fatalf("expected %v tests, got %v", test.Swarm.NumberOfRuns, len(recorder.testIndexes))
+	}
+	seen := make(map[int]bool)
+	for _, testIndex := range recorder.testIndexes {
+		if seen[testIndex] {
+			t.Errorf("the test index %v is received twice", testIndex)
+		}
+		seen[testIndex] = true
+	}
+	for _, testIndex := range recorder.actionTests {
+		if !seen[testIndex] || recorder.stageTriedBy[testIndex] != 1 {
+			t.Errorf("the action of the test index %v does not match a single test and stage", testIndex)
+		}
+	}
+	if len(recorder.actionTests) != len(recorder.testIndexes) {
+		t.Errorf("expected %v actions, got %v", len(recorder.testIndexes), len(recorder.actionTests))
+	}
+}
+
+func TestCoordinatorToken(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	coordinator := NewCoordinator(1, "secret")
+	server := httptest.NewServer(coordinator.router())
+	defer server.Close()
+
+	var registered registrationResponse
+	if err := NewWorker(server.URL, "intruder", "wrong").post(context.Background(), "/workers", registration{Name: "intruder"}, &registered); err == nil {
+		t.Errorf("expected a worker with a wrong token to be rejected")
+	}
+	if err := NewWorker(server.URL, "anonymous", "").post(context.Background(), "/workers", registration{Name: "anonymous"}, &registered); err == nil {
+		t.Errorf("expected a worker without token to be rejected")
+	}
+	if err := NewWorker(server.URL, "worker", "secret").post(context.Background(), "/workers", registration{Name: "worker"}, &registered); err != nil {
+		t.Errorf("expected the worker with the token to be registered, got %v", err)
+	}
+}
+
+func TestCoordinatorLateResults(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coordinator := NewCoordinator(1, "")
+	server := httptest.NewServer(coordinator.router())
+	defer server.Close()
+
+	worker := NewWorker(server.URL, "worker", "")
+	var registered registrationResponse
+	if err := worker.post(ctx, "/workers", registration{Name: "worker"}, &registered); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last results are sent twice, as when their answer is lost
+	runIDs := make(chan string, 1)
+	go func() {
+		assigned, err := worker.waitForAssignment(ctx, registered.WorkerID)
+		if err != nil || assigned == nil {
+			runIDs <- ""
+			return
+		}
+		entry := &db.TestEntry{TestIndex: 0}
+		finalResults := results{RunID: assigned.RunID, Events: []event{{Kind: testStartedEvent, Test: entry}}, Finished: true}
+		var response resultsResponse
+		worker.post(ctx, "/workers/"+registered.WorkerID+"/results", finalResults, &response)
+		worker.post(ctx, "/workers/"+registered.WorkerID+"/results", finalResults, &response)
+		runIDs <- assigned.RunID
+	}()
+
+	if err := coordinator.WaitForWorkers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	test := definition.Test{
+		TestName: "test",
+		Stages:   []definition.Stage{{Name: "stage", Actions: []definition.Action{{Name: "action", Query: definition.Query{URL: "http://localhost/", Method: definition.GET}}}}},
+		Swarm:    definition.Swarm{NumberOfRuns: 1, CreationRate: 1},
+	}
+
+	recorder := &recordingSink{stageTriedBy: make(map[int]int)}
+	if err := coordinator.Run(ctx, test, recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	runID := <-runIDs
+	if len(runID) == 0 {
+		t.Fatal("the worker did not receive its assignment")
+	}
+
+	// The results received once the run is over are rejected
+	late := results{RunID: runID, Events: []event{{Kind: testStartedEvent, Test: &db.TestEntry{TestIndex: 1}}}, Finished: true}
+	var response resultsResponse
+	if err := worker.post(ctx, "/workers/"+registered.WorkerID+"/results", late, &response); err == nil {
+		t.Errorf("expected the results received after the run to be rejected")
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if len(recorder.testIndexes) != 1 {
+		t.Errorf("expected the test to be received once, got %v", recorder.testIndexes)
+	}
+}
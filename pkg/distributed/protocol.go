@@ -0,0 +1,64 @@
+package distributed
+
+import (
+	"github.com/twuillemin/gargote/pkg/db"
+)
+
+// The messages exchanged between the coordinator and the workers, in JSON over HTTP. The workers only send queries
+// to the coordinator, so that they do not need to be reachable:
+//  - POST /workers: a worker registers and receives its ID
+//  - GET /workers/{id}/assignment: a worker waits for its part of the test (long polling, 204 if nothing yet)
+//  - POST /workers/{id}/results: a worker sends its results, at least every second, and learns if it must abort
+
+// registration is sent by a worker to register
+type registration struct {
+	Name string `json:"name"`
+}
+
+// registrationResponse gives its ID to a registered worker
+type registrationResponse struct {
+	WorkerID string `json:"worker_id"`
+}
+
+// assignment is the part of the test executed by a worker
+type assignment struct {
+	RunID string `json:"run_id"`
+	// Definition is the definition of the test in YAML, with the number of runs and the creation rate of the worker
+	Definition string `json:"definition"`
+	// StartTimeNano is the time (Unix time in nanoseconds) at which all the workers start
+	StartTimeNano int64 `json:"start_time_nano"`
+}
+
+// eventKind is the kind of an event of a worker
+type eventKind string
+
+const (
+	testStartedEvent  eventKind = "test_started"
+	stageTriedEvent   eventKind = "stage_tried"
+	testFinishedEvent eventKind = "test_finished"
+)
+
+// event is a result of a worker, replayed by the coordinator in its own result sink
+type event struct {
+	Kind       eventKind         `json:"kind"`
+	Test       *db.TestEntry     `json:"test,omitempty"`
+	TestIndex  int               `json:"test_index,omitempty"`
+	StageIndex int               `json:"stage_index,omitempty"`
+	TryNumber  int               `json:"try_number,omitempty"`
+	Actions    []*db.ActionEntry `json:"actions,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// results are the events of a worker since its last results
+type results struct {
+	RunID  string  `json:"run_id"`
+	Events []event `json:"events"`
+	// Finished is true for the last results of the worker
+	Finished bool `json:"finished"`
+}
+
+// resultsResponse is the answer of the coordinator to the results of a worker
+type resultsResponse struct {
+	// Abort is true if the worker must stop starting new tests
+	Abort bool `json:"abort"`
+}
@@ -0,0 +1,340 @@
+package distributed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/loader"
+	"github.com/twuillemin/gargote/pkg/runner"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+const (
+	// sendInterval is the interval between two sendings of results to the coordinator
+	sendInterval = 1 * time.Second
+	// retryInterval is the interval between two tries to reach the coordinator
+	retryInterval = 2 * time.Second
+)
+
+// Worker executes the parts of the tests given by a coordinator
+type Worker struct {
+	coordinatorURL string
+	name           string
+	token          string
+	client         *http.Client
+}
+
+// NewWorker creates a new Worker
+//
+// Params:
+//  - coordinatorURL: the URL of the coordinator, for example http://localhost:7000
+//  - name: the name of the worker, displayed by the coordinator. The host name is used if empty.
+//  - token: the bearer token expected by the coordinator, if any
+//
+// Return the new Worker
+func NewWorker(coordinatorURL string, name string, token string) *Worker {
+
+	if len(name) == 0 {
+		name, _ = os.Hostname()
+	}
+
+	return &Worker{
+		coordinatorURL: strings.TrimSuffix(coordinatorURL, "/"),
+		name:           name,
+		token:          token,
+		client:         &http.Client{Timeout: assignmentPollTimeout + 10*time.Second},
+	}
+}
+
+// Run registers the worker, waits for its part of a test, executes it and sends the results to the coordinator. The
+// worker registers again once finished, until the context is done, unless once is true. The coordinator is waited
+// for if it is not reachable.
+//
+// Params:
+//  - ctx: the context of the worker
+//  - once: if true, the function returns after executing a single test
+//
+// Return an error if the coordinator rejects the worker
+func (worker *Worker) Run(ctx context.Context, once bool) error {
+
+	for ctx.Err() == nil {
+
+		var registered registrationResponse
+		if err := worker.post(ctx, "/workers", registration{Name: worker.name}, &registered); err != nil {
+			log.Warnf("unable to register to the coordinator %v due to %v, retrying", worker.coordinatorURL, err)
+			sleep(ctx, retryInterval)
+			continue
+		}
+
+		fmt.Printf("Registered to %v as worker %v\n", worker.coordinatorURL, registered.WorkerID)
+
+		assigned, err := worker.waitForAssignment(ctx, registered.WorkerID)
+		if err != nil {
+			log.Warnf("lost the coordinator while waiting for a test due to %v, registering again", err)
+			sleep(ctx, retryInterval)
+			continue
+		}
+		if assigned == nil {
+			return ctx.Err()
+		}
+
+		if err := worker.execute(ctx, registered.WorkerID, assigned); err != nil {
+			log.Errorf("unable to execute the test due to %v", err)
+		}
+
+		if once {
+			return nil
+		}
+	}
+
+	return ctx.Err()
+}
+
+func (worker *Worker) waitForAssignment(ctx context.Context, workerID string) (*assignment, error) {
+
+	for ctx.Err() == nil {
+
+		request, err := http.NewRequest("GET", worker.coordinatorURL+"/workers/"+workerID+"/assignment", nil)
+		if err != nil {
+			return nil, err
+		}
+		worker.authorize(request)
+
+		response, err := worker.client.Do(request.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		if response.StatusCode == http.StatusNoContent {
+			response.Body.Close()
+			continue
+		}
+
+		var assigned assignment
+		err = decodeResponse(response, &assigned)
+		if err != nil {
+			return nil, err
+		}
+
+		return &assigned, nil
+	}
+
+	return nil, nil
+}
+
+func (worker *Worker) execute(ctx context.Context, workerID string, assigned *assignment) error {
+
+	test, err := loader.LoadFromData([]byte(assigned.Definition))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting %v\n", describeSwarm(test.Swarm))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	remote := &remoteSink{}
+
+	// Send the results regularly, which also lets the coordinator know that the worker is alive
+	sendDone := make(chan struct{})
+	stopSending := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+
+		ticker := time.NewTicker(sendInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if worker.sendResults(workerID, assigned.RunID, remote, false) {
+					cancel()
+				}
+			case <-stopSending:
+				return
+			}
+		}
+	}()
+
+	// All the workers start at the same time
+	sleep(runCtx, time.Until(time.Unix(0, assigned.StartTimeNano)))
+
+	err = runner.RunTest(runCtx, *test, remote)
+
+	close(stopSending)
+	<-sendDone
+
+	worker.sendResults(workerID, assigned.RunID, remote, true)
+
+	return err
+}
+
+// sendResults sends the results kept by the sink to the coordinator and returns true if the coordinator asks to abort.
+// The results that could not be sent are given back to the sink, to be sent with the next ones.
+func (worker *Worker) sendResults(workerID string, runID string, remote *remoteSink, finished bool) bool {
+
+	var response resultsResponse
+
+	events := remote.take()
+
+	// The last results are retried, as the coordinator waits for them
+	for try := 0; ; try++ {
+
+		err := worker.post(context.Background(), "/workers/"+workerID+"/results", results{
+			RunID:    runID,
+			Events:   events,
+			Finished: finished,
+		}, &response)
+
+		if err == nil {
+			return response.Abort
+		}
+
+		if !finished {
+			log.Warnf("unable to send the results to the coordinator due to %v, retrying with the next ones", err)
+			remote.giveBack(events)
+			return false
+		}
+
+		if try >= 5 {
+			log.Errorf("unable to send the results to the coordinator due to %v", err)
+			return false
+		}
+
+		time.Sleep(retryInterval)
+	}
+}
+
+func (worker *Worker) post(ctx context.Context, path string, body interface{}, answer interface{}) error {
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", worker.coordinatorURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	worker.authorize(request)
+
+	response, err := worker.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	return decodeResponse(response, answer)
+}
+
+// authorize adds the token of the worker to a query to the coordinator
+func (worker *Worker) authorize(request *http.Request) {
+	if len(worker.token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+worker.token)
+	}
+}
+
+func decodeResponse(response *http.Response, answer interface{}) error {
+
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the coordinator answered %v: %v", response.Status, strings.TrimSpace(string(data)))
+	}
+
+	return json.Unmarshal(data, answer)
+}
+
+func sleep(ctx context.Context, duration time.Duration) {
+
+	if duration <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// remoteSink keeps the results of the worker until they are sent to the coordinator
+type remoteSink struct {
+	sink.Base
+	mutex  sync.Mutex
+	events []event
+}
+
+func (remote *remoteSink) add(received event) {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	remote.events = append(remote.events, received)
+}
+
+// take returns the events received since the last call
+func (remote *remoteSink) take() []event {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	events := remote.events
+	remote.events = nil
+
+	return events
+}
+
+// giveBack keeps again events that could not be sent, before the ones received since
+func (remote *remoteSink) giveBack(events []event) {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+
+	remote.events = append(events, remote.events...)
+}
+
+// TestStarted keeps the start of a test run
+func (remote *remoteSink) TestStarted(entry *db.TestEntry) {
+	remote.add(event{Kind: testStartedEvent, Test: entry})
+}
+
+// StageTried keeps the actions of a stage try
+func (remote *remoteSink) StageTried(testIndex int, stageIndex int, tryNumber int, entries []*db.ActionEntry, err error) {
+
+	tried := event{
+		Kind:       stageTriedEvent,
+		TestIndex:  testIndex,
+		StageIndex: stageIndex,
+		TryNumber:  tryNumber,
+		Actions:    entries,
+	}
+	if err != nil {
+		tried.Error = err.Error()
+	}
+
+	remote.add(tried)
+}
+
+// TestFinished keeps the end of a test run
+func (remote *remoteSink) TestFinished(entry *db.TestEntry) {
+	remote.add(event{Kind: testFinishedEvent, Test: entry})
+}
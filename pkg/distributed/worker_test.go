@@ -0,0 +1,83 @@
+package distributed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+func TestWorkerFlakyCoordinator(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	// The coordinator fails the first results received, the worker having to send them again
+	coordinator := NewCoordinator(1, "")
+	router := coordinator.router()
+	var mutex sync.Mutex
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fail := strings.HasSuffix(r.URL.Path, "/results") && failures > 0
+		if fail {
+			failures--
+		}
+		mutex.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- NewWorker(server.URL, "worker", "").Run(ctx, true)
+	}()
+
+	if err := coordinator.WaitForWorkers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	test := definition.Test{
+		TestName: "test",
+		Stages: []definition.Stage{
+			{
+				Name:    "stage",
+				Actions: []definition.Action{{Name: "action", Query: definition.Query{URL: target.URL, Method: definition.GET}}},
+			},
+		},
+		Swarm: definition.Swarm{NumberOfRuns: 30, CreationRate: 10},
+	}
+
+	recorder := &recordingSink{stageTriedBy: make(map[int]int)}
+	if err := coordinator.Run(ctx, test, recorder); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if failures > 0 {
+		t.Fatalf("expected the worker to send its results at least 3 times, %v failures left", failures)
+	}
+	if len(recorder.testIndexes) != int(test.Swarm.NumberOfRuns) || len(recorder.actionTests) != int(test.Swarm.NumberOfRuns) {
+		t.Errorf("expected %v tests and actions, got %v tests and %v actions", test.Swarm.NumberOfRuns, len(recorder.testIndexes), len(recorder.actionTests))
+	}
+}
@@ -0,0 +1,156 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+)
+
+var samplesHeader = []string{
+	"test_index",
+	"stage_index",
+	"try_number",
+	"action_index",
+	"time_nano",
+	"duration_nano",
+	"success",
+	"status_code",
+	"error_category",
+	"error_message",
+	"dns_nano",
+	"connect_nano",
+	"tls_nano",
+	"time_to_first_byte_nano",
+	"transfer_nano",
+	"connection_reused",
+}
+
+var summaryHeader = []string{
+	"level",
+	"stage_index",
+	"action_index",
+	"name",
+	"url",
+	"nb_success",
+	"nb_failure",
+	"error_rate",
+	"throughput",
+	"min_nano",
+	"max_nano",
+	"mean_nano",
+	"std_dev_nano",
+	"p50_nano",
+	"p90_nano",
+	"p95_nano",
+	"p99_nano",
+	"p999_nano",
+}
+
+// SamplesToCSV exports the samples of the results as CSV, with one line by executed action
+//
+// Params:
+//  - results: the results to export
+//
+// Return the CSV or an error if the results can not be converted
+func SamplesToCSV(results *Results) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	if err := writer.Write(samplesHeader); err != nil {
+		return nil, err
+	}
+
+	for _, sample := range results.Samples {
+		record := []string{
+			strconv.Itoa(sample.TestIndex),
+			strconv.Itoa(sample.StageIndex),
+			strconv.Itoa(sample.TryNumber),
+			strconv.Itoa(sample.ActionIndex),
+			strconv.Itoa(sample.TimeNano),
+			strconv.Itoa(sample.DurationNano),
+			strconv.FormatBool(sample.Success),
+			strconv.Itoa(sample.StatusCode),
+			sample.ErrorCategory.ToString(),
+			sample.ErrorMessage,
+			strconv.Itoa(sample.DNSNano),
+			strconv.Itoa(sample.ConnectNano),
+			strconv.Itoa(sample.TLSNano),
+			strconv.Itoa(sample.TimeToFirstByteNano),
+			strconv.Itoa(sample.TransferNano),
+			strconv.FormatBool(sample.ConnectionReused),
+		}
+
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+
+	return buffer.Bytes(), writer.Error()
+}
+
+// SummaryToCSV exports the statistics of the results as CSV, with one line for the test, one line for all the
+// actions, one line for each scenario if any, then one line for each stage followed by one line for each of its
+// actions
+//
+// Params:
+//  - results: the results to export
+//
+// Return the CSV or an error if the results can not be converted
+func SummaryToCSV(results *Results) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	if err := writer.Write(summaryHeader); err != nil {
+		return nil, err
+	}
+
+	records := [][]string{
+		summaryToRecord("test", "", "", results.TestName, "", results.Test),
+		summaryToRecord("all_actions", "", "", "", "", results.AllActions),
+	}
+
+	for _, scenario := range results.Scenarios {
+		records = append(records, summaryToRecord("scenario", "", "", scenario.Name, "", scenario.Summary))
+	}
+
+	for _, stage := range results.Stages {
+		records = append(records, summaryToRecord("stage", strconv.Itoa(stage.StageIndex), "", stage.Name, "", stage.Summary))
+
+		for _, action := range stage.Actions {
+			records = append(records, summaryToRecord("action", strconv.Itoa(action.StageIndex), strconv.Itoa(action.ActionIndex), action.Name, action.URL, action.Summary))
+		}
+	}
+
+	if err := writer.WriteAll(records); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func summaryToRecord(level string, stageIndex string, actionIndex string, name string, url string, summary Summary) []string {
+	return []string{
+		level,
+		stageIndex,
+		actionIndex,
+		name,
+		url,
+		strconv.FormatInt(summary.NbSuccess, 10),
+		strconv.FormatInt(summary.NbFailure, 10),
+		strconv.FormatFloat(summary.ErrorRate, 'f', -1, 64),
+		strconv.FormatFloat(summary.Throughput, 'f', -1, 64),
+		strconv.FormatInt(summary.MinNano, 10),
+		strconv.FormatInt(summary.MaxNano, 10),
+		strconv.FormatInt(summary.MeanNano, 10),
+		strconv.FormatInt(summary.StdDevNano, 10),
+		strconv.FormatInt(summary.P50Nano, 10),
+		strconv.FormatInt(summary.P90Nano, 10),
+		strconv.FormatInt(summary.P95Nano, 10),
+		strconv.FormatInt(summary.P99Nano, 10),
+		strconv.FormatInt(summary.P999Nano, 10),
+	}
+}
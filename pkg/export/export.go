@@ -0,0 +1,265 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/statistics"
+)
+
+// Summary is the exported version of statistics.Statistics. All the durations are in nanoseconds.
+type Summary struct {
+	NbSuccess          int64            `json:"nb_success"`
+	NbFailure          int64            `json:"nb_failure"`
+	ErrorRate          float64          `json:"error_rate"`
+	Throughput         float64          `json:"throughput"`
+	MinNano            int64            `json:"min_nano"`
+	MaxNano            int64            `json:"max_nano"`
+	MeanNano           int64            `json:"mean_nano"`
+	StdDevNano         int64            `json:"std_dev_nano"`
+	P50Nano            int64            `json:"p50_nano"`
+	P90Nano            int64            `json:"p90_nano"`
+	P95Nano            int64            `json:"p95_nano"`
+	P99Nano            int64            `json:"p99_nano"`
+	P999Nano           int64            `json:"p999_nano"`
+	FailuresByCategory map[string]int64 `json:"failures_by_category,omitempty"`
+}
+
+// ActionSummary is the exported version of statistics.ActionStatistics
+type ActionSummary struct {
+	Summary
+	StageIndex  int    `json:"stage_index"`
+	ActionIndex int    `json:"action_index"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+}
+
+// StageSummary is the exported version of statistics.StageStatistics
+type StageSummary struct {
+	Summary
+	StageIndex int             `json:"stage_index"`
+	Name       string          `json:"name"`
+	Scenario   string          `json:"scenario,omitempty"`
+	Actions    []ActionSummary `json:"actions"`
+}
+
+// ScenarioSummary is the exported version of statistics.ScenarioStatistics
+type ScenarioSummary struct {
+	Summary
+	Name   string `json:"name"`
+	Weight uint   `json:"weight"`
+}
+
+// Results is the exported version of the results of a run: the statistics and, optionally, the raw samples
+type Results struct {
+	TestName    string            `json:"test_name"`
+	ElapsedNano int64             `json:"elapsed_nano"`
+	Test        Summary           `json:"test"`
+	AllActions  Summary           `json:"all_actions"`
+	Scenarios   []ScenarioSummary `json:"scenarios,omitempty"`
+	Stages      []StageSummary    `json:"stages"`
+	Samples     []*db.ActionEntry `json:"samples,omitempty"`
+}
+
+// NewResults creates the exported results from the statistics of a run
+//
+// Params:
+//  - report: the statistics of the run
+//  - withSamples: if true, all the entries of the database are added to the results
+//
+// Return the Results or an error if the samples can not be read from the database
+func NewResults(report *statistics.Report, withSamples bool) (*Results, error) {
+
+	results := &Results{
+		TestName:    report.TestName,
+		ElapsedNano: report.Elapsed.Nanoseconds(),
+		Test:        newSummary(report.Statistics),
+		AllActions:  newSummary(report.AllActions),
+		Stages:      make([]StageSummary, 0, len(report.Stages)),
+	}
+
+	for _, scenario := range report.Scenarios {
+		results.Scenarios = append(results.Scenarios, ScenarioSummary{
+			Summary: newSummary(scenario.Statistics),
+			Name:    scenario.Name,
+			Weight:  scenario.Weight,
+		})
+	}
+
+	for _, stage := range report.Stages {
+
+		stageSummary := StageSummary{
+			Summary:    newSummary(stage.Statistics),
+			StageIndex: stage.StageIndex,
+			Name:       stage.Name,
+			Scenario:   stage.Scenario,
+			Actions:    make([]ActionSummary, 0, len(stage.Actions)),
+		}
+
+		for _, action := range stage.Actions {
+			stageSummary.Actions = append(stageSummary.Actions, ActionSummary{
+				Summary:     newSummary(action.Statistics),
+				StageIndex:  action.StageIndex,
+				ActionIndex: action.ActionIndex,
+				Name:        action.Name,
+				URL:         action.URL,
+			})
+		}
+
+		results.Stages = append(results.Stages, stageSummary)
+	}
+
+	if withSamples {
+		samples, err := getSamples()
+		if err != nil {
+			return nil, err
+		}
+		results.Samples = samples
+	}
+
+	return results, nil
+}
+
+func newSummary(data statistics.Statistics) Summary {
+
+	summary := Summary{
+		NbSuccess:  data.NbSuccess,
+		NbFailure:  data.NbFailure,
+		ErrorRate:  data.ErrorRate(),
+		Throughput: data.Throughput,
+		MinNano:    data.Min.Nanoseconds(),
+		MaxNano:    data.Max.Nanoseconds(),
+		MeanNano:   data.Mean.Nanoseconds(),
+		StdDevNano: data.StdDev.Nanoseconds(),
+		P50Nano:    data.P50.Nanoseconds(),
+		P90Nano:    data.P90.Nanoseconds(),
+		P95Nano:    data.P95.Nanoseconds(),
+		P99Nano:    data.P99.Nanoseconds(),
+		P999Nano:   data.P999.Nanoseconds(),
+	}
+
+	if len(data.FailuresByCategory) > 0 {
+		summary.FailuresByCategory = make(map[string]int64, len(data.FailuresByCategory))
+		for category, count := range data.FailuresByCategory {
+			summary.FailuresByCategory[category.ToString()] = count
+		}
+	}
+
+	return summary
+}
+
+// getSamples returns all the entries of the database, in chronological order
+func getSamples() ([]*db.ActionEntry, error) {
+
+	samples := make([]*db.ActionEntry, 0)
+
+	err := db.ForEachAction(func(action *db.ActionEntry) {
+		sample := *action
+		samples = append(samples, &sample)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].TimeNano < samples[j].TimeNano
+	})
+
+	return samples, nil
+}
+
+// ToFile exports the results of a run to a file. The format is given by the extension of the file:
+//  - .json: a single JSON file with the statistics and the samples
+//  - .csv: a CSV file with the samples, and a second CSV file, with the same name suffixed by _summary, with the
+//    statistics of the test, of the stages and of the actions
+//
+// Params:
+//  - fileName: the name of the file
+//  - report: the statistics of the run
+//
+// Return an error if the format is not supported or if the file can not be written
+func ToFile(fileName string, report *statistics.Report) error {
+
+	results, err := NewResults(report, true)
+	if err != nil {
+		return err
+	}
+
+	extension := strings.ToLower(filepath.Ext(fileName))
+
+	switch extension {
+
+	case ".json":
+		data, err := ToJSON(results)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(fileName, data, 0644)
+
+	case ".csv":
+		samples, err := SamplesToCSV(results)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(fileName, samples, 0644); err != nil {
+			return err
+		}
+
+		summary, err := SummaryToCSV(results)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(strings.TrimSuffix(fileName, filepath.Ext(fileName))+"_summary.csv", summary, 0644)
+
+	default:
+		return fmt.Errorf("the format of the output file '%s' is not supported, use .json or .csv", fileName)
+	}
+}
+
+// ToJSON exports the results as JSON
+//
+// Params:
+//  - results: the results to export
+//
+// Return the JSON or an error if the results can not be converted
+func ToJSON(results *Results) ([]byte, error) {
+	return json.MarshalIndent(results, "", "  ")
+}
+
+// FromJSON reads results previously exported as JSON
+//
+// Params:
+//  - data: the JSON
+//
+// Return the results or an error if the JSON is not valid
+func FromJSON(data []byte) (*Results, error) {
+
+	var results Results
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, err
+	}
+
+	return &results, nil
+}
+
+// FromFile reads results previously exported to a JSON file
+//
+// Params:
+//  - fileName: the name of the file
+//
+// Return the results or an error if the file can not be read
+func FromFile(fileName string) (*Results, error) {
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromJSON(data)
+}
@@ -0,0 +1,356 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/statistics"
+	"github.com/twuillemin/gargote/pkg/threshold"
+)
+
+// maximumHTMLFailures is the maximum number of failures detailed in the HTML report
+const maximumHTMLFailures = 50
+
+// htmlAction is the data of an action displayed in the HTML report
+type htmlAction struct {
+	*statistics.ActionStatistics
+	StageName string
+	Failures  []htmlCount
+}
+
+// htmlCount is a label with a number of occurrences
+type htmlCount struct {
+	Label string
+	Count int64
+}
+
+// htmlFailure is a failed action detailed in the HTML report
+type htmlFailure struct {
+	*db.ActionEntry
+	StageName  string
+	ActionName string
+	Time       string
+}
+
+// htmlReport is the data given to the HTML template
+type htmlReport struct {
+	TestName        string
+	GeneratedAt     string
+	Elapsed         time.Duration
+	Report          *statistics.Report
+	Thresholds      []threshold.Result
+	Actions         []htmlAction
+	LatencyChart    template.HTML
+	ThroughputChart template.HTML
+	ActiveChart     template.HTML
+	Failures        []htmlFailure
+	NbFailures      int64
+}
+
+// ToHTML exports the results of a run as a single self-contained HTML page, with a summary, the statistics of each
+// action, charts of the evolution of the latency and of the throughput, the breakdown of the errors and the details
+// of the first failures.
+//
+// Params:
+//  - test: the Test that was run
+//  - report: the statistics of the run
+//  - thresholds: the result of the thresholds, if any
+//
+// Return the HTML or an error if the database can not be read
+func ToHTML(test definition.Test, report *statistics.Report, thresholds []threshold.Result) ([]byte, error) {
+
+	data := htmlReport{
+		TestName:    test.TestName,
+		GeneratedAt: time.Now().Format(time.RFC1123),
+		Elapsed:     report.Elapsed.Round(time.Millisecond),
+		Report:      report,
+		Thresholds:  thresholds,
+		Actions:     make([]htmlAction, 0),
+		NbFailures:  report.AllActions.NbFailure,
+	}
+
+	for _, stage := range report.Stages {
+		for _, action := range stage.Actions {
+			data.Actions = append(data.Actions, htmlAction{
+				ActionStatistics: action,
+				StageName:        stage.FullName(),
+				Failures:         getFailureCounts(action.Statistics),
+			})
+		}
+	}
+
+	// Build the charts
+	buckets, err := db.GetTimeSeries(1 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	data.LatencyChart, data.ThroughputChart, data.ActiveChart = BuildCharts(buckets)
+
+	// Keep the first failures
+	failures, err := getFailures(test)
+	if err != nil {
+		return nil, err
+	}
+	data.Failures = failures
+
+	var buffer bytes.Buffer
+	if err := htmlTemplate.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ToHTMLFile exports the results of a run to an HTML file
+//
+// Params:
+//  - fileName: the name of the file
+//  - test: the Test that was run
+//  - report: the statistics of the run
+//  - thresholds: the result of the thresholds, if any
+//
+// Return an error if the file can not be written
+func ToHTMLFile(fileName string, test definition.Test, report *statistics.Report, thresholds []threshold.Result) error {
+
+	data, err := ToHTML(test, report, thresholds)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+// BuildCharts renders the time series of a run as SVG charts
+//
+// Params:
+//  - buckets: the time series, by second
+//
+// Return the charts of the latency, of the throughput and of the active tests
+func BuildCharts(buckets []*db.TimeBucket) (template.HTML, template.HTML, template.HTML) {
+
+	labels := make([]string, len(buckets))
+	p50 := Series{Name: "p50", Color: "#2b8cbe", Values: make([]float64, len(buckets))}
+	p95 := Series{Name: "p95", Color: "#f39c12", Values: make([]float64, len(buckets))}
+	p99 := Series{Name: "p99", Color: "#c0392b", Values: make([]float64, len(buckets))}
+	requests := Series{Name: "requests/s", Color: "#27ae60", Values: make([]float64, len(buckets))}
+	errors := Series{Name: "errors/s", Color: "#c0392b", Values: make([]float64, len(buckets))}
+	active := Series{Name: "active tests", Color: "#8e44ad", Values: make([]float64, len(buckets))}
+
+	for i, bucket := range buckets {
+		labels[i] = fmt.Sprintf("%ds", i)
+		p50.Values[i] = toMilliseconds(bucket.Durations.Percentile(50))
+		p95.Values[i] = toMilliseconds(bucket.Durations.Percentile(95))
+		p99.Values[i] = toMilliseconds(bucket.Durations.Percentile(99))
+		requests.Values[i] = float64(bucket.NbRequests)
+		errors.Values[i] = float64(bucket.NbFailures)
+		active.Values[i] = float64(bucket.ActiveTests)
+	}
+
+	return LineChart("Latency over time", "ms", labels, []Series{p50, p95, p99}),
+		LineChart("Throughput", "/s", labels, []Series{requests, errors}),
+		LineChart("Active tests", "", labels, []Series{active})
+}
+
+func getFailureCounts(data statistics.Statistics) []htmlCount {
+
+	counts := make([]htmlCount, 0, len(data.FailuresByCategory))
+
+	for category, count := range data.FailuresByCategory {
+		counts = append(counts, htmlCount{Label: category.ToString(), Count: count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+
+	return counts
+}
+
+func getFailures(test definition.Test) ([]htmlFailure, error) {
+
+	failures := make([]htmlFailure, 0)
+
+	err := db.ForEachAction(func(action *db.ActionEntry) {
+		if !action.Success {
+			failures = append(failures, htmlFailure{
+				ActionEntry: action,
+				StageName:   test.Stages[action.StageIndex].FullName(),
+				ActionName:  test.Stages[action.StageIndex].Actions[action.ActionIndex].Name,
+				Time:        time.Unix(0, int64(action.TimeNano)).Format("15:04:05.000"),
+			})
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].TimeNano < failures[j].TimeNano
+	})
+
+	if len(failures) > maximumHTMLFailures {
+		failures = failures[:maximumHTMLFailures]
+	}
+
+	return failures, nil
+}
+
+func toMilliseconds(durationNano int64) float64 {
+	return float64(durationNano) / float64(time.Millisecond)
+}
+
+var htmlFunctions = template.FuncMap{
+	"ms": func(duration time.Duration) string {
+		return fmt.Sprintf("%.2f", toMilliseconds(duration.Nanoseconds()))
+	},
+	"percent": func(value float64) string {
+		return fmt.Sprintf("%.2f%%", value*100)
+	},
+	"float": func(value float64) string {
+		return fmt.Sprintf("%.2f", value)
+	},
+	"headers": func(headers map[string][]string) string {
+		// The headers are redacted again, as the runs stored by older versions kept them as is
+		headers = db.RedactHeaders(headers)
+		lines := make([]string, 0, len(headers))
+		for name, values := range headers {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, strings.Join(values, ", ")))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	},
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(htmlFunctions).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Gargote report - {{ .TestName }}</title>
+<style>
+  body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+  h1 { margin-bottom: 0; }
+  .subtitle { color: #777; margin-bottom: 2em; }
+  table { border-collapse: collapse; margin-bottom: 2em; width: 100%; }
+  th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; font-size: 0.9em; }
+  th { background: #f4f4f4; }
+  td.label, th.label { text-align: left; }
+  .cards { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 2em; }
+  .card { border: 1px solid #ddd; border-radius: 4px; padding: 1em; min-width: 140px; }
+  .card .value { font-size: 1.6em; font-weight: bold; }
+  .card .name { color: #777; font-size: 0.9em; }
+  .passed { color: #27ae60; font-weight: bold; }
+  .failed { color: #c0392b; font-weight: bold; }
+  .chart { width: 100%; max-width: 800px; display: block; margin-bottom: 1em; }
+  .chart-title { font-weight: bold; font-size: 14px; }
+  .chart-axis { font-size: 11px; fill: #555; }
+  .chart-grid { stroke: #eee; }
+  details { border: 1px solid #ddd; border-radius: 4px; padding: 0.5em; margin-bottom: 0.5em; }
+  summary { cursor: pointer; }
+  pre { background: #f8f8f8; padding: 0.5em; overflow-x: auto; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>{{ .TestName }}</h1>
+<div class="subtitle">Generated on {{ .GeneratedAt }} - total duration {{ .Elapsed }}</div>
+
+<h2>Summary</h2>
+<div class="cards">
+  <div class="card"><div class="value">{{ .Report.NbSuccess }} / {{ .Report.NbFailure }}</div><div class="name">test runs succeeded / failed</div></div>
+  <div class="card"><div class="value">{{ .Report.AllActions.NbSuccess }} / {{ .Report.AllActions.NbFailure }}</div><div class="name">actions succeeded / failed</div></div>
+  <div class="card"><div class="value">{{ percent .Report.AllActions.ErrorRate }}</div><div class="name">action error rate</div></div>
+  <div class="card"><div class="value">{{ float .Report.AllActions.Throughput }}</div><div class="name">actions / second</div></div>
+  <div class="card"><div class="value">{{ ms .Report.AllActions.P95 }} ms</div><div class="name">action p95</div></div>
+</div>
+
+{{ if .Thresholds }}
+<h2>Thresholds</h2>
+<table>
+  <tr><th class="label">Threshold</th><th class="label">Result</th></tr>
+  {{ range .Thresholds }}
+  <tr><td class="label">{{ .Threshold }}</td><td class="label {{ if .Passed }}passed{{ else }}failed{{ end }}">{{ . }}</td></tr>
+  {{ end }}
+</table>
+{{ end }}
+
+{{ if .Report.Scenarios }}
+<h2>Scenarios</h2>
+<table>
+  <tr>
+    <th class="label">Scenario</th><th>Weight</th><th>Success</th><th>Failure</th><th>Error rate</th><th>Throughput (/s)</th>
+    <th>Mean (ms)</th><th>p50 (ms)</th><th>p95 (ms)</th><th>p99 (ms)</th><th>Max (ms)</th>
+  </tr>
+  {{ range .Report.Scenarios }}
+  <tr>
+    <td class="label">{{ .Name }}</td><td>{{ .Weight }}</td>
+    <td>{{ .NbSuccess }}</td><td>{{ .NbFailure }}</td><td>{{ percent .ErrorRate }}</td><td>{{ float .Throughput }}</td>
+    <td>{{ ms .Mean }}</td><td>{{ ms .P50 }}</td><td>{{ ms .P95 }}</td><td>{{ ms .P99 }}</td><td>{{ ms .Max }}</td>
+  </tr>
+  {{ end }}
+</table>
+{{ end }}
+
+<h2>Actions</h2>
+<table>
+  <tr>
+    <th class="label">Stage</th><th class="label">Action</th><th>Success</th><th>Failure</th><th>Error rate</th><th>Throughput (/s)</th>
+    <th>Min (ms)</th><th>Mean (ms)</th><th>p50 (ms)</th><th>p90 (ms)</th><th>p95 (ms)</th><th>p99 (ms)</th><th>p99.9 (ms)</th><th>Max (ms)</th>
+  </tr>
+  {{ range .Actions }}
+  <tr>
+    <td class="label">{{ .StageName }}</td><td class="label" title="{{ .URL }}">{{ .Name }}</td>
+    <td>{{ .NbSuccess }}</td><td>{{ .NbFailure }}</td><td>{{ percent .ErrorRate }}</td><td>{{ float .Throughput }}</td>
+    <td>{{ ms .Min }}</td><td>{{ ms .Mean }}</td><td>{{ ms .P50 }}</td><td>{{ ms .P90 }}</td><td>{{ ms .P95 }}</td><td>{{ ms .P99 }}</td><td>{{ ms .P999 }}</td><td>{{ ms .Max }}</td>
+  </tr>
+  {{ end }}
+</table>
+
+<h2>Evolution</h2>
+{{ .LatencyChart }}
+{{ .ThroughputChart }}
+{{ .ActiveChart }}
+
+<h2>Errors</h2>
+{{ if eq .NbFailures 0 }}
+<p>No action failed.</p>
+{{ else }}
+<table>
+  <tr><th class="label">Stage</th><th class="label">Action</th><th class="label">Category</th><th>Count</th></tr>
+  {{ range $action := .Actions }}{{ range .Failures }}
+  <tr><td class="label">{{ $action.StageName }}</td><td class="label">{{ $action.Name }}</td><td class="label">{{ .Label }}</td><td>{{ .Count }}</td></tr>
+  {{ end }}{{ end }}
+</table>
+
+<h2>Failures</h2>
+<p>Showing the first {{ len .Failures }} failure(s) out of {{ .NbFailures }}.</p>
+{{ range .Failures }}
+<details>
+  <summary>{{ .Time }} - test {{ .TestIndex }}, try {{ .TryNumber }} - {{ .StageName }} / {{ .ActionName }} - <span class="failed">{{ .ErrorCategory.ToString }}</span>: {{ .ErrorMessage }}</summary>
+  {{ with .FailureDetails }}
+  <h4>Request</h4>
+  <pre>{{ .RequestMethod }} {{ .RequestURL }}
+{{ headers .RequestHeaders }}
+
+{{ .RequestBody }}</pre>
+  {{ if .ResponseStatus }}
+  <h4>Response</h4>
+  <pre>{{ .ResponseStatus }}
+{{ headers .ResponseHeaders }}
+
+{{ .ResponseBody }}</pre>
+  {{ end }}
+  {{ end }}
+</details>
+{{ end }}
+{{ end }}
+
+</body>
+</html>
+`))
@@ -0,0 +1,335 @@
+package export
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+// JUnitLevel defines what is reported as a JUnit testcase
+type JUnitLevel int
+
+const (
+	// JUnitStageLevel reports each stage as a testcase
+	JUnitStageLevel JUnitLevel = iota
+	// JUnitActionLevel reports each action as a testcase
+	JUnitActionLevel
+)
+
+var junitLevelToID = map[string]JUnitLevel{
+	"stage":  JUnitStageLevel,
+	"action": JUnitActionLevel,
+}
+
+// ParseJUnitLevel converts the name of a level ("stage" or "action") to a JUnitLevel
+//
+// Params:
+//  - name: the name of the level
+//
+// Return the JUnitLevel or an error if the name is unknown
+func ParseJUnitLevel(name string) (JUnitLevel, error) {
+
+	level, ok := junitLevelToID[name]
+	if !ok {
+		return JUnitStageLevel, fmt.Errorf("the JUnit level '%s' is unknown, expected stage or action", name)
+	}
+
+	return level, nil
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// stageTries holds all the tries of a stage for a single run of the test, each try being the list of its actions
+type stageTries map[int][]*db.ActionEntry
+
+// ToJUnit exports the results of the database as a JUnit XML report. Each run of the test is a testsuite, and each
+// stage or each action, depending on the level, is a testcase. The stages not executed are reported as skipped.
+//
+// Params:
+//  - test: the Test that was run
+//  - level: the level reported as testcase
+//
+// Return the XML or an error if the database can not be read
+func ToJUnit(test definition.Test, level JUnitLevel) ([]byte, error) {
+
+	// Group the actions by test run, by stage and by try
+	runs := make(map[int]map[int]stageTries)
+
+	err := db.ForEachAction(func(action *db.ActionEntry) {
+
+		stages, ok := runs[action.TestIndex]
+		if !ok {
+			stages = make(map[int]stageTries)
+			runs[action.TestIndex] = stages
+		}
+
+		tries, ok := stages[action.StageIndex]
+		if !ok {
+			tries = make(stageTries)
+			stages[action.StageIndex] = tries
+		}
+
+		tries[action.TryNumber] = append(tries[action.TryNumber], action)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	startTimes := make(map[int]int)
+	err = db.ForEachTest(func(entry *db.TestEntry) {
+		startTimes[entry.TestIndex] = entry.StartTimeNano
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	testIndexes := make([]int, 0, len(runs))
+	for testIndex := range runs {
+		testIndexes = append(testIndexes, testIndex)
+	}
+	sort.Ints(testIndexes)
+
+	suites := junitTestSuites{
+		Name:   test.TestName,
+		Suites: make([]junitTestSuite, 0, len(testIndexes)),
+	}
+
+	var totalNano int
+	for _, testIndex := range testIndexes {
+
+		suite, durationNano := newJUnitTestSuite(test, testIndex, runs[testIndex], level)
+		if startTime, ok := startTimes[testIndex]; ok {
+			suite.Timestamp = time.Unix(0, int64(startTime)).UTC().Format("2006-01-02T15:04:05")
+		}
+
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+		totalNano += durationNano
+	}
+
+	suites.Time = formatJUnitTime(totalNano)
+
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
+
+// ToJUnitFile exports the results of the database to a JUnit XML file
+//
+// Params:
+//  - fileName: the name of the file
+//  - test: the Test that was run
+//  - level: the level reported as testcase
+//
+// Return an error if the file can not be written
+func ToJUnitFile(fileName string, test definition.Test, level JUnitLevel) error {
+
+	data, err := ToJUnit(test, level)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+func newJUnitTestSuite(test definition.Test, testIndex int, stages map[int]stageTries, level JUnitLevel) (junitTestSuite, int) {
+
+	suite := junitTestSuite{
+		Name:      fmt.Sprintf("%s #%d", test.TestName, testIndex),
+		TestCases: make([]junitTestCase, 0),
+	}
+
+	var suiteNano int
+
+	// With scenarios, only the stages of the scenario of the run, given by any of its executed stages, are reported
+	scenarioName := ""
+	for stageIndex := range stages {
+		if stageIndex < len(test.Stages) {
+			scenarioName = test.Stages[stageIndex].Scenario
+			break
+		}
+	}
+	classPrefix := test.TestName
+	if len(scenarioName) > 0 {
+		suite.Name = fmt.Sprintf("%s #%d (%s)", test.TestName, testIndex, scenarioName)
+		classPrefix = fmt.Sprintf("%s.%s", test.TestName, scenarioName)
+	}
+
+	for _, stageIndex := range test.StageIndexes(scenarioName) {
+
+		stage := test.Stages[stageIndex]
+		className := fmt.Sprintf("%s.%s", classPrefix, stage.Name)
+		tries, executed := stages[stageIndex]
+
+		// A stage without any try was not executed
+		if !executed {
+			if level == JUnitStageLevel {
+				suite.TestCases = append(suite.TestCases, junitTestCase{
+					Name:      stage.Name,
+					ClassName: className,
+					Time:      formatJUnitTime(0),
+					Skipped:   &struct{}{},
+				})
+			} else {
+				for _, action := range stage.Actions {
+					suite.TestCases = append(suite.TestCases, junitTestCase{
+						Name:      action.Name,
+						ClassName: className,
+						Time:      formatJUnitTime(0),
+						Skipped:   &struct{}{},
+					})
+				}
+			}
+			continue
+		}
+
+		// Find the last try, which gives the final result of the stage
+		lastTry := -1
+		var stageNano int
+		for tryNumber, actions := range tries {
+			if tryNumber > lastTry {
+				lastTry = tryNumber
+			}
+			for _, action := range actions {
+				stageNano += action.DurationNano
+			}
+		}
+		suiteNano += stageNano
+
+		sort.Slice(tries[lastTry], func(i, j int) bool {
+			return tries[lastTry][i].ActionIndex < tries[lastTry][j].ActionIndex
+		})
+
+		systemOut := fmt.Sprintf("tries: %d", len(tries))
+
+		if level == JUnitStageLevel {
+			testCase := junitTestCase{
+				Name:      stage.Name,
+				ClassName: className,
+				Time:      formatJUnitTime(stageNano),
+				SystemOut: systemOut,
+			}
+
+			for _, action := range tries[lastTry] {
+				if !action.Success {
+					testCase.Failure = newJUnitFailure(stage.Actions[action.ActionIndex].Name, action, len(tries))
+				}
+			}
+
+			suite.TestCases = append(suite.TestCases, testCase)
+		} else {
+			executedActions := make(map[int]*db.ActionEntry)
+			for _, action := range tries[lastTry] {
+				executedActions[action.ActionIndex] = action
+			}
+
+			for actionIndex, action := range stage.Actions {
+
+				entry, ok := executedActions[actionIndex]
+				if !ok {
+					suite.TestCases = append(suite.TestCases, junitTestCase{
+						Name:      action.Name,
+						ClassName: className,
+						Time:      formatJUnitTime(0),
+						Skipped:   &struct{}{},
+					})
+					continue
+				}
+
+				testCase := junitTestCase{
+					Name:      action.Name,
+					ClassName: className,
+					Time:      formatJUnitTime(entry.DurationNano),
+					SystemOut: fmt.Sprintf("%s, status code: %d", systemOut, entry.StatusCode),
+				}
+
+				if !entry.Success {
+					testCase.Failure = newJUnitFailure(action.Name, entry, len(tries))
+				}
+
+				suite.TestCases = append(suite.TestCases, testCase)
+			}
+		}
+	}
+
+	for _, testCase := range suite.TestCases {
+		suite.Tests++
+		if testCase.Failure != nil {
+			suite.Failures++
+		}
+		if testCase.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+
+	suite.Time = formatJUnitTime(suiteNano)
+
+	return suite, suiteNano
+}
+
+func newJUnitFailure(actionName string, action *db.ActionEntry, nbTries int) *junitFailure {
+
+	lines := []string{
+		fmt.Sprintf("action: %s", actionName),
+		fmt.Sprintf("error: %s", action.ErrorMessage),
+		fmt.Sprintf("status code: %d", action.StatusCode),
+		fmt.Sprintf("duration: %v", time.Duration(action.DurationNano)),
+		fmt.Sprintf("tries: %d", nbTries),
+	}
+
+	return &junitFailure{
+		Message: action.ErrorMessage,
+		Type:    action.ErrorCategory.ToString(),
+		Text:    strings.Join(lines, "\n"),
+	}
+}
+
+func formatJUnitTime(durationNano int) string {
+	return fmt.Sprintf("%.3f", time.Duration(durationNano).Seconds())
+}
@@ -0,0 +1,103 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+)
+
+// Series is a named list of values displayed as a line in a chart
+type Series struct {
+	Name   string
+	Color  string
+	Values []float64
+}
+
+const (
+	chartWidth        = 800.0
+	chartHeight       = 250.0
+	chartMarginLeft   = 60.0
+	chartMarginRight  = 20.0
+	chartMarginTop    = 30.0
+	chartMarginBottom = 30.0
+	chartGridLines    = 5
+)
+
+// LineChart renders series of values as an SVG line chart that can be directly embedded in an HTML page. The values
+// of all the series are expected to be at the same abscissa, given by the labels.
+//
+// Params:
+//  - title: the title of the chart
+//  - unit: the unit of the values, displayed on the vertical axis
+//  - labels: the label of each abscissa
+//  - series: the series to display
+//
+// Return the SVG
+func LineChart(title string, unit string, labels []string, series []Series) template.HTML {
+
+	var buffer bytes.Buffer
+
+	fmt.Fprintf(&buffer, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %.0f %.0f" class="chart">`, chartWidth, chartHeight)
+	fmt.Fprintf(&buffer, `<text x="%.0f" y="18" class="chart-title">%s</text>`, chartMarginLeft, template.HTMLEscapeString(title))
+
+	// Find the maximum value, for the scale
+	maxValue := 0.0
+	for _, s := range series {
+		for _, value := range s.Values {
+			maxValue = math.Max(maxValue, value)
+		}
+	}
+	if maxValue == 0 {
+		maxValue = 1
+	}
+
+	plotWidth := chartWidth - chartMarginLeft - chartMarginRight
+	plotHeight := chartHeight - chartMarginTop - chartMarginBottom
+
+	x := func(index int) float64 {
+		if len(labels) <= 1 {
+			return chartMarginLeft
+		}
+		return chartMarginLeft + plotWidth*float64(index)/float64(len(labels)-1)
+	}
+	y := func(value float64) float64 {
+		return chartMarginTop + plotHeight*(1-value/maxValue)
+	}
+
+	// Horizontal grid with the values
+	for i := 0; i <= chartGridLines; i++ {
+		value := maxValue * float64(i) / chartGridLines
+		fmt.Fprintf(&buffer, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" class="chart-grid"/>`, chartMarginLeft, y(value), chartWidth-chartMarginRight, y(value))
+		fmt.Fprintf(&buffer, `<text x="%.1f" y="%.1f" class="chart-axis" text-anchor="end">%.4g %s</text>`, chartMarginLeft-4, y(value)+4, value, template.HTMLEscapeString(unit))
+	}
+
+	// Labels of the abscissa, at most 10 of them
+	step := 1
+	if len(labels) > 10 {
+		step = int(math.Ceil(float64(len(labels)) / 10))
+	}
+	for i := 0; i < len(labels); i += step {
+		fmt.Fprintf(&buffer, `<text x="%.1f" y="%.1f" class="chart-axis" text-anchor="middle">%s</text>`, x(i), chartHeight-10, template.HTMLEscapeString(labels[i]))
+	}
+
+	// The series and their legend
+	legendX := chartWidth - chartMarginRight
+	for seriesIndex := len(series) - 1; seriesIndex >= 0; seriesIndex-- {
+		s := series[seriesIndex]
+
+		var points bytes.Buffer
+		for i, value := range s.Values {
+			fmt.Fprintf(&points, "%.1f,%.1f ", x(i), y(value))
+		}
+
+		fmt.Fprintf(&buffer, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, points.String(), s.Color)
+
+		legendX -= 10 + 7*float64(len(s.Name))
+		fmt.Fprintf(&buffer, `<text x="%.1f" y="18" class="chart-axis" fill="%s">&#9632; %s</text>`, legendX, s.Color, template.HTMLEscapeString(s.Name))
+	}
+
+	buffer.WriteString(`</svg>`)
+
+	return template.HTML(buffer.String())
+}
@@ -0,0 +1,361 @@
+package histogram
+
+import (
+	"math"
+	"math/bits"
+)
+
+// DefaultSignificantDigits is the precision used by New. With 2 significant digits, the error on any recorded value
+// is below 1%.
+const DefaultSignificantDigits = 2
+
+// Histogram is a recorder of positive values (typically durations in nanoseconds), in the spirit of the HDR
+// histogram. The values are not kept: they are counted in buckets whose width grows with the magnitude of the
+// values, so that the relative precision stays the same whatever the value and that the memory used does not depend
+// on the number of recorded values.
+//
+// The buckets are organized as follows: all the values below subBucketCount have their own bucket. Then, each time the
+// magnitude of the value doubles, a new series of subBucketHalfCount buckets, twice as wide as the previous ones, is
+// used.
+type Histogram struct {
+	subBucketCount     int64
+	subBucketHalfCount int64
+	subBucketBits      uint
+	counts             []int64
+	totalCount         int64
+	min                int64
+	max                int64
+	sum                float64
+	sumOfSquares       float64
+}
+
+// Bin is a range of values of the histogram with the number of values recorded in this range
+type Bin struct {
+	From  int64
+	To    int64
+	Count int64
+}
+
+// New creates a new Histogram with the default precision
+//
+// Return the new Histogram
+func New() *Histogram {
+	return NewWithPrecision(DefaultSignificantDigits)
+}
+
+// NewWithPrecision creates a new Histogram
+//
+// Params:
+//  - significantDigits: the number of significant decimal digits kept for each value (between 1 and 5)
+//
+// Return the new Histogram
+func NewWithPrecision(significantDigits int) *Histogram {
+
+	if significantDigits < 1 {
+		significantDigits = 1
+	}
+	if significantDigits > 5 {
+		significantDigits = 5
+	}
+
+	// The smallest power of two able to distinguish 2 * 10^digits values
+	largestSingleUnitValue := uint64(2 * math.Pow10(significantDigits))
+	subBucketBits := uint(bits.Len64(largestSingleUnitValue - 1))
+
+	return &Histogram{
+		subBucketCount:     1 << subBucketBits,
+		subBucketHalfCount: 1 << (subBucketBits - 1),
+		subBucketBits:      subBucketBits,
+		counts:             make([]int64, 1<<subBucketBits),
+		min:                math.MaxInt64,
+		max:                0,
+	}
+}
+
+// Record adds a value to the histogram. Negative values are recorded as 0.
+//
+// Params:
+//  - value: the value to record
+func (histogram *Histogram) Record(value int64) {
+	histogram.RecordMany(value, 1)
+}
+
+// RecordMany adds multiple times the same value to the histogram. Negative values are recorded as 0.
+//
+// Params:
+//  - value: the value to record
+//  - count: the number of times the value is recorded
+func (histogram *Histogram) RecordMany(value int64, count int64) {
+
+	if count <= 0 {
+		return
+	}
+
+	if value < 0 {
+		value = 0
+	}
+
+	index := histogram.indexOf(value)
+	if index >= len(histogram.counts) {
+		grown := make([]int64, index+1)
+		copy(grown, histogram.counts)
+		histogram.counts = grown
+	}
+
+	histogram.counts[index] += count
+	histogram.totalCount += count
+
+	if value < histogram.min {
+		histogram.min = value
+	}
+	if value > histogram.max {
+		histogram.max = value
+	}
+
+	histogram.sum += float64(value) * float64(count)
+	histogram.sumOfSquares += float64(value) * float64(value) * float64(count)
+}
+
+// Merge adds all the values recorded in another histogram to this histogram
+//
+// Params:
+//  - other: the histogram to merge
+func (histogram *Histogram) Merge(other *Histogram) {
+
+	if other == nil || other.totalCount == 0 {
+		return
+	}
+
+	// With a different precision, values have to be recorded again
+	if other.subBucketBits != histogram.subBucketBits {
+		for index, count := range other.counts {
+			if count > 0 {
+				histogram.RecordMany(other.medianEquivalentValue(index), count)
+			}
+		}
+		return
+	}
+
+	if len(other.counts) > len(histogram.counts) {
+		grown := make([]int64, len(other.counts))
+		copy(grown, histogram.counts)
+		histogram.counts = grown
+	}
+
+	for index, count := range other.counts {
+		histogram.counts[index] += count
+	}
+
+	histogram.totalCount += other.totalCount
+	histogram.sum += other.sum
+	histogram.sumOfSquares += other.sumOfSquares
+
+	if other.min < histogram.min {
+		histogram.min = other.min
+	}
+	if other.max > histogram.max {
+		histogram.max = other.max
+	}
+}
+
+// Count returns the number of recorded values
+func (histogram *Histogram) Count() int64 {
+	return histogram.totalCount
+}
+
+// Min returns the smallest recorded value, or 0 if no value was recorded
+func (histogram *Histogram) Min() int64 {
+	if histogram.totalCount == 0 {
+		return 0
+	}
+	return histogram.min
+}
+
+// Max returns the largest recorded value, or 0 if no value was recorded
+func (histogram *Histogram) Max() int64 {
+	return histogram.max
+}
+
+// Mean returns the mean of the recorded values, or 0 if no value was recorded
+func (histogram *Histogram) Mean() float64 {
+	if histogram.totalCount == 0 {
+		return 0
+	}
+	return histogram.sum / float64(histogram.totalCount)
+}
+
+// StdDev returns the standard deviation of the recorded values, or 0 if no value was recorded
+func (histogram *Histogram) StdDev() float64 {
+	if histogram.totalCount == 0 {
+		return 0
+	}
+	mean := histogram.Mean()
+	variance := histogram.sumOfSquares/float64(histogram.totalCount) - mean*mean
+	if variance < 0 {
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// Percentile returns the value below which the given percentage of the recorded values are. The returned value is
+// the highest value equivalent to the recorded values in the bucket, capped by the maximum recorded value.
+//
+// Params:
+//  - percentile: the percentile, between 0 and 100
+//
+// Return the value at the given percentile, or 0 if no value was recorded
+func (histogram *Histogram) Percentile(percentile float64) int64 {
+
+	if histogram.totalCount == 0 {
+		return 0
+	}
+
+	if percentile <= 0 {
+		return histogram.Min()
+	}
+	if percentile >= 100 {
+		return histogram.max
+	}
+
+	countAtPercentile := int64(math.Ceil(percentile / 100.0 * float64(histogram.totalCount)))
+	if countAtPercentile < 1 {
+		countAtPercentile = 1
+	}
+
+	var total int64
+	for index, count := range histogram.counts {
+		total += count
+		if total >= countAtPercentile {
+			value := histogram.highestEquivalentValue(index)
+			if value > histogram.max {
+				return histogram.max
+			}
+			if value < histogram.min {
+				return histogram.min
+			}
+			return value
+		}
+	}
+
+	return histogram.max
+}
+
+// CountAbove returns the number of recorded values that are strictly above the given value. As values are grouped
+// in buckets, the bucket containing the given value is counted as being above if its lowest value is above.
+//
+// Params:
+//  - value: the value
+//
+// Return the number of recorded values above the given value
+func (histogram *Histogram) CountAbove(value int64) int64 {
+
+	var total int64
+	for index, count := range histogram.counts {
+		if count > 0 && histogram.lowestEquivalentValue(index) > value {
+			total += count
+		}
+	}
+
+	return total
+}
+
+// Bins returns the distribution of the recorded values in bins of exponentially growing width, between the minimum
+// and the maximum recorded values.
+//
+// Params:
+//  - numberOfBins: the number of bins
+//
+// Return the bins, or an empty slice if no value was recorded
+func (histogram *Histogram) Bins(numberOfBins int) []Bin {
+
+	if histogram.totalCount == 0 || numberOfBins < 1 {
+		return []Bin{}
+	}
+
+	min := float64(histogram.Min())
+	max := float64(histogram.max)
+	if min < 1 {
+		min = 1
+	}
+
+	// Compute the upper bound of each bin
+	ratio := math.Pow(max/min, 1.0/float64(numberOfBins))
+	bins := make([]Bin, numberOfBins)
+	from := histogram.Min()
+	for i := range bins {
+		to := int64(math.Ceil(min * math.Pow(ratio, float64(i+1))))
+		if i == numberOfBins-1 || to > histogram.max {
+			to = histogram.max
+		}
+		bins[i] = Bin{From: from, To: to}
+		from = to
+	}
+
+	// Dispatch the buckets in the bins
+	for index, count := range histogram.counts {
+		if count == 0 {
+			continue
+		}
+
+		value := histogram.medianEquivalentValue(index)
+		binIndex := 0
+		for binIndex < numberOfBins-1 && value > bins[binIndex].To {
+			binIndex++
+		}
+		bins[binIndex].Count += count
+	}
+
+	return bins
+}
+
+// indexOf returns the index of the bucket of a value
+func (histogram *Histogram) indexOf(value int64) int {
+
+	if value < histogram.subBucketCount {
+		return int(value)
+	}
+
+	shift := uint(bits.Len64(uint64(value))) - histogram.subBucketBits
+	subBucket := value >> shift
+
+	return int(histogram.subBucketCount + int64(shift-1)*histogram.subBucketHalfCount + subBucket - histogram.subBucketHalfCount)
+}
+
+// lowestEquivalentValue returns the lowest value counted in a bucket
+func (histogram *Histogram) lowestEquivalentValue(index int) int64 {
+
+	if int64(index) < histogram.subBucketCount {
+		return int64(index)
+	}
+
+	shift, subBucket := histogram.decompose(index)
+
+	return subBucket << shift
+}
+
+// highestEquivalentValue returns the highest value counted in a bucket
+func (histogram *Histogram) highestEquivalentValue(index int) int64 {
+
+	if int64(index) < histogram.subBucketCount {
+		return int64(index)
+	}
+
+	shift, subBucket := histogram.decompose(index)
+
+	return ((subBucket + 1) << shift) - 1
+}
+
+// medianEquivalentValue returns the value in the middle of a bucket
+func (histogram *Histogram) medianEquivalentValue(index int) int64 {
+	low := histogram.lowestEquivalentValue(index)
+	return low + (histogram.highestEquivalentValue(index)-low)/2
+}
+
+func (histogram *Histogram) decompose(index int) (uint, int64) {
+
+	offset := int64(index) - histogram.subBucketCount
+	shift := uint(offset/histogram.subBucketHalfCount) + 1
+	subBucket := offset%histogram.subBucketHalfCount + histogram.subBucketHalfCount
+
+	return shift, subBucket
+}
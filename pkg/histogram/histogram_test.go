@@ -0,0 +1,105 @@
+package histogram
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestIndexOfRoundTrip(t *testing.T) {
+
+	values := []int64{0, 1, 2, 127, 128, 255, 256, 257, 1000, 1023, 1024, 1025, 123456, 1 << 20, (1 << 20) - 1, 987654321, 1 << 40, math.MaxInt64 >> 2}
+
+	for _, significantDigits := range []int{1, 2, 3} {
+
+		histogram := NewWithPrecision(significantDigits)
+		maximumError := math.Pow10(-significantDigits)
+
+		for _, value := range values {
+
+			index := histogram.indexOf(value)
+			low := histogram.lowestEquivalentValue(index)
+			high := histogram.highestEquivalentValue(index)
+
+			if value < low || value > high {
+				t.Errorf("%v digits: the value %v is not in its bucket [%v, %v]", significantDigits, value, low, high)
+			}
+			if histogram.indexOf(low) != index || histogram.indexOf(high) != index {
+				t.Errorf("%v digits: the bounds [%v, %v] of the bucket of %v are not in the bucket %v", significantDigits, low, high, value, index)
+			}
+			if low > 0 && float64(high-low)/float64(low) > maximumError {
+				t.Errorf("%v digits: the bucket [%v, %v] of %v is too wide", significantDigits, low, high, value)
+			}
+		}
+	}
+}
+
+func TestDecomposeRoundTrip(t *testing.T) {
+
+	histogram := New()
+
+	// Each bucket starts right after the previous one
+	for index := 1; index < 5000; index++ {
+
+		low := histogram.lowestEquivalentValue(index)
+		if histogram.indexOf(low) != index {
+			t.Fatalf("the lowest value %v of the bucket %v is in the bucket %v", low, index, histogram.indexOf(low))
+		}
+		if previousHigh := histogram.highestEquivalentValue(index - 1); previousHigh+1 != low {
+			t.Fatalf("the bucket %v ends at %v but the bucket %v starts at %v", index-1, previousHigh, index, low)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+
+	random := rand.New(rand.NewSource(1))
+
+	samples := []struct {
+		name   string
+		values []int64
+	}{
+		{"single value", []int64{42}},
+		{"small values", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"uniform", make([]int64, 10000)},
+		{"exponential", make([]int64, 10000)},
+	}
+	for i := range samples[2].values {
+		samples[2].values[i] = random.Int63n(1000000000)
+	}
+	for i := range samples[3].values {
+		samples[3].values[i] = int64(random.ExpFloat64() * 50000000)
+	}
+
+	for _, sample := range samples {
+		t.Run(sample.name, func(t *testing.T) {
+
+			histogram := New()
+			for _, value := range sample.values {
+				histogram.Record(value)
+			}
+
+			sorted := append([]int64(nil), sample.values...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			if histogram.Min() != sorted[0] || histogram.Max() != sorted[len(sorted)-1] {
+				t.Errorf("expected min %v and max %v, got %v and %v", sorted[0], sorted[len(sorted)-1], histogram.Min(), histogram.Max())
+			}
+
+			for _, percentile := range []float64{1, 10, 50, 90, 95, 99, 99.9} {
+
+				rank := int(math.Ceil(percentile/100.0*float64(len(sorted)))) - 1
+				if rank < 0 {
+					rank = 0
+				}
+				expected := sorted[rank]
+				actual := histogram.Percentile(percentile)
+
+				if math.Abs(float64(actual-expected)) > 0.01*float64(expected) {
+					t.Errorf("p%v: expected %v, got %v", percentile, expected, actual)
+				}
+			}
+		})
+	}
+}
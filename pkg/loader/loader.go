@@ -1,9 +1,13 @@
 package loader
 
 import (
+	"errors"
+	"fmt"
 	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/threshold"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"path/filepath"
 )
 
 // LoadFromFile loads a Test from a file. The test is checked and if needed some sane default values
@@ -20,25 +24,246 @@ func LoadFromFile(fileName string) (*definition.Test, error) {
 		return nil, err
 	}
 
+	return load(data, filepath.Dir(fileName))
+}
+
+// LoadFromData loads a Test from its definition, in YAML or in JSON. The test is checked and if needed some sane
+// default values are set. As the definition is not read from a file, its scenarios can not refer to other files.
+//
+// Params:
+//  - data: the definition of the test
+//
+// Return a Test object and an error if the loading fail
+func LoadFromData(data []byte) (*definition.Test, error) {
+	return load(data, "")
+}
+
+func load(data []byte, directory string) (*definition.Test, error) {
+
 	var test definition.Test
-	err = yaml.Unmarshal(data, &test)
+	err := yaml.Unmarshal(data, &test)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err = loadScenarios(&test, directory); err != nil {
+		return nil, err
+	}
+
 	return validateAndFix(&test)
 }
 
 func validateAndFix(test *definition.Test) (*definition.Test, error) {
 
-	if test.Swarm.CreationRate == 0 {
-		test.Swarm.CreationRate = 1
+	if test.Swarm.IsClosedModel() {
+		if len(test.Swarm.Phases) > 0 {
+			return nil, errors.New("the phases of the swarm can not be used with virtual users")
+		}
+		if test.Swarm.Iterations == 0 && test.Swarm.Duration == 0 {
+			test.Swarm.Iterations = 1
+		}
+	} else {
+		if test.Swarm.CreationRate == 0 && len(test.Swarm.Phases) == 0 {
+			test.Swarm.CreationRate = 1
+		}
+		if test.Swarm.NumberOfRuns == 0 && !test.Swarm.IsLimitedByDuration() {
+			test.Swarm.NumberOfRuns = 1
+		}
+	}
+
+	switch test.Swarm.Arrival {
+	case "", definition.UniformArrival, definition.PoissonArrival:
+	default:
+		return nil, fmt.Errorf("the arrival of the swarm is expected to be %v or %v", definition.UniformArrival, definition.PoissonArrival)
+	}
+
+	if err := fixPhases(test.Swarm.Phases); err != nil {
+		return nil, err
+	}
+
+	if test.AbortConditions.ErrorRate < 0 || test.AbortConditions.ErrorRate > 100 {
+		return nil, errors.New("the error rate of the abort conditions is expected to be a percentage between 0 and 100")
+	}
+	if test.AbortConditions.Window == 0 && (test.AbortConditions.ErrorRate > 0 || test.AbortConditions.Unreachable) {
+		test.AbortConditions.Window = definition.DefaultAbortWindow
+	}
+
+	if err := validateThinkTime(test.Swarm.ThinkTime, "the think time of the swarm"); err != nil {
+		return nil, err
+	}
+	for _, stage := range test.Stages {
+		for _, action := range stage.Actions {
+			if err := validateThinkTime(action.ThinkTime, "the think time of the action "+action.Name); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if test.Swarm.NumberOfRuns == 0 {
-		test.Swarm.NumberOfRuns = 1
+	if _, err := threshold.ParseAll(*test); err != nil {
+		return nil, err
 	}
 
 	return test, nil
 }
+
+// fixPhases checks the phases of a swarm and sets their rates, so that each phase has explicit starting and ending
+// rates
+func fixPhases(phases []definition.Phase) error {
+
+	var previousRate uint
+	for i := range phases {
+
+		phase := &phases[i]
+		if phase.Duration == 0 {
+			return fmt.Errorf("the phase %v of the swarm has no duration", i+1)
+		}
+
+		if phase.CreationRate == nil {
+			rate := previousRate
+			phase.CreationRate = &rate
+		}
+		if phase.TargetRate == nil {
+			rate := *phase.CreationRate
+			phase.TargetRate = &rate
+		}
+
+		previousRate = *phase.TargetRate
+	}
+
+	return nil
+}
+
+// validateThinkTime checks that a think time has a known distribution and consistent values
+//
+// Params:
+//  - thinkTime: the think time
+//  - description: the description of the think time, used in the error
+//
+// Return an error if the think time is not valid
+func validateThinkTime(thinkTime definition.ThinkTime, description string) error {
+
+	switch thinkTime.Distribution {
+	case "", definition.FixedDistribution, definition.NormalDistribution, definition.ExponentialDistribution:
+	case definition.UniformDistribution:
+		if thinkTime.Maximum < thinkTime.Minimum {
+			return fmt.Errorf("%v has a maximum lower than its minimum", description)
+		}
+	default:
+		return fmt.Errorf("%v is expected to have a distribution %v, %v, %v or %v", description, definition.FixedDistribution, definition.UniformDistribution, definition.NormalDistribution, definition.ExponentialDistribution)
+	}
+
+	return nil
+}
+
+// loadScenarios moves the stages of the scenarios of a test to the stages of the test, reading the files of the
+// scenarios if needed. A test already loaded, whose stages give their scenario, is kept as is.
+//
+// Params:
+//  - test: the test
+//  - directory: the directory of the file of the test, from which the files of the scenarios are read, or an empty
+//    string if the test was not read from a file
+//
+// Return an error if a scenario can not be loaded
+func loadScenarios(test *definition.Test, directory string) error {
+
+	if len(test.Scenarios) == 0 {
+		for _, stage := range test.Stages {
+			if len(stage.Scenario) > 0 {
+				return fmt.Errorf("the stage %v belongs to the scenario %v but the test has no scenarios", stage.Name, stage.Scenario)
+			}
+		}
+		return nil
+	}
+
+	names := make(map[string]bool, len(test.Scenarios))
+	stages := make([]definition.Stage, 0, len(test.Stages))
+
+	for i := range test.Scenarios {
+
+		scenario := &test.Scenarios[i]
+		if len(scenario.File) > 0 {
+			if err := loadScenarioFile(scenario, directory); err != nil {
+				return err
+			}
+		}
+
+		if len(scenario.Name) == 0 {
+			return fmt.Errorf("the scenario %v has no name", i+1)
+		}
+		if names[scenario.Name] {
+			return fmt.Errorf("the scenario %v is defined more than once", scenario.Name)
+		}
+		names[scenario.Name] = true
+
+		if scenario.Weight == 0 {
+			return fmt.Errorf("the scenario %v has no weight", scenario.Name)
+		}
+
+		for _, stage := range scenario.Stages {
+			stage.Scenario = scenario.Name
+			stages = append(stages, stage)
+		}
+		scenario.Stages = nil
+	}
+
+	// The stages already given must belong to a scenario, as for a test already loaded
+	for _, stage := range test.Stages {
+		if !names[stage.Scenario] {
+			return fmt.Errorf("the stage %v does not belong to any scenario of the test", stage.Name)
+		}
+	}
+	test.Stages = append(test.Stages, stages...)
+
+	for _, scenario := range test.Scenarios {
+		if len(test.StageIndexes(scenario.Name)) == 0 {
+			return fmt.Errorf("the scenario %v has no stages", scenario.Name)
+		}
+	}
+
+	return nil
+}
+
+// loadScenarioFile sets the stages of a scenario from the file of another test. If the scenario has no name, the
+// name of the test is used.
+//
+// Params:
+//  - scenario: the scenario
+//  - directory: the directory from which the file is read
+//
+// Return an error if the file can not be loaded
+func loadScenarioFile(scenario *definition.Scenario, directory string) error {
+
+	if len(directory) == 0 {
+		return fmt.Errorf("the file %v of the scenario %v can only be read from a test file", scenario.File, scenario.Name)
+	}
+	if len(scenario.Stages) > 0 {
+		return fmt.Errorf("the scenario %v can not have both a file and stages", scenario.Name)
+	}
+
+	fileName := scenario.File
+	if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(directory, fileName)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	var scenarioTest definition.Test
+	if err = yaml.Unmarshal(data, &scenarioTest); err != nil {
+		return fmt.Errorf("the file %v of the scenario %v can not be read: %v", scenario.File, scenario.Name, err)
+	}
+	if len(scenarioTest.Scenarios) > 0 {
+		return fmt.Errorf("the file %v of the scenario %v can not have scenarios itself", scenario.File, scenario.Name)
+	}
+
+	if len(scenario.Name) == 0 {
+		scenario.Name = scenarioTest.TestName
+	}
+	scenario.Stages = scenarioTest.Stages
+	scenario.File = ""
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/runner"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the duration histograms
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// actionKey identifies an action of the test
+type actionKey struct {
+	stageIndex  int
+	actionIndex int
+}
+
+// actionMetrics holds the metrics of a single action
+type actionMetrics struct {
+	nbSuccess      int64
+	nbFailure      int64
+	failures       map[db.ErrorCategory]int64
+	bucketCounts   []int64
+	durationsSum   float64
+	durationsCount int64
+}
+
+// Exporter collects the results of the actions while a Test is running and publishes them in the Prometheus text
+// format
+type Exporter struct {
+	sink.Base
+	mutex   sync.Mutex
+	test    definition.Test
+	actions map[actionKey]*actionMetrics
+}
+
+// NewExporter creates a new Exporter for a Test. The exporter must then be given to the runner as a sink, usually
+// through a sink.Multi.
+//
+// Params:
+//  - test: the Test that will be run
+//
+// Return the new Exporter
+func NewExporter(test definition.Test) *Exporter {
+	return &Exporter{
+		test:    test,
+		actions: make(map[actionKey]*actionMetrics),
+	}
+}
+
+// ActionFinished records the result of a finished action
+//
+// Params:
+//  - entry: the result of the action
+func (exporter *Exporter) ActionFinished(entry *db.ActionEntry) {
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	key := actionKey{
+		stageIndex:  entry.StageIndex,
+		actionIndex: entry.ActionIndex,
+	}
+
+	metrics, ok := exporter.actions[key]
+	if !ok {
+		metrics = &actionMetrics{
+			failures:     make(map[db.ErrorCategory]int64),
+			bucketCounts: make([]int64, len(durationBuckets)),
+		}
+		exporter.actions[key] = metrics
+	}
+
+	if entry.Success {
+		metrics.nbSuccess++
+	} else {
+		metrics.nbFailure++
+		metrics.failures[entry.ErrorCategory]++
+	}
+
+	duration := time.Duration(entry.DurationNano).Seconds()
+	for i, upperBound := range durationBuckets {
+		if duration <= upperBound {
+			metrics.bucketCounts[i]++
+		}
+	}
+	metrics.durationsSum += duration
+	metrics.durationsCount++
+}
+
+// ServeHTTP publishes the metrics in the Prometheus text format
+func (exporter *Exporter) ServeHTTP(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := writer.Write(exporter.Metrics()); err != nil {
+		log.Warnf("unable to write the metrics due to %v", err)
+	}
+}
+
+// Metrics returns the current metrics in the Prometheus text format
+func (exporter *Exporter) Metrics() []byte {
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	var buffer bytes.Buffer
+
+	// Sort the actions so that the output is stable
+	keys := make([]actionKey, 0, len(exporter.actions))
+	for key := range exporter.actions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stageIndex != keys[j].stageIndex {
+			return keys[i].stageIndex < keys[j].stageIndex
+		}
+		return keys[i].actionIndex < keys[j].actionIndex
+	})
+
+	writeHeader(&buffer, "gargote_active_tests", "gauge", "Number of tests currently running.")
+	fmt.Fprintf(&buffer, "gargote_active_tests %d\n", runner.GetCurrentNumberOfRunningTests())
+
+	writeHeader(&buffer, "gargote_max_active_tests", "gauge", "Maximum number of tests running at the same time.")
+	fmt.Fprintf(&buffer, "gargote_max_active_tests %d\n", runner.GetMaximumNumberOfRunningTests())
+
+	writeHeader(&buffer, "gargote_actions_total", "counter", "Number of executed actions.")
+	for _, key := range keys {
+		metrics := exporter.actions[key]
+		labels := exporter.labels(key)
+		fmt.Fprintf(&buffer, "gargote_actions_total{%s,result=\"success\"} %d\n", labels, metrics.nbSuccess)
+		fmt.Fprintf(&buffer, "gargote_actions_total{%s,result=\"failure\"} %d\n", labels, metrics.nbFailure)
+	}
+
+	writeHeader(&buffer, "gargote_action_failures_total", "counter", "Number of failed actions by reason.")
+	for _, key := range keys {
+		metrics := exporter.actions[key]
+		labels := exporter.labels(key)
+
+		categories := make([]db.ErrorCategory, 0, len(metrics.failures))
+		for category := range metrics.failures {
+			categories = append(categories, category)
+		}
+		sort.Slice(categories, func(i, j int) bool { return categories[i] < categories[j] })
+
+		for _, category := range categories {
+			fmt.Fprintf(&buffer, "gargote_action_failures_total{%s,reason=\"%s\"} %d\n", labels, category.ToString(), metrics.failures[category])
+		}
+	}
+
+	writeHeader(&buffer, "gargote_action_duration_seconds", "histogram", "Duration of the executed actions.")
+	for _, key := range keys {
+		metrics := exporter.actions[key]
+		labels := exporter.labels(key)
+
+		for i, upperBound := range durationBuckets {
+			fmt.Fprintf(&buffer, "gargote_action_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(upperBound, 'g', -1, 64), metrics.bucketCounts[i])
+		}
+		fmt.Fprintf(&buffer, "gargote_action_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, metrics.durationsCount)
+		fmt.Fprintf(&buffer, "gargote_action_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(metrics.durationsSum, 'g', -1, 64))
+		fmt.Fprintf(&buffer, "gargote_action_duration_seconds_count{%s} %d\n", labels, metrics.durationsCount)
+	}
+
+	return buffer.Bytes()
+}
+
+// labels returns the labels identifying an action
+func (exporter *Exporter) labels(key actionKey) string {
+
+	stageName := ""
+	actionName := ""
+	if key.stageIndex < len(exporter.test.Stages) {
+		stage := exporter.test.Stages[key.stageIndex]
+		stageName = stage.FullName()
+		if key.actionIndex < len(stage.Actions) {
+			actionName = stage.Actions[key.actionIndex].Name
+		}
+	}
+
+	return fmt.Sprintf(
+		"test=\"%s\",stage=\"%s\",action=\"%s\"",
+		escapeLabel(exporter.test.TestName),
+		escapeLabel(stageName),
+		escapeLabel(actionName))
+}
+
+func writeHeader(buffer *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// Serve starts an HTTP server publishing the metrics of the exporter on /metrics. The server runs until the context
+// is done.
+//
+// Params:
+//  - ctx: the context of the server
+//  - address: the address to listen to, for example ":9090"
+//  - exporter: the exporter to publish
+//
+// Return an error if the server can not listen to the address
+func Serve(ctx context.Context, address string, exporter *Exporter) error {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("the metrics server stopped due to %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Warnf("unable to close the metrics server due to %v", err)
+		}
+	}()
+
+	return nil
+}
@@ -2,31 +2,107 @@ package runner
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
 	"github.com/twuillemin/gargote/pkg/definition"
 )
 
+// maximumFailureBodySize is the maximum size of the bodies kept in the details of a failure
+const maximumFailureBodySize = 2048
+
+// maximumFailureDetailsByAction is the number of failures of each action whose details are kept, so that the memory
+// used stays bounded when the target keeps failing during a long test
+const maximumFailureDetailsByAction = 50
+
+// The number of failures whose details were kept are set up by RunTest, indexed by stage and by action, and are then
+// updated atomically by all the tests of the run
+var failureDetailsCounts [][]int64
+
+// ActionResult is the outcome of the execution of an Action, whether it is successful or not
+type ActionResult struct {
+	StatusCode     int
+	ErrorCategory  db.ErrorCategory
+	HTTPTimings    db.HTTPTimings
+	FailureDetails *db.FailureDetails
+	request        *http.Request
+	response       *http.Response
+	responseBody   []byte
+}
+
+// actionError is an error raised while executing an Action, keeping the category of the failure
+type actionError struct {
+	category db.ErrorCategory
+	err      error
+}
+
+func (e *actionError) Error() string {
+	return e.err.Error()
+}
+
+// newActionError creates a new error with the given category. If the error is nil, nil is returned.
+func newActionError(category db.ErrorCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &actionError{
+		category: category,
+		err:      err,
+	}
+}
+
+// newTransportError creates a new error for an error raised while sending a query or reading a response
+func newTransportError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return newActionError(db.TimeoutError, err)
+	}
+	return newActionError(db.NetworkError, err)
+}
+
 // RunAction executes a single Action.
 //
 // Params:
+//  - ctx: the context of the run. When the context is done, the query is cancelled
 //  - testIndex: the test number
 //  - stageIndex: the stage number
 //  - actionIndex: The action number
 //  - action: the Action to execute
 //  - variables: the existing variables. Note that the map is updated is the action has Capture elements.
 //
-// Return an error if the action fail, nil otherwise
-func RunAction(testIndex int, stageIndex int, actionIndex int, action definition.Action, variables map[string]interface{}) error {
+// Return the result of the action, which is always given, and an error if the action fail, nil otherwise
+func RunAction(ctx context.Context, testIndex int, stageIndex int, actionIndex int, action definition.Action, variables map[string]interface{}) (*ActionResult, error) {
+
+	result := &ActionResult{
+		ErrorCategory: db.NoError,
+	}
+
+	err := runAction(ctx, testIndex, stageIndex, actionIndex, action, variables, result)
+	if err != nil {
+		result.ErrorCategory = db.NetworkError
+		if actionErr, ok := err.(*actionError); ok {
+			result.ErrorCategory = actionErr.category
+		}
+		if keepFailureDetails(stageIndex, actionIndex) {
+			result.FailureDetails = newFailureDetails(result.request, result.response, result.responseBody)
+		}
+	}
+
+	return result, err
+}
+
+func runAction(ctx context.Context, testIndex int, stageIndex int, actionIndex int, action definition.Action, variables map[string]interface{}, result *ActionResult) error {
 
 	stageTitle := fmt.Sprintf("Action %v-%v-%v:", testIndex, stageIndex, actionIndex)
 
@@ -47,26 +123,39 @@ func RunAction(testIndex int, stageIndex int, actionIndex int, action definition
 	req, err := prepareQuery(variables, action.Query)
 	if err != nil {
 		log.Warnf("%s ---> Error while preparing the query %v", stageTitle, err)
-		return err
+		return newActionError(db.TemplateError, err)
 	}
 
+	// Trace the phases of the query
+	tracer := &requestTracer{}
+	req = tracer.trace(req.WithContext(ctx))
+	result.request = req
+	defer func() {
+		result.HTTPTimings = tracer.timings()
+	}()
+
 	// Make the actual query
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Warnf("%s ---> Error while sending query %v", stageTitle, err)
-		return err
+		return newTransportError(err)
 	}
 
 	if resp == nil {
 		log.Warnf("%s ---> No response Received", stageTitle)
-		return errors.New("no response received to query")
+		return newActionError(db.NetworkError, errors.New("no response received to query"))
 	}
 
+	result.StatusCode = resp.StatusCode
+	result.response = resp
+
 	// Read the body as it is used by check and save
 	body, err := ioutil.ReadAll(resp.Body)
+	tracer.setBodyRead()
+	result.responseBody = body
 	if err != nil {
 		log.Warnf("%s ---> Unable to read the body", stageTitle)
-		return err
+		return newTransportError(err)
 	}
 
 	defer func() {
@@ -84,13 +173,71 @@ func RunAction(testIndex int, stageIndex int, actionIndex int, action definition
 	// Capture the response
 	if err = saveResponse(resp, body, action.Response.Capture, variables); err != nil {
 		log.Warnf("%s ---> Error while capturing the response: %v", stageTitle, err)
-		return err
+		return newActionError(db.CaptureError, err)
 	}
 
 	log.Infof("%s ---> OK", stageTitle)
 	return nil
 }
 
+// setUpFailureDetails resets the number of failures whose details were kept for all the actions of a Test
+//
+// Params:
+//  - test: the Test
+func setUpFailureDetails(test definition.Test) {
+
+	failureDetailsCounts = make([][]int64, len(test.Stages))
+	for stageIndex, stage := range test.Stages {
+		failureDetailsCounts[stageIndex] = make([]int64, len(stage.Actions))
+	}
+}
+
+// keepFailureDetails returns true if the details of a new failure of an action can be kept
+func keepFailureDetails(stageIndex int, actionIndex int) bool {
+
+	if stageIndex >= len(failureDetailsCounts) || actionIndex >= len(failureDetailsCounts[stageIndex]) {
+		return false
+	}
+
+	return atomic.AddInt64(&failureDetailsCounts[stageIndex][actionIndex], 1) <= maximumFailureDetailsByAction
+}
+
+// newFailureDetails keeps the request and the response of a failed action, with their body truncated. The request
+// and the response can be nil if the action failed before they were available.
+func newFailureDetails(req *http.Request, resp *http.Response, responseBody []byte) *db.FailureDetails {
+
+	details := &db.FailureDetails{}
+
+	if req != nil {
+		details.RequestMethod = req.Method
+		details.RequestURL = req.URL.String()
+		details.RequestHeaders = db.RedactHeaders(req.Header)
+
+		if req.GetBody != nil {
+			if bodyReader, err := req.GetBody(); err == nil {
+				if requestBody, err := ioutil.ReadAll(bodyReader); err == nil {
+					details.RequestBody = truncateBody(requestBody)
+				}
+			}
+		}
+	}
+
+	if resp != nil {
+		details.ResponseStatus = resp.Status
+		details.ResponseHeaders = db.RedactHeaders(resp.Header)
+		details.ResponseBody = truncateBody(responseBody)
+	}
+
+	return details
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > maximumFailureBodySize {
+		return string(body[:maximumFailureBodySize]) + "..."
+	}
+	return string(body)
+}
+
 func prepareQuery(variables map[string]interface{}, query definition.Query) (*http.Request, error) {
 	// Prepare the bodyToSend the bodyToSend
 	bodyToSend := []byte("")
@@ -230,7 +377,7 @@ func checkResponse(resp *http.Response, body []byte, check definition.Validation
 		}
 
 		if !codeReceivedAccepted {
-			return fmt.Errorf("received Bad Status %d (Expected: %v)", resp.StatusCode, check.StatusCodes)
+			return newActionError(db.StatusError, fmt.Errorf("received Bad Status %d (Expected: %v)", resp.StatusCode, check.StatusCodes))
 		}
 	}
 
@@ -241,7 +388,7 @@ func checkResponse(resp *http.Response, body []byte, check definition.Validation
 
 			responseHeader := resp.Header.Get(headerName)
 			if len(responseHeader) == 0 || responseHeader != expectedValue {
-				return fmt.Errorf("expected '%s' for response header '%s', but was not received", expectedValue, headerName)
+				return newActionError(db.HeaderError, fmt.Errorf("expected '%s' for response header '%s', but was not received", expectedValue, headerName))
 			}
 		}
 	}
@@ -249,7 +396,7 @@ func checkResponse(resp *http.Response, body []byte, check definition.Validation
 	if len(check.BodyJSON) > 0 || len(check.BodyText) > 0 {
 
 		if len(body) == 0 {
-			return fmt.Errorf("body should be checked, but can not be read from response")
+			return newActionError(db.BodyError, fmt.Errorf("body should be checked, but can not be read from response"))
 		}
 
 		// Check the body against a Regex
@@ -258,24 +405,24 @@ func checkResponse(resp *http.Response, body []byte, check definition.Validation
 			matched, err := regexp.Match(check.BodyText, body)
 
 			if err != nil {
-				return fmt.Errorf("body text should be checked against the RegExp '%v' but the RegExp is probably malformed", check.BodyText)
+				return newActionError(db.BodyError, fmt.Errorf("body text should be checked against the RegExp '%v' but the RegExp is probably malformed", check.BodyText))
 			}
 
 			if !matched {
-				return fmt.Errorf("body of the query is not matching the expected RegExp")
+				return newActionError(db.BodyError, fmt.Errorf("body of the query is not matching the expected RegExp"))
 			}
 		}
 
 		if len(check.BodyJSON) > 0 {
 			var data interface{}
 			if err := json.Unmarshal(body, &data); err != nil {
-				return fmt.Errorf("body text should be checked against JSON, but the body can not be converted to JSON")
+				return newActionError(db.BodyError, fmt.Errorf("body text should be checked against JSON, but the body can not be converted to JSON"))
 			}
 
 			// Check the body against a Regex
 			for jsonKey, jsonValue := range check.BodyJSON {
 				if err := checkJSONValue(data, jsonKey, jsonValue); err != nil {
-					return fmt.Errorf("an expected value is the JSON response can not be found : %v", err)
+					return newActionError(db.BodyError, fmt.Errorf("an expected value is the JSON response can not be found : %v", err))
 				}
 			}
 		}
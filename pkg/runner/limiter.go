@@ -0,0 +1,112 @@
+package runner
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+// The limiters of the request rates are created by RunTest, before starting the tests, and are then shared by all
+// the tests of the run. The limiters of the actions are indexed by stage and by action.
+var testLimiter *limiter
+var actionLimiters [][]*limiter
+
+// limiter is a token bucket limiting the rate of the requests. The bucket holds a single token, so that the requests
+// are evenly spaced instead of being sent in bursts. When the bucket is empty, the requests wait for their token in
+// the order they arrived.
+type limiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter creates a new limiter
+//
+// Params:
+//  - rate: the number of requests by second
+//
+// Return the new limiter, or nil if the rate is 0
+func newLimiter(rate uint) *limiter {
+
+	if rate == 0 {
+		return nil
+	}
+
+	return &limiter{
+		rate:   float64(rate),
+		tokens: 1,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket, even if it is not available yet
+//
+// Return the duration to wait before the token is available
+func (limiter *limiter) reserve() time.Duration {
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.tokens = math.Min(1, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+	limiter.tokens--
+
+	if limiter.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+// wait waits until a request is allowed by the limiter, unless the context is done. A nil limiter allows all the
+// requests.
+//
+// Return true if the request is allowed, false if the context is done
+func (limiter *limiter) wait(ctx context.Context) bool {
+	if limiter == nil {
+		return ctx.Err() == nil
+	}
+
+	return sleepContext(ctx, limiter.reserve())
+}
+
+// setUpLimiters creates the limiters of the request rates of a Test
+//
+// Params:
+//  - test: the Test
+func setUpLimiters(test definition.Test) {
+
+	testLimiter = newLimiter(test.RequestRate)
+
+	actionLimiters = make([][]*limiter, len(test.Stages))
+	for stageIndex, stage := range test.Stages {
+		actionLimiters[stageIndex] = make([]*limiter, len(stage.Actions))
+		for actionIndex, action := range stage.Actions {
+			actionLimiters[stageIndex][actionIndex] = newLimiter(action.RequestRate)
+		}
+	}
+}
+
+// waitForRequest waits until the request of an action is allowed by the limiters of the action and of the test
+//
+// Params:
+//  - ctx: the context of the run
+//  - stageIndex: the stage number
+//  - actionIndex: the action number
+//
+// Return true if the request is allowed, false if the context is done
+func waitForRequest(ctx context.Context, stageIndex int, actionIndex int) bool {
+
+	if stageIndex < len(actionLimiters) && actionIndex < len(actionLimiters[stageIndex]) {
+		if !actionLimiters[stageIndex][actionIndex].wait(ctx) {
+			return false
+		}
+	}
+
+	return testLimiter.wait(ctx)
+}
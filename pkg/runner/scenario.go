@@ -0,0 +1,56 @@
+package runner
+
+import (
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+// scenarioPicker chooses the scenario of each new run of a Test, in proportion of the weights of the scenarios. It
+// uses a smooth weighted round robin, so that the proportions are respected even for a small number of runs and that
+// the runs of each scenario are spread over time rather than grouped. It is not safe for concurrent use.
+type scenarioPicker struct {
+	scenarios   []definition.Scenario
+	credits     []int
+	totalWeight int
+}
+
+// newScenarioPicker creates a new scenarioPicker
+//
+// Params:
+//  - test: the Test whose scenarios are picked
+//
+// Return the new scenarioPicker
+func newScenarioPicker(test definition.Test) *scenarioPicker {
+
+	picker := &scenarioPicker{
+		scenarios: test.Scenarios,
+		credits:   make([]int, len(test.Scenarios)),
+	}
+
+	for _, scenario := range test.Scenarios {
+		picker.totalWeight += int(scenario.Weight)
+	}
+
+	return picker
+}
+
+// next returns the scenario of the next run. Each scenario earns its weight and the scenario with the most credits is
+// chosen, paying the total of the weights.
+//
+// Return the name of the scenario, or an empty string if the Test has no scenarios
+func (picker *scenarioPicker) next() string {
+
+	if len(picker.scenarios) == 0 {
+		return ""
+	}
+
+	chosen := 0
+	for i, scenario := range picker.scenarios {
+		picker.credits[i] += int(scenario.Weight)
+		if picker.credits[i] > picker.credits[chosen] {
+			chosen = i
+		}
+	}
+	picker.credits[chosen] -= picker.totalWeight
+
+	return picker.scenarios[chosen].Name
+}
@@ -0,0 +1,210 @@
+package runner
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/histogram"
+)
+
+// maximumSchedulingLag is the p99 of the scheduling lag above which a warning is displayed
+const maximumSchedulingLag = 10 * time.Millisecond
+
+// schedule gives the start time of each test of a Swarm. The Swarm is seen as a series of phases during which the
+// creation rate changes linearly. With uniform arrivals, the n-th test is started when the number of tests that
+// should have been started since the beginning, which is the integral of the creation rate, reaches n. With Poisson
+// arrivals, this integral is increased by a random value following an exponential distribution of mean 1 between two
+// tests instead of 1, which gives a Poisson process even when the rate changes.
+//
+// As the start times are computed from the beginning of the swarm and not from the previous start, the rounding and
+// the delays of the timers do not add up, whatever the creation rate.
+type schedule struct {
+	phases       []schedulePhase
+	maximumRuns  int
+	random       *rand.Rand
+	phaseIndex   int
+	phaseArrival float64
+	arrival      float64
+	count        int
+}
+
+// schedulePhase is a phase of a schedule, all the values being in seconds and in tests by second
+type schedulePhase struct {
+	name     string
+	start    float64
+	duration float64
+	fromRate float64
+	toRate   float64
+}
+
+// newSchedule creates the schedule of a Swarm
+//
+// Params:
+//  - swarm: the Swarm
+//
+// Return the new schedule
+func newSchedule(swarm definition.Swarm) *schedule {
+
+	var phases []schedulePhase
+
+	if len(swarm.Phases) == 0 {
+		// Without phases, the whole swarm is a single phase at constant rate, that ends with the number of runs if
+		// it has no duration
+		duration := math.Inf(1)
+		if swarm.Duration > 0 {
+			duration = float64(swarm.Duration)
+		}
+		phases = append(phases, schedulePhase{
+			duration: duration,
+			fromRate: float64(swarm.CreationRate),
+			toRate:   float64(swarm.CreationRate),
+		})
+	} else {
+		start := 0.0
+		for index, phase := range swarm.Phases {
+			from, to := phase.Rates()
+			name := phase.Name
+			if len(name) == 0 {
+				name = fmt.Sprintf("#%v", index+1)
+			}
+			phases = append(phases, schedulePhase{
+				name:     name,
+				start:    start,
+				duration: float64(phase.Duration),
+				fromRate: float64(from),
+				toRate:   float64(to),
+			})
+			start += float64(phase.Duration)
+		}
+	}
+
+	var random *rand.Rand
+	if swarm.Arrival == definition.PoissonArrival {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return &schedule{
+		phases:      phases,
+		maximumRuns: int(swarm.NumberOfRuns),
+		random:      random,
+	}
+}
+
+// next returns the start time of the next test
+//
+// Return the start time of the next test, relative to the start of the swarm, the index of the phase of the test and
+// false if there is no more test to start
+func (schedule *schedule) next() (time.Duration, int, bool) {
+
+	if schedule.maximumRuns > 0 && schedule.count >= schedule.maximumRuns {
+		return 0, 0, false
+	}
+
+	target := schedule.arrival + 1
+	if schedule.random != nil {
+		target = schedule.arrival + schedule.random.ExpFloat64()
+	}
+
+	for schedule.phaseIndex < len(schedule.phases) {
+
+		phase := schedule.phases[schedule.phaseIndex]
+		arrivals := phase.arrivals()
+
+		if target-schedule.phaseArrival <= arrivals {
+			schedule.count++
+			schedule.arrival = target
+			offset := phase.start + phase.timeOf(target-schedule.phaseArrival)
+			return time.Duration(offset * float64(time.Second)), schedule.phaseIndex, true
+		}
+
+		schedule.phaseArrival += arrivals
+		schedule.phaseIndex++
+	}
+
+	return 0, 0, false
+}
+
+// arrivals returns the number of tests started during the phase, as a real number
+func (phase schedulePhase) arrivals() float64 {
+
+	if phase.fromRate == 0 && phase.toRate == 0 {
+		return 0
+	}
+
+	return (phase.fromRate + phase.toRate) / 2.0 * phase.duration
+}
+
+// timeOf returns the time, from the start of the phase, at which the given number of tests is reached. As the rate is
+// r(t) = from + (to - from) * t / duration, the number of tests is from * t + (to - from) * t² / (2 * duration), whose
+// inverse is computed in a form that is stable even for constant rates.
+//
+// Params:
+//  - arrivals: the number of tests, that must not be greater than the number of tests of the phase
+//
+// Return the time in seconds
+func (phase schedulePhase) timeOf(arrivals float64) float64 {
+
+	a := (phase.toRate - phase.fromRate) / (2.0 * phase.duration)
+	b := phase.fromRate
+
+	return 2.0 * arrivals / (b + math.Sqrt(math.Max(0, b*b+4.0*a*arrivals)))
+}
+
+// lagRecorder records the scheduling lag of the tests, that is the delay between the time a test should have been
+// started and the time it was actually started. A large lag means that the load generator can not keep up with the
+// creation rate, so that the actual load is lower than the expected one.
+type lagRecorder struct {
+	mutex sync.Mutex
+	lags  *histogram.Histogram
+}
+
+// newLagRecorder creates a new lagRecorder
+//
+// Return the new lagRecorder
+func newLagRecorder() *lagRecorder {
+	return &lagRecorder{
+		lags: histogram.New(),
+	}
+}
+
+// record records the lag of a test
+//
+// Params:
+//  - scheduled: the time at which the test should have been started
+func (recorder *lagRecorder) record(scheduled time.Time) {
+
+	lag := time.Since(scheduled)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.lags.Record(int64(lag))
+}
+
+// display displays the statistics of the lag, with a warning if the tests were significantly late
+func (recorder *lagRecorder) display() {
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.lags.Count() == 0 {
+		return
+	}
+
+	p99 := time.Duration(recorder.lags.Percentile(99))
+	fmt.Fprintf(
+		output,
+		"Scheduling lag: mean: %v, p99: %v, max: %v\n",
+		time.Duration(recorder.lags.Mean()).Round(time.Microsecond),
+		p99.Round(time.Microsecond),
+		time.Duration(recorder.lags.Max()).Round(time.Microsecond))
+
+	if p99 > maximumSchedulingLag {
+		log.Warnf("The tests were started up to %v late (p99), the load generator is probably saturated and the actual load is lower than expected", p99.Round(time.Millisecond))
+	}
+}
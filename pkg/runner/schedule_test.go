@@ -0,0 +1,116 @@
+package runner
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+func TestSchedulePhaseArrivalsAndTimeOf(t *testing.T) {
+
+	phases := []struct {
+		name     string
+		phase    schedulePhase
+		arrivals float64
+	}{
+		{"constant", schedulePhase{duration: 10, fromRate: 5, toRate: 5}, 50},
+		{"ramp-up", schedulePhase{duration: 10, fromRate: 0, toRate: 10}, 50},
+		{"ramp-up from a rate", schedulePhase{duration: 4, fromRate: 10, toRate: 30}, 80},
+		{"ramp-down", schedulePhase{duration: 10, fromRate: 10, toRate: 0}, 50},
+		{"ramp-down to a rate", schedulePhase{duration: 60, fromRate: 200, toRate: 50}, 7500},
+		{"no rate", schedulePhase{duration: 10}, 0},
+	}
+
+	for _, test := range phases {
+		t.Run(test.name, func(t *testing.T) {
+
+			phase := test.phase
+			if arrivals := phase.arrivals(); math.Abs(arrivals-test.arrivals) > 1e-9 {
+				t.Fatalf("expected %v arrivals, got %v", test.arrivals, arrivals)
+			}
+
+			// timeOf is the inverse of the integral of the rate
+			for i := 0; i <= 20; i++ {
+				elapsed := phase.duration * float64(i) / 20.0
+				arrivals := phase.fromRate*elapsed + (phase.toRate-phase.fromRate)*elapsed*elapsed/(2.0*phase.duration)
+				if arrivals == 0 && i > 0 {
+					continue
+				}
+				if actual := phase.timeOf(arrivals); math.Abs(actual-elapsed) > 1e-6 {
+					t.Errorf("%v arrivals: expected a time of %v, got %v", arrivals, elapsed, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+
+	rate := func(value uint) *uint { return &value }
+
+	swarms := []struct {
+		name     string
+		swarm    definition.Swarm
+		nbRuns   int
+		duration time.Duration
+	}{
+		{"number of runs", definition.Swarm{NumberOfRuns: 25, CreationRate: 10}, 25, 2500 * time.Millisecond},
+		{"duration", definition.Swarm{Duration: 3, CreationRate: 7}, 21, 3 * time.Second},
+		{"duration limited by the number of runs", definition.Swarm{Duration: 3, CreationRate: 7, NumberOfRuns: 10}, 10, 3 * time.Second},
+		{"phases", definition.Swarm{Phases: []definition.Phase{
+			{Duration: 10, CreationRate: rate(0), TargetRate: rate(10)},
+			{Duration: 5, CreationRate: rate(10), TargetRate: rate(10)},
+			{Duration: 10, CreationRate: rate(10), TargetRate: rate(0)},
+		}}, 150, 25 * time.Second},
+	}
+
+	for _, test := range swarms {
+		t.Run(test.name, func(t *testing.T) {
+
+			swarmSchedule := newSchedule(test.swarm)
+
+			count := 0
+			var previous time.Duration
+			for {
+				offset, _, ok := swarmSchedule.next()
+				if !ok {
+					break
+				}
+				if offset < previous || offset > test.duration {
+					t.Fatalf("run %v: unexpected offset %v after %v", count, offset, previous)
+				}
+				previous = offset
+				count++
+			}
+
+			if count != test.nbRuns {
+				t.Errorf("expected %v runs, got %v", test.nbRuns, count)
+			}
+			if expected := int(test.swarm.ExpectedNumberOfRuns()); count != expected {
+				t.Errorf("expected %v runs as given by the swarm, got %v", expected, count)
+			}
+		})
+	}
+}
+
+func TestScheduleRampUpSpacing(t *testing.T) {
+
+	rate := uint(10)
+	swarmSchedule := newSchedule(definition.Swarm{Phases: []definition.Phase{
+		{Duration: 10, CreationRate: new(uint), TargetRate: &rate},
+	}})
+
+	// With a rate of t tests by second, the n-th test starts at sqrt(2 * n) seconds
+	for n := 1; n <= 50; n++ {
+		offset, _, ok := swarmSchedule.next()
+		if !ok {
+			t.Fatalf("the schedule ended after %v runs", n-1)
+		}
+		expected := math.Sqrt(2.0 * float64(n))
+		if math.Abs(offset.Seconds()-expected) > 1e-6 {
+			t.Errorf("run %v: expected an offset of %vs, got %v", n, expected, offset)
+		}
+	}
+}
@@ -1,22 +1,26 @@
 package runner
 
 import (
+	"context"
 	"github.com/twuillemin/gargote/pkg/db"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/sink"
 )
 
 // RunStage executes a single Stage.
 //
 // Params:
+//  - ctx: the context of the run. When the context is done, the current try is interrupted and is not retried
 //  - testIndex: the test number
 //  - stageIndex: the stage number
 //  - stage: the Stage to execute
+//  - resultSink: the sink receiving the results
 //
-// Return an error if the action fail, nil otherwise
-func RunStage(testIndex int, stageIndex int, stage definition.Stage) error {
+// Return an error if the action fail or if the stage was interrupted, nil otherwise
+func RunStage(ctx context.Context, testIndex int, stageIndex int, stage definition.Stage, resultSink sink.ResultSink) error {
 
 	log.Infof("Stage %v-%v: starting ", testIndex, stageIndex)
 
@@ -28,9 +32,9 @@ func RunStage(testIndex int, stageIndex int, stage definition.Stage) error {
 	tryNumber := 0
 
 	// Run the stages n-times until success
-	for ; tryNumber < maxTries && !success; tryNumber++ {
+	for ; tryNumber < maxTries && !success && ctx.Err() == nil; tryNumber++ {
 
-		err = runStageOneTime(testIndex, stageIndex, stage)
+		err = runStageOneTime(ctx, testIndex, stageIndex, tryNumber, stage, resultSink)
 
 		// If no errors raised, prepare to leave the loop
 		if err == nil {
@@ -48,7 +52,10 @@ func RunStage(testIndex int, stageIndex int, stage definition.Stage) error {
 	return err
 }
 
-func runStageOneTime(testIndex int, stageIndex int, stage definition.Stage) error {
+// runStageOneTime executes a single try of a Stage. If the context is done during the try, the action in progress is
+// cancelled and the actions completed before are given to the sink with the error of the context, so that the results
+// of an interrupted run are kept.
+func runStageOneTime(ctx context.Context, testIndex int, stageIndex int, tryNumber int, stage definition.Stage, resultSink sink.ResultSink) error {
 
 	// variables will store the stage variables
 	variables := make(map[string]interface{})
@@ -56,8 +63,16 @@ func runStageOneTime(testIndex int, stageIndex int, stage definition.Stage) erro
 	// results will store the result for each action
 	results := make([]*db.ActionEntry, 0, len(stage.Actions))
 
-	if stage.DelayBefore > 0 {
-		time.Sleep(time.Duration(stage.DelayBefore) * time.Millisecond)
+	// Give the completed actions to the sink when the try is interrupted
+	interrupt := func() error {
+		if len(results) > 0 {
+			resultSink.StageTried(testIndex, stageIndex, tryNumber, results, ctx.Err())
+		}
+		return ctx.Err()
+	}
+
+	if !sleepContext(ctx, time.Duration(stage.DelayBefore)*time.Millisecond) {
+		return ctx.Err()
 	}
 
 	// Define err out of the loop so that it can be returned
@@ -66,50 +81,68 @@ func runStageOneTime(testIndex int, stageIndex int, stage definition.Stage) erro
 	// For each action of the stage
 	for actionIndex, action := range stage.Actions {
 
+		// Wait for the request to be allowed, out of the measured duration
+		if !waitForRequest(ctx, stageIndex, actionIndex) {
+			return interrupt()
+		}
+
+		resultSink.ActionStarted(testIndex, stageIndex, tryNumber, actionIndex)
+
 		startTime := time.Now()
 
 		// Execute the action
-		err = RunAction(testIndex, stageIndex, actionIndex, action, variables)
+		var result *ActionResult
+		result, err = RunAction(ctx, testIndex, stageIndex, actionIndex, action, variables)
 
-		// If no error
-		if err == nil {
+		// An action cancelled by the interruption of the run is not a failure of the action
+		if err != nil && ctx.Err() != nil {
+			return interrupt()
+		}
 
-			// Keep the result
-			results = append(results, &db.ActionEntry{
-				TestIndex:    testIndex,
-				StageIndex:   stageIndex,
-				ActionIndex:  actionIndex,
-				TimeNano:     startTime.Nanosecond(),
-				DurationNano: int(time.Since(startTime).Nanoseconds()),
-				Success:      true,
-			})
+		entry := &db.ActionEntry{
+			TestIndex:      testIndex,
+			StageIndex:     stageIndex,
+			TryNumber:      tryNumber,
+			ActionIndex:    actionIndex,
+			TimeNano:       int(startTime.UnixNano()),
+			DurationNano:   int(time.Since(startTime).Nanoseconds()),
+			Success:        err == nil,
+			StatusCode:     result.StatusCode,
+			ErrorCategory:  result.ErrorCategory,
+			HTTPTimings:    result.HTTPTimings,
+			FailureDetails: result.FailureDetails,
+		}
 
-		} else {
+		if err != nil {
+			entry.ErrorMessage = err.Error()
+		}
+
+		// Keep the result
+		results = append(results, entry)
+		resultSink.ActionFinished(entry)
 
-			// Keep the result
-			results = append(results, &db.ActionEntry{
-				TestIndex:    testIndex,
-				StageIndex:   stageIndex,
-				ActionIndex:  actionIndex,
-				TimeNano:     startTime.Nanosecond(),
-				DurationNano: 0,
-				Success:      false,
-			})
-
-			// Stop the loop
+		// Stop the loop
+		if err != nil {
 			break
 		}
-	}
 
-	// Even if an error was raised, wait as other tests may rely on the wait timing
-	if stage.DelayAfter > 0 {
-		time.Sleep(time.Duration(stage.DelayAfter) * time.Millisecond)
+		if !sleepContext(ctx, getThinkTime(action.ThinkTime)) {
+			return interrupt()
+		}
 	}
 
-	if saveErr := db.Insert(results); saveErr != nil {
-		log.Errorf("unable to save stage results due to %v", saveErr)
+	// Even if an error was raised, wait as other tests may rely on the wait timing. All the actions were executed, so
+	// the try is complete even if the wait is interrupted.
+	if !sleepContext(ctx, time.Duration(stage.DelayAfter)*time.Millisecond) {
+		resultSink.StageTried(testIndex, stageIndex, tryNumber, results, err)
+		if err != nil {
+			return err
+		}
+		return ctx.Err()
 	}
 
+	resultSink.StageTried(testIndex, stageIndex, tryNumber, results, err)
+
 	// Return the last error found while executing the actions
 	return err
 }
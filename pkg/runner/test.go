@@ -1,57 +1,270 @@
 package runner
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
 	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/sink"
 )
 
-var currentNumberOfRunningTests = 0
-var maximumNumberOfRunningTests = 0
+// The number of running tests are updated concurrently by the tests and read by the displays, so they are only
+// accessed atomically
+var currentNumberOfRunningTests int64
+var maximumNumberOfRunningTests int64
+
+// output is where the banner and the summary of a run are written
+var output io.Writer = os.Stdout
+
+// SetOutput sets where the banner and the summary of the next runs are written, for example a buffer while the full
+// screen dashboard is displayed. It must not be called while a test is running.
+//
+// Params:
+//  - writer: where the banner and the summary are written, os.Stdout by default
+func SetOutput(writer io.Writer) {
+	output = writer
+}
 
 // RunTest executes a Test.
 //
 // Params:
+//  - ctx: the context of the run. When the context is done, no new test is started, the running tests are
+//    interrupted and the function returns once they are stopped
 //  - test: the Test to execute
+//  - resultSink: the sink receiving the results. It is not closed by the function.
 //
 // Return an error if the action fail, nil otherwise
-func RunTest(test definition.Test) error {
+func RunTest(ctx context.Context, test definition.Test, resultSink sink.ResultSink) error {
+
+	fmt.Fprintf(output, "====================================================\n")
+	fmt.Fprintf(output, "=\n")
+	fmt.Fprintf(output, "=         Test: %s \n", test.TestName)
+	fmt.Fprintf(output, "=\n")
+	fmt.Fprintf(output, "====================================================\n")
+
+	atomic.StoreInt64(&currentNumberOfRunningTests, 0)
+	atomic.StoreInt64(&maximumNumberOfRunningTests, 0)
+	setUpLimiters(test)
+	setUpFailureDetails(test)
+
+	start := time.Now()
+
+	if test.Swarm.IsClosedModel() {
+		runVirtualUsers(ctx, test, resultSink)
+	} else {
+		runSwarm(ctx, test, resultSink)
+	}
 
-	fmt.Printf("====================================================\n")
-	fmt.Printf("=\n")
-	fmt.Printf("=         Test: %s \n", test.TestName)
-	fmt.Printf("=\n")
-	fmt.Printf("====================================================\n")
+	fmt.Fprintf(output, "All tests total duration: %v\n", time.Since(start))
+
+	return nil
+}
+
+// runSwarm starts the tests of an open model swarm following its schedule and waits for them to finish
+//
+// Params:
+//  - ctx: the context of the run
+//  - test: the Test to execute
+//  - resultSink: the sink receiving the results
+func runSwarm(ctx context.Context, test definition.Test, resultSink sink.ResultSink) {
 
 	var wg sync.WaitGroup
 
-	wg.Add(int(test.Swarm.NumberOfRuns))
+	// With a maximum concurrency, a test is only started if a slot is available
+	var slots chan struct{}
+	if test.Swarm.MaximumConcurrency > 0 {
+		slots = make(chan struct{}, test.Swarm.MaximumConcurrency)
+	}
+	nbSkipped := 0
+
+	swarmSchedule := newSchedule(test.Swarm)
+	scenarios := newScenarioPicker(test)
+	lags := newLagRecorder()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	start := time.Now()
+	currentPhase := -1
+	nbStarted := 0
+
+	for index := 0; ctx.Err() == nil; index++ {
 
-	intervalBetweenStart := uint(1000 / test.Swarm.CreationRate)
-	currentNumberOfRunningTests = 0
+		offset, phaseIndex, ok := swarmSchedule.next()
+		if !ok {
+			break
+		}
 
-	ticker := time.NewTicker(time.Duration(intervalBetweenStart) * time.Millisecond)
+		// At high rates, several tests may be due when the timer fires: they are started without waiting
+		scheduled := start.Add(offset)
+		if wait := time.Until(scheduled); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				continue
+			}
+		}
+
+		if phaseIndex != currentPhase && len(test.Swarm.Phases) > 0 {
+			currentPhase = phaseIndex
+			phase := swarmSchedule.phases[phaseIndex]
+			log.Infof("Swarm: starting phase %v, from %v to %v test(s)/s during %vs", phase.name, phase.fromRate, phase.toRate, phase.duration)
+		}
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				nbSkipped++
+				continue
+			}
+		}
+
+		nbStarted++
+		wg.Add(1)
+		go func(t definition.Test, i int, n string, s time.Time) {
+			defer wg.Done()
+			lags.record(s)
+			runSingleTest(ctx, t, i, n, resultSink)
+			if slots != nil {
+				<-slots
+			}
+		}(test, index, scenarios.next(), scheduled)
+	}
+
+	if ctx.Err() != nil {
+		log.Warnf("Swarm interrupted after starting %v test(s)", nbStarted)
+	}
+
+	wg.Wait()
+
+	lags.display()
+
+	if nbSkipped > 0 {
+		log.Warnf("Swarm: %v test(s) not started as %v tests were already running (max_concurrency)", nbSkipped, test.Swarm.MaximumConcurrency)
+	}
+}
+
+// runVirtualUsers starts the virtual users of a closed model swarm and waits for them to finish
+//
+// Params:
+//  - ctx: the context of the run
+//  - test: the Test to execute
+//  - resultSink: the sink receiving the results
+func runVirtualUsers(ctx context.Context, test definition.Test, resultSink sink.ResultSink) {
+
+	var wg sync.WaitGroup
+
+	// The test indexes are shared by all the users
+	nextTestIndex := int64(-1)
 
 	start := time.Now()
+	var end time.Time
+	if test.Swarm.Duration > 0 {
+		end = start.Add(test.Swarm.TotalDuration())
+	}
+
+	// Each user runs a single scenario
+	scenarios := newScenarioPicker(test)
 
-	for index := 0; index < int(test.Swarm.NumberOfRuns); index++ {
+	// The users are started at the creation rate, or all at once without creation rate
+	userSchedule := newSchedule(definition.Swarm{
+		NumberOfRuns: test.Swarm.VirtualUsers,
+		CreationRate: test.Swarm.CreationRate,
+	})
 
-		<-ticker.C
+	for user := 0; user < int(test.Swarm.VirtualUsers); user++ {
 
-		go func(t definition.Test, i int) {
+		if test.Swarm.CreationRate > 0 {
+			offset, _, _ := userSchedule.next()
+			if !sleepContext(ctx, time.Until(start.Add(offset))) {
+				log.Warnf("Swarm interrupted after starting %v virtual user(s)", user)
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func(u int, n string) {
 			defer wg.Done()
-			runSingleTest(t, i)
-		}(test, index)
+			runVirtualUser(ctx, test, u, n, end, &nextTestIndex, resultSink)
+		}(user, scenarios.next())
 	}
 
 	wg.Wait()
+}
 
-	fmt.Printf("All tests total duration: %v\n", time.Since(start))
+// runVirtualUser runs the test in a loop, as a single user would do
+//
+// Params:
+//  - ctx: the context of the run. When the context is done, the user stops
+//  - test: the Test to execute
+//  - user: the user number
+//  - scenarioName: the scenario run by the user, or an empty string if the test has no scenarios
+//  - end: the time after which no test is started, or the zero time if the user is only limited by its iterations
+//  - nextTestIndex: the last test index used by all the users, to be updated atomically
+//  - resultSink: the sink receiving the results
+func runVirtualUser(ctx context.Context, test definition.Test, user int, scenarioName string, end time.Time, nextTestIndex *int64, resultSink sink.ResultSink) {
 
-	return nil
+	pacing := time.Duration(test.Swarm.Pacing) * time.Millisecond
+	var iterationStart time.Time
+
+	for iteration := 0; test.Swarm.Iterations == 0 || iteration < int(test.Swarm.Iterations); iteration++ {
+
+		// Between two iterations, think then wait for the end of the pacing
+		if iteration > 0 {
+			if !sleepContext(ctx, getThinkTime(test.Swarm.ThinkTime)) {
+				return
+			}
+			if !sleepContext(ctx, time.Until(iterationStart.Add(pacing))) {
+				return
+			}
+		}
+
+		if ctx.Err() != nil || (!end.IsZero() && !time.Now().Before(end)) {
+			return
+		}
+
+		testIndex := int(atomic.AddInt64(nextTestIndex, 1))
+		if test.Swarm.NumberOfRuns > 0 && testIndex >= int(test.Swarm.NumberOfRuns) {
+			return
+		}
+
+		log.Infof("User %v: iteration %v", user, iteration)
+		iterationStart = time.Now()
+		runSingleTest(ctx, test, testIndex, scenarioName, resultSink)
+	}
+}
+
+// sleepContext waits for the given duration, unless the context is done
+//
+// Params:
+//  - ctx: the context
+//  - duration: the duration to wait
+//
+// Return true if the duration elapsed, false if the context is done
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // GetCurrentNumberOfRunningTests returns the current number of test running in parallel. Should be zero when
@@ -59,7 +272,7 @@ func RunTest(test definition.Test) error {
 //
 // Return the current number of test running in parallel
 func GetCurrentNumberOfRunningTests() int {
-	return currentNumberOfRunningTests
+	return int(atomic.LoadInt64(&currentNumberOfRunningTests))
 }
 
 // GetMaximumNumberOfRunningTests returns the maximum number of test running in parallel. It is the maximum of
@@ -67,22 +280,35 @@ func GetCurrentNumberOfRunningTests() int {
 //
 // Return the maximum number of test running in parallel
 func GetMaximumNumberOfRunningTests() int {
-	return maximumNumberOfRunningTests
+	return int(atomic.LoadInt64(&maximumNumberOfRunningTests))
 }
 
-func runSingleTest(test definition.Test, testIndex int) {
+func runSingleTest(ctx context.Context, test definition.Test, testIndex int, scenarioName string, resultSink sink.ResultSink) {
 
-	log.Infof("Test %v: starting ", testIndex)
+	log.Infof("Test %v: starting %s", testIndex, scenarioName)
 
-	currentNumberOfRunningTests++
-	if currentNumberOfRunningTests > maximumNumberOfRunningTests {
-		maximumNumberOfRunningTests = currentNumberOfRunningTests
+	current := atomic.AddInt64(&currentNumberOfRunningTests, 1)
+	for maximum := atomic.LoadInt64(&maximumNumberOfRunningTests); current > maximum; maximum = atomic.LoadInt64(&maximumNumberOfRunningTests) {
+		if atomic.CompareAndSwapInt64(&maximumNumberOfRunningTests, maximum, current) {
+			break
+		}
 	}
 
 	start := time.Now()
 
-	for stageIndex, stage := range test.Stages {
-		if err := RunStage(testIndex, stageIndex, stage); err != nil && !test.ContinueOnStageFailure {
+	entry := &db.TestEntry{
+		TestIndex:     testIndex,
+		StartTimeNano: int(start.UnixNano()),
+	}
+	resultSink.TestStarted(entry)
+
+	for _, stageIndex := range test.StageIndexes(scenarioName) {
+		err := RunStage(ctx, testIndex, stageIndex, test.Stages[stageIndex], resultSink)
+		if ctx.Err() != nil {
+			log.Infof("Test %v: interrupted", testIndex)
+			break
+		}
+		if err != nil && !test.ContinueOnStageFailure {
 			log.Infof("Test %v: ending prematurely due to error in stage", testIndex)
 			break
 		}
@@ -90,7 +316,14 @@ func runSingleTest(test definition.Test, testIndex int) {
 
 	elapsed := time.Since(start)
 
-	currentNumberOfRunningTests--
+	// Send a new entry, so that the one already given to the sink is never modified
+	resultSink.TestFinished(&db.TestEntry{
+		TestIndex:     testIndex,
+		StartTimeNano: entry.StartTimeNano,
+		EndTimeNano:   int(start.Add(elapsed).UnixNano()),
+	})
+
+	atomic.AddInt64(&currentNumberOfRunningTests, -1)
 
 	log.Infof("Test %v: total duration: %v", testIndex, elapsed)
 }
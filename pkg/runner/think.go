@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+// The random think times are drawn by all the tests concurrently, so the generator is protected by a mutex
+var thinkRandomMutex sync.Mutex
+var thinkRandom = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// getThinkTime draws a think time following its distribution
+//
+// Params:
+//  - thinkTime: the think time
+//
+// Return the duration to wait
+func getThinkTime(thinkTime definition.ThinkTime) time.Duration {
+
+	if thinkTime.IsZero() {
+		return 0
+	}
+
+	thinkRandomMutex.Lock()
+	var milliseconds float64
+	switch thinkTime.Distribution {
+	case definition.UniformDistribution:
+		milliseconds = float64(thinkTime.Minimum) + thinkRandom.Float64()*float64(thinkTime.Maximum-thinkTime.Minimum)
+	case definition.NormalDistribution:
+		milliseconds = float64(thinkTime.Duration) + thinkRandom.NormFloat64()*float64(thinkTime.StdDev)
+	case definition.ExponentialDistribution:
+		milliseconds = thinkRandom.ExpFloat64() * float64(thinkTime.Duration)
+	default:
+		milliseconds = float64(thinkTime.Duration)
+	}
+	thinkRandomMutex.Unlock()
+
+	milliseconds = math.Max(0, milliseconds)
+	if thinkTime.Maximum > 0 {
+		milliseconds = math.Min(float64(thinkTime.Maximum), milliseconds)
+	}
+
+	return time.Duration(milliseconds * float64(time.Millisecond))
+}
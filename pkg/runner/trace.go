@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+)
+
+// requestTracer keeps the time of the events occurring while executing an HTTP request. As some events may be
+// raised by the transport in other goroutines, the access to the events is protected by a mutex.
+type requestTracer struct {
+	mutex             sync.Mutex
+	dnsStart          time.Time
+	dnsDone           time.Time
+	connectStart      time.Time
+	connectDone       time.Time
+	tlsStart          time.Time
+	tlsDone           time.Time
+	wroteRequest      time.Time
+	firstResponseByte time.Time
+	bodyRead          time.Time
+	reused            bool
+}
+
+// setBodyRead records the time at which the body of the response was fully read
+func (tracer *requestTracer) setBodyRead() {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	tracer.bodyRead = time.Now()
+}
+
+// trace returns a copy of the request instrumented with the tracer
+func (tracer *requestTracer) trace(req *http.Request) *http.Request {
+
+	clientTrace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.dnsDone = time.Now()
+		},
+		ConnectStart: func(string, string) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			// With multiple addresses, only keep the first attempt
+			if tracer.connectStart.IsZero() {
+				tracer.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(string, string, error) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.connectDone = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.tlsDone = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.reused = info.Reused
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			tracer.mutex.Lock()
+			defer tracer.mutex.Unlock()
+			tracer.firstResponseByte = time.Now()
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace))
+}
+
+// timings returns the duration of each phase of the request. The phases that did not occur have a duration of 0.
+func (tracer *requestTracer) timings() db.HTTPTimings {
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	return db.HTTPTimings{
+		DNSNano:             phaseDuration(tracer.dnsStart, tracer.dnsDone),
+		ConnectNano:         phaseDuration(tracer.connectStart, tracer.connectDone),
+		TLSNano:             phaseDuration(tracer.tlsStart, tracer.tlsDone),
+		TimeToFirstByteNano: phaseDuration(tracer.wroteRequest, tracer.firstResponseByte),
+		TransferNano:        phaseDuration(tracer.firstResponseByte, tracer.bodyRead),
+		ConnectionReused:    tracer.reused,
+	}
+}
+
+func phaseDuration(start time.Time, end time.Time) int {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return int(end.Sub(start).Nanoseconds())
+}
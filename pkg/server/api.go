@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/twuillemin/gargote/pkg/export"
+	"github.com/twuillemin/gargote/pkg/loader"
+	"github.com/twuillemin/gargote/pkg/runner"
+)
+
+// maximumDefinitionSize is the maximum size of a definition sent to the API
+const maximumDefinitionSize = 1024 * 1024
+
+// apiRun is the state of a run returned by the API
+type apiRun struct {
+	RunInfo
+	ElapsedNano int64 `json:"elapsed_nano"`
+	// ActiveTests is the number of tests currently running, only given for the run in progress
+	ActiveTests *int `json:"active_tests,omitempty"`
+	// Results are the statistics of the run, live while the run is in progress
+	Results *export.Results `json:"results,omitempty"`
+}
+
+// apiError is the body of the responses in error
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (server *Server) addAPIRoutes(router *gin.Engine) {
+	router.POST("/runs", server.apiStart)
+	router.GET("/runs/:id", server.apiGet)
+	router.DELETE("/runs/:id", server.apiAbort)
+	router.GET("/runs/:id/report", server.apiReport)
+}
+
+// apiStart starts a run. The definition of the test is given in the body, in YAML or in JSON, or, if the body is
+// empty, by the name of a test file of the server in the query parameter "file". The query parameters
+// "number_of_runs" and "creation_rate" override the values of the definition.
+func (server *Server) apiStart(c *gin.Context) {
+
+	var overrides Overrides
+	if err := c.ShouldBindQuery(&overrides); err != nil {
+		c.JSON(http.StatusBadRequest, apiError{"the overrides are not valid: " + err.Error()})
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maximumDefinitionSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, apiError{"unable to read the definition: " + err.Error()})
+		return
+	}
+
+	var run *Run
+	if len(strings.TrimSpace(string(data))) == 0 {
+		if len(c.Query("file")) == 0 {
+			c.JSON(http.StatusBadRequest, apiError{"the body must contain the definition of the test, or the query parameter file must name a test file"})
+			return
+		}
+		run, err = server.StartFile(c.Query("file"), overrides)
+	} else {
+		run, err = server.startDefinition(data, overrides)
+	}
+
+	if err != nil {
+		c.JSON(statusOf(err), apiError{err.Error()})
+		return
+	}
+
+	info := run.Info()
+	c.Header("Location", "/runs/"+info.ID)
+	c.JSON(http.StatusCreated, apiRun{RunInfo: info})
+}
+
+func (server *Server) startDefinition(data []byte, overrides Overrides) (*Run, error) {
+
+	test, err := loader.LoadFromData(data)
+	if err != nil {
+		return nil, errors.New("the definition is not valid: " + err.Error())
+	}
+
+	if len(test.Stages) == 0 {
+		return nil, errors.New("the definition is not valid: the test has no stage")
+	}
+
+	return server.Start("", *test, overrides)
+}
+
+// apiGet returns the status and the statistics of a run. The statistics of the run in progress are computed from the
+// results received so far.
+func (server *Server) apiGet(c *gin.Context) {
+
+	id := c.Param("id")
+
+	run, err := server.Get(id)
+	if err != nil {
+
+		// The run may have been started by another process, or before the server was started
+		stored, storeErr := server.store.Load(id)
+		if storeErr != nil {
+			c.JSON(http.StatusNotFound, apiError{err.Error()})
+			return
+		}
+
+		status := StatusFinished
+		if len(stored.AbortReason) > 0 {
+			status = StatusAborted
+		}
+
+		endTime := time.Unix(0, stored.EndTimeNano)
+		c.JSON(http.StatusOK, apiRun{
+			RunInfo: RunInfo{
+				ID:          stored.ID,
+				FileName:    stored.FileName,
+				TestName:    stored.Results.TestName,
+				Status:      status,
+				AbortReason: stored.AbortReason,
+				StartTime:   time.Unix(0, stored.StartTimeNano),
+				EndTime:     &endTime,
+			},
+			ElapsedNano: stored.EndTimeNano - stored.StartTimeNano,
+			Results:     stored.Results,
+		})
+		return
+	}
+
+	info := run.Info()
+	response := apiRun{
+		RunInfo:     info,
+		ElapsedNano: info.elapsed().Nanoseconds(),
+	}
+
+	// The statistics are in the database only for the last run, the others are read from the store
+	if server.isCurrent(run) {
+
+		if info.Status == StatusRunning {
+			activeTests := runner.GetCurrentNumberOfRunningTests()
+			response.ActiveTests = &activeTests
+		}
+
+		report, _, err := run.liveStatistics()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, apiError{"unable to compute the statistics: " + err.Error()})
+			return
+		}
+
+		if response.Results, err = export.NewResults(report, false); err != nil {
+			c.JSON(http.StatusInternalServerError, apiError{"unable to compute the statistics: " + err.Error()})
+			return
+		}
+	} else if stored, err := server.store.Load(info.ID); err == nil {
+		response.Results = stored.Results
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// apiAbort stops a run in progress. The tests already started are interrupted and the results are stored.
+func (server *Server) apiAbort(c *gin.Context) {
+
+	run, err := server.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(statusOf(err), apiError{err.Error()})
+		return
+	}
+
+	if run.Info().Status != StatusRunning {
+		c.JSON(http.StatusConflict, apiError{"the run is not in progress"})
+		return
+	}
+
+	run.abort(userAbortReason)
+
+	c.JSON(http.StatusAccepted, apiRun{RunInfo: run.Info()})
+}
+
+// apiReport returns the report of a finished run: the HTML report if the client accepts HTML, otherwise the results
+// as JSON. The samples are added to the JSON results if the query parameter "samples" is true.
+func (server *Server) apiReport(c *gin.Context) {
+
+	id := c.Param("id")
+
+	if run, err := server.Get(id); err == nil {
+		if info := run.Info(); info.Status == StatusRunning {
+			c.JSON(http.StatusConflict, apiError{"the run is still in progress"})
+			return
+		} else if info.Status == StatusError {
+			c.JSON(http.StatusInternalServerError, apiError{"the run has no report: " + info.Error})
+			return
+		}
+	}
+
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		report, err := server.store.LoadReport(id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, apiError{"the report of the run '" + id + "' is not available"})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", report)
+		return
+	}
+
+	stored, err := server.store.Load(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, apiError{err.Error()})
+		return
+	}
+
+	if c.Query("samples") == "true" {
+		if stored.Results.Samples, err = server.store.LoadSamples(id); err != nil {
+			c.JSON(http.StatusInternalServerError, apiError{"unable to read the samples: " + err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, stored.Results)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/abort"
+	"github.com/twuillemin/gargote/pkg/dashboard"
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/export"
+	"github.com/twuillemin/gargote/pkg/runner"
+	"github.com/twuillemin/gargote/pkg/sink"
+	"github.com/twuillemin/gargote/pkg/statistics"
+	"github.com/twuillemin/gargote/pkg/store"
+	"github.com/twuillemin/gargote/pkg/threshold"
+)
+
+// Status is the status of a run started by the server
+type Status string
+
+const (
+	// StatusRunning is the status of a run in progress
+	StatusRunning Status = "running"
+	// StatusFinished is the status of a run that executed all its tests
+	StatusFinished Status = "finished"
+	// StatusAborted is the status of a run stopped before its end, by a user or by a threshold
+	StatusAborted Status = "aborted"
+	// StatusError is the status of a run whose results could not be computed or stored
+	StatusError Status = "error"
+)
+
+// Overrides are values replacing those of the definition of a test. The zero values keep those of the definition.
+type Overrides struct {
+	NumberOfRuns uint `json:"number_of_runs,omitempty" form:"number_of_runs"`
+	CreationRate uint `json:"creation_rate,omitempty" form:"creation_rate"`
+}
+
+// apply replaces the values of the test by the overrides
+func (overrides Overrides) apply(test *definition.Test) {
+	if overrides.NumberOfRuns > 0 {
+		test.Swarm.NumberOfRuns = overrides.NumberOfRuns
+	}
+	if overrides.CreationRate > 0 {
+		test.Swarm.CreationRate = overrides.CreationRate
+	}
+}
+
+// RunInfo describes a run started by the server
+type RunInfo struct {
+	ID          string     `json:"id"`
+	FileName    string     `json:"file_name,omitempty"`
+	TestName    string     `json:"test_name"`
+	Status      Status     `json:"status"`
+	Passed      bool       `json:"passed"`
+	AbortReason string     `json:"abort_reason,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartTime   time.Time  `json:"start_time"`
+	EndTime     *time.Time `json:"end_time,omitempty"`
+}
+
+// elapsed returns the duration of the run, up to now if the run is not finished
+func (info RunInfo) elapsed() time.Duration {
+	if info.EndTime == nil {
+		return time.Since(info.StartTime)
+	}
+	return info.EndTime.Sub(info.StartTime)
+}
+
+// Run is a run started by the server. Its information is updated by the goroutine executing it and read by the
+// handlers, so it is only accessed through its functions.
+type Run struct {
+	mutex    sync.Mutex
+	info     RunInfo
+	test     definition.Test
+	progress *dashboard.Dashboard
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Info returns a copy of the information of the run
+//
+// Return the information
+func (run *Run) Info() RunInfo {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return run.info
+}
+
+// Test returns the definition of the test executed, with the overrides applied
+//
+// Return the definition
+func (run *Run) Test() definition.Test {
+	return run.test
+}
+
+// Progress returns the lines describing the progress of the run
+//
+// Return the lines
+func (run *Run) Progress() []string {
+	return run.progress.Lines()
+}
+
+// Done returns a channel closed once the run is finished and its results are stored
+//
+// Return the channel
+func (run *Run) Done() <-chan struct{} {
+	return run.done
+}
+
+// abort stops the creation of new tests. The tests already started are interrupted.
+func (run *Run) abort(reason string) {
+
+	run.mutex.Lock()
+	if len(run.info.AbortReason) == 0 && run.info.Status == StatusRunning {
+		run.info.AbortReason = reason
+	}
+	run.mutex.Unlock()
+
+	run.cancel()
+}
+
+func (run *Run) finish(status Status, passed bool, err error) {
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	run.info.Status = status
+	run.info.Passed = passed
+	endTime := time.Now()
+	run.info.EndTime = &endTime
+	if err != nil {
+		run.info.Error = err.Error()
+	}
+}
+
+// execute runs the test, then computes and stores its results. It is called in its own goroutine, once the database
+// is created.
+func (run *Run) execute(ctx context.Context, runStore *store.Store) {
+
+	defer close(run.done)
+
+	thresholds, err := threshold.ParseAll(run.test)
+	if err != nil {
+		run.finish(StatusError, false, err)
+		return
+	}
+
+	// Abort the run as soon as a threshold can not be respected anymore, when it runs for too long or when an abort
+	// condition is met
+	thresholdMonitor := threshold.NewMonitor(thresholds, run.test)
+	go thresholdMonitor.Watch(ctx, func(breach threshold.Result) {
+		run.abort("threshold irrecoverably breached: " + breach.String())
+	})
+
+	monitor := abort.NewMonitor(run.test)
+	go monitor.Watch(ctx, run.abort)
+
+	resultSink := sink.NewMulti(sink.NewMemDB(), thresholdMonitor, monitor, run.progress)
+
+	start := time.Now()
+	err = runner.RunTest(ctx, run.test, resultSink)
+	elapsed := time.Since(start)
+	if closeErr := resultSink.Close(); closeErr != nil {
+		log.Warnf("unable to close the results destinations due to %v", closeErr)
+	}
+	run.cancel()
+
+	if err != nil {
+		run.finish(StatusError, false, err)
+		return
+	}
+
+	report, err := statistics.Compute(run.test, elapsed)
+	if err != nil {
+		run.finish(StatusError, false, err)
+		return
+	}
+
+	thresholdResults := threshold.Evaluate(thresholds, report)
+
+	info := run.Info()
+	passed := len(info.AbortReason) == 0
+	for _, result := range thresholdResults {
+		passed = passed && result.Passed
+	}
+
+	status := StatusFinished
+	if len(info.AbortReason) > 0 {
+		status = StatusAborted
+	}
+
+	if err := storeRun(runStore, info, run.test, report, thresholdResults, start, elapsed); err != nil {
+		run.finish(StatusError, false, err)
+		return
+	}
+
+	run.finish(status, passed, nil)
+}
+
+// storeRun stores the results and the HTML report of a run
+func storeRun(runStore *store.Store, info RunInfo, test definition.Test, report *statistics.Report, thresholdResults []threshold.Result, start time.Time, elapsed time.Duration) error {
+
+	results, err := export.NewResults(report, true)
+	if err != nil {
+		return err
+	}
+
+	if _, err = runStore.Save(&store.Run{
+		ID:             info.ID,
+		FileName:       info.FileName,
+		DefinitionHash: store.HashDefinition(test),
+		StartTimeNano:  start.UnixNano(),
+		EndTimeNano:    start.Add(elapsed).UnixNano(),
+		Definition:     test,
+		Results:        results,
+		AbortReason:    info.AbortReason,
+	}); err != nil {
+		return err
+	}
+
+	html, err := export.ToHTML(test, report, thresholdResults)
+	if err != nil {
+		return err
+	}
+
+	return runStore.SaveReport(info.ID, html)
+}
+
+// liveStatistics computes the statistics of the results received so far
+func (run *Run) liveStatistics() (*statistics.Report, []*db.TimeBucket, error) {
+
+	report, err := statistics.Compute(run.test, run.Info().elapsed())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buckets, err := db.GetTimeSeries(1 * time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return report, buckets, nil
+}
+
+func (run *Run) progressText() string {
+	return strings.Join(run.Progress(), "\n")
+}
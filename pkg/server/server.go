@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/twuillemin/gargote/pkg/dashboard"
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/loader"
+	"github.com/twuillemin/gargote/pkg/store"
+)
+
+// ErrBusy is returned when a run is started while another one is in progress. As the results are kept in a single
+// in-memory database, the runs are executed one at a time.
+var ErrBusy = errors.New("a run is already in progress")
+
+// userAbortReason is the reason given to the runs aborted through the UI or the API
+const userAbortReason = "aborted by the user"
+
+// NotFoundError is returned when a run or a test file does not exist
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (err *NotFoundError) Error() string {
+	return fmt.Sprintf("the %s '%s' does not exist", err.Kind, err.Name)
+}
+
+// Server starts runs and gives access to their progress and to the stored runs
+type Server struct {
+	mutex     sync.Mutex
+	directory string
+	store     *store.Store
+	runs      map[string]*Run
+	current   *Run
+	// csrfToken is given to the forms of the UI and checked when they are posted, so that another site can not make
+	// the browser of a user start or abort a run
+	csrfToken string
+	// token is required by all the routes if not empty
+	token string
+}
+
+// New creates a new Server
+//
+// Params:
+//  - directory: the directory of the test files that can be started
+//  - runStore: the store where the runs are kept
+//  - token: the token required to access the server, as a bearer token or as the password of the basic authentication,
+//    or an empty string to let anyone reaching the server use it
+//
+// Return the new Server or an error if its CSRF token can not be generated
+func New(directory string, runStore *store.Store, token string) (*Server, error) {
+
+	csrfToken := make([]byte, 32)
+	if _, err := rand.Read(csrfToken); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		directory: directory,
+		store:     runStore,
+		runs:      make(map[string]*Run),
+		csrfToken: hex.EncodeToString(csrfToken),
+		token:     token,
+	}, nil
+}
+
+// Router returns the HTTP handler of the server
+//
+// Return the handler
+func (server *Server) Router() *gin.Engine {
+
+	router := gin.Default()
+	if len(server.token) > 0 {
+		router.Use(server.checkToken)
+	}
+	server.addUIRoutes(router)
+	server.addAPIRoutes(router)
+
+	return router
+}
+
+// checkToken rejects the requests without the token of the server. The API clients give it as a bearer token, while
+// the browsers give it as the password of the basic authentication, the user name being ignored.
+func (server *Server) checkToken(c *gin.Context) {
+
+	token := ""
+	if authorization := c.GetHeader("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	} else if _, password, ok := c.Request.BasicAuth(); ok {
+		token = password
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1 {
+		c.Header("WWW-Authenticate", `Basic realm="Gargote"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, apiError{"the token is missing or not valid"})
+		return
+	}
+
+	c.Next()
+}
+
+// TestFiles returns the test files (.yaml or .yml) of the directory of the server and of its sub-directories, the
+// hidden directories excepted
+//
+// Return the names of the files, relative to the directory, or an error if the directory can not be read
+func (server *Server) TestFiles() ([]string, error) {
+
+	files := make([]string, 0)
+
+	err := filepath.Walk(server.directory, func(path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != server.directory && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		extension := strings.ToLower(filepath.Ext(path))
+		if extension == ".yaml" || extension == ".yml" {
+			relative, err := filepath.Rel(server.directory, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relative))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// StartFile loads a test file of the directory of the server and starts it
+//
+// Params:
+//  - fileName: the name of the file, as returned by TestFiles
+//  - overrides: the values replacing those of the file
+//
+// Return the new run, or an error if the file can not be loaded or if a run is already in progress
+func (server *Server) StartFile(fileName string, overrides Overrides) (*Run, error) {
+
+	// Only the listed files can be started, so that no file outside of the directory can be read
+	files, err := server.TestFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, file := range files {
+		found = found || file == fileName
+	}
+	if !found {
+		return nil, &NotFoundError{Kind: "test file", Name: fileName}
+	}
+
+	test, err := loader.LoadFromFile(filepath.Join(server.directory, filepath.FromSlash(fileName)))
+	if err != nil {
+		return nil, err
+	}
+
+	return server.Start(fileName, *test, overrides)
+}
+
+// Start starts a run of a test. The run is executed in background.
+//
+// Params:
+//  - fileName: the name of the file of the test, if any
+//  - test: the test to run
+//  - overrides: the values replacing those of the test
+//
+// Return the new run, or ErrBusy if a run is already in progress
+func (server *Server) Start(fileName string, test definition.Test, overrides Overrides) (*Run, error) {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.current != nil && server.current.Info().Status == StatusRunning {
+		return nil, ErrBusy
+	}
+
+	overrides.apply(&test)
+
+	// The database is shared by all the runs, so it is only recreated once the previous run is finished
+	if err := db.CreateDatabase(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Two runs started in the same second would have the same ID until the first one is stored
+	id := server.store.NewID(start)
+	for i := 2; server.runs[id] != nil; i++ {
+		id = fmt.Sprintf("%s-%d", server.store.NewID(start), i)
+	}
+
+	run := &Run{
+		info: RunInfo{
+			ID:        id,
+			FileName:  fileName,
+			TestName:  test.TestName,
+			Status:    StatusRunning,
+			StartTime: start,
+		},
+		test:     test,
+		progress: dashboard.New(test),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	server.runs[run.info.ID] = run
+	server.current = run
+
+	go run.execute(ctx, server.store)
+
+	return run, nil
+}
+
+// Abort stops a run in progress. The tests already started are interrupted and the results are stored.
+//
+// Params:
+//  - id: the ID of the run
+//
+// Return the run, or a NotFoundError if the run was not started by this server
+func (server *Server) Abort(id string) (*Run, error) {
+
+	run, err := server.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	run.abort(userAbortReason)
+
+	return run, nil
+}
+
+// Get returns a run started by this server
+//
+// Params:
+//  - id: the ID of the run
+//
+// Return the run, or a NotFoundError if the run was not started by this server
+func (server *Server) Get(id string) (*Run, error) {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	run, ok := server.runs[id]
+	if !ok {
+		return nil, &NotFoundError{Kind: "run", Name: id}
+	}
+
+	return run, nil
+}
+
+// Current returns the last run started, nil if none was started
+//
+// Return the run
+func (server *Server) Current() *Run {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.current
+}
+
+// isCurrent returns true if the run is the last one started, in which case its results are in the database
+func (server *Server) isCurrent(run *Run) bool {
+	return server.Current() == run
+}
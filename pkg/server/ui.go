@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/export"
+	"github.com/twuillemin/gargote/pkg/statistics"
+	"github.com/twuillemin/gargote/pkg/store"
+)
+
+// uiRefreshSeconds is the delay between two refreshes of the page of a run in progress
+const uiRefreshSeconds = 2
+
+// uiIndex is the data of the index page
+type uiIndex struct {
+	Files      []string
+	Current    *RunInfo
+	StoredRuns []*store.Run
+	CSRFToken  string
+	Error      string
+}
+
+// uiRun is the data of the page of a run
+type uiRun struct {
+	Info            RunInfo
+	Refresh         bool
+	Progress        string
+	Report          *statistics.Report
+	LatencyChart    template.HTML
+	ThroughputChart template.HTML
+	ActiveChart     template.HTML
+	CSRFToken       string
+	Error           string
+}
+
+func (server *Server) addUIRoutes(router *gin.Engine) {
+
+	router.SetHTMLTemplate(uiTemplates)
+
+	router.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+
+	ui := router.Group("/ui")
+	ui.GET("/", server.uiIndex)
+	ui.POST("/start", server.checkCSRFToken, server.uiStart)
+	ui.GET("/runs/:id", server.uiRun)
+	ui.POST("/runs/:id/abort", server.checkCSRFToken, server.uiAbort)
+	ui.GET("/runs/:id/report", server.uiReport)
+}
+
+func (server *Server) uiIndex(c *gin.Context) {
+	server.renderIndex(c, http.StatusOK, "")
+}
+
+func (server *Server) renderIndex(c *gin.Context, code int, message string) {
+
+	data := uiIndex{
+		CSRFToken: server.csrfToken,
+		Error:     message,
+	}
+
+	var err error
+	if data.Files, err = server.TestFiles(); err != nil {
+		log.Errorf("unable to list the test files due to %v", err)
+		data.Error = fmt.Sprintf("unable to list the test files: %v", err)
+	}
+
+	if current := server.Current(); current != nil {
+		info := current.Info()
+		data.Current = &info
+	}
+
+	if data.StoredRuns, err = server.store.List(); err != nil {
+		log.Errorf("unable to list the stored runs due to %v", err)
+		data.Error = fmt.Sprintf("unable to list the stored runs: %v", err)
+	}
+
+	// The most recent runs first
+	for i, j := 0, len(data.StoredRuns)-1; i < j; i, j = i+1, j-1 {
+		data.StoredRuns[i], data.StoredRuns[j] = data.StoredRuns[j], data.StoredRuns[i]
+	}
+
+	c.HTML(code, "index", data)
+}
+
+func (server *Server) uiStart(c *gin.Context) {
+
+	var overrides Overrides
+	if err := c.ShouldBind(&overrides); err != nil {
+		server.renderIndex(c, http.StatusBadRequest, fmt.Sprintf("the overrides are not valid: %v", err))
+		return
+	}
+
+	run, err := server.StartFile(c.PostForm("file"), overrides)
+	if err != nil {
+		server.renderIndex(c, statusOf(err), fmt.Sprintf("unable to start the run: %v", err))
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/ui/runs/"+run.Info().ID)
+}
+
+func (server *Server) uiRun(c *gin.Context) {
+
+	run, err := server.Get(c.Param("id"))
+	if err != nil {
+		// The runs not started by this server are only available as reports
+		c.Redirect(http.StatusFound, "/ui/runs/"+c.Param("id")+"/report")
+		return
+	}
+
+	data := uiRun{
+		Info:      run.Info(),
+		Progress:  run.progressText(),
+		CSRFToken: server.csrfToken,
+	}
+	data.Refresh = data.Info.Status == StatusRunning
+
+	// The statistics are in the database only for the last run
+	if server.isCurrent(run) {
+		report, buckets, err := run.liveStatistics()
+		if err != nil {
+			data.Error = fmt.Sprintf("unable to compute the statistics: %v", err)
+		} else {
+			data.Report = report
+			data.LatencyChart, data.ThroughputChart, data.ActiveChart = export.BuildCharts(buckets)
+		}
+	}
+
+	c.HTML(http.StatusOK, "run", data)
+}
+
+func (server *Server) uiAbort(c *gin.Context) {
+
+	if _, err := server.Abort(c.Param("id")); err != nil {
+		c.String(statusOf(err), err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/ui/runs/"+c.Param("id"))
+}
+
+// checkCSRFToken rejects the forms posted without the token given by the pages of the server
+func (server *Server) checkCSRFToken(c *gin.Context) {
+
+	if subtle.ConstantTimeCompare([]byte(c.PostForm("csrf_token")), []byte(server.csrfToken)) != 1 {
+		c.String(http.StatusForbidden, "the form is not valid, reload the page and try again")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+func (server *Server) uiReport(c *gin.Context) {
+
+	report, err := server.store.LoadReport(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusNotFound, "the report of the run '%s' is not available", c.Param("id"))
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", report)
+}
+
+// statusOf returns the HTTP status corresponding to an error
+func statusOf(err error) int {
+
+	switch err.(type) {
+	case *NotFoundError:
+		return http.StatusNotFound
+	}
+
+	if err == ErrBusy {
+		return http.StatusConflict
+	}
+
+	return http.StatusBadRequest
+}
+
+var uiFunctions = template.FuncMap{
+	"ms": func(duration time.Duration) string {
+		return fmt.Sprintf("%.2f", float64(duration.Nanoseconds())/float64(time.Millisecond))
+	},
+	"nanoms": func(durationNano int64) string {
+		return fmt.Sprintf("%.2f", float64(durationNano)/float64(time.Millisecond))
+	},
+	"percent": func(value float64) string {
+		return fmt.Sprintf("%.2f%%", value*100)
+	},
+	"float": func(value float64) string {
+		return fmt.Sprintf("%.2f", value)
+	},
+	"time": func(value time.Time) string {
+		return value.Format("2006-01-02 15:04:05")
+	},
+	"nanotime": func(valueNano int64) string {
+		return time.Unix(0, valueNano).Format("2006-01-02 15:04:05")
+	},
+	"duration": func(startNano int64, endNano int64) time.Duration {
+		return time.Duration(endNano - startNano).Round(time.Millisecond)
+	},
+	"running": func(status Status) bool {
+		return status == StatusRunning
+	},
+}
+
+var uiTemplates = template.Must(template.New("ui").Funcs(uiFunctions).Parse(`
+{{ define "header" }}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+{{ if . }}<meta http-equiv="refresh" content="` + fmt.Sprint(uiRefreshSeconds) + `">{{ end }}
+<title>Gargote</title>
+<style>
+  body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+  a { color: #2b8cbe; }
+  table { border-collapse: collapse; margin-bottom: 2em; width: 100%; }
+  th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; font-size: 0.9em; }
+  th { background: #f4f4f4; }
+  td.label, th.label { text-align: left; }
+  input[type=number] { width: 6em; }
+  .error { background: #fdecea; border: 1px solid #c0392b; padding: 0.5em; margin-bottom: 1em; }
+  .passed { color: #27ae60; font-weight: bold; }
+  .failed { color: #c0392b; font-weight: bold; }
+  .running { color: #2b8cbe; font-weight: bold; }
+  .chart { width: 100%; max-width: 800px; display: block; margin-bottom: 1em; }
+  .chart-title { font-weight: bold; font-size: 14px; }
+  .chart-axis { font-size: 11px; fill: #555; }
+  .chart-grid { stroke: #eee; }
+  pre { background: #f8f8f8; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1><a href="/ui/">Gargote</a></h1>
+{{ end }}
+
+{{ define "status" }}{{ if running .Status }}<span class="running">running</span>{{ else if .Passed }}<span class="passed">{{ .Status }}</span>{{ else }}<span class="failed">{{ .Status }}</span>{{ end }}{{ end }}
+
+{{ define "index" }}{{ template "header" false }}{{ $csrfToken := .CSRFToken }}
+{{ with .Error }}<div class="error">{{ . }}</div>{{ end }}
+
+{{ with .Current }}
+<h2>Last run</h2>
+<p><a href="/ui/runs/{{ .ID }}">{{ .TestName }} ({{ .ID }})</a> - {{ template "status" . }}</p>
+{{ end }}
+
+<h2>Start a run</h2>
+{{ if .Files }}
+<table>
+  <tr><th class="label">Test file</th><th class="label">Overrides (empty to keep the values of the file)</th></tr>
+  {{ range .Files }}
+  <tr>
+    <td class="label">{{ . }}</td>
+    <td class="label">
+      <form method="post" action="/ui/start">
+        <input type="hidden" name="file" value="{{ . }}">
+        <input type="hidden" name="csrf_token" value="{{ $csrfToken }}">
+        number of runs <input type="number" name="number_of_runs" min="0">
+        creation rate (/s) <input type="number" name="creation_rate" min="0">
+        <button type="submit">Start</button>
+      </form>
+    </td>
+  </tr>
+  {{ end }}
+</table>
+{{ else }}
+<p>No test file (.yaml or .yml) found.</p>
+{{ end }}
+
+<h2>Past runs</h2>
+{{ if .StoredRuns }}
+<table>
+  <tr>
+    <th class="label">Run</th><th class="label">Test</th><th class="label">File</th><th class="label">Start</th><th>Duration</th>
+    <th>Test runs</th><th>Failed</th><th>Action error rate</th><th>Action p95 (ms)</th>
+  </tr>
+  {{ range .StoredRuns }}
+  <tr>
+    <td class="label"><a href="/ui/runs/{{ .ID }}/report">{{ .ID }}</a></td><td class="label">{{ .Results.TestName }}</td>
+    <td class="label">{{ .FileName }}</td><td class="label">{{ nanotime .StartTimeNano }}</td><td>{{ duration .StartTimeNano .EndTimeNano }}</td>
+    <td>{{ .Results.Test.NbSuccess }}</td><td>{{ .Results.Test.NbFailure }}</td>
+    <td>{{ percent .Results.AllActions.ErrorRate }}</td><td>{{ nanoms .Results.AllActions.P95Nano }}</td>
+  </tr>
+  {{ end }}
+</table>
+{{ else }}
+<p>No run stored yet.</p>
+{{ end }}
+</body>
+</html>
+{{ end }}
+
+{{ define "run" }}{{ template "header" .Refresh }}{{ $csrfToken := .CSRFToken }}
+{{ with .Error }}<div class="error">{{ . }}</div>{{ end }}
+{{ with .Info }}
+<h2>{{ .TestName }} - {{ template "status" . }}</h2>
+<p>
+  Run {{ .ID }}{{ with .FileName }}, file {{ . }}{{ end }}, started {{ time .StartTime }}{{ with .EndTime }}, finished {{ time . }}{{ end }}
+  {{ with .AbortReason }}<br><span class="failed">{{ . }}</span>{{ end }}
+  {{ with .Error }}<br><span class="failed">Error: {{ . }}</span>{{ end }}
+</p>
+{{ if running .Status }}
+<form method="post" action="/ui/runs/{{ .ID }}/abort"><input type="hidden" name="csrf_token" value="{{ $csrfToken }}"><button type="submit">Abort</button></form>
+{{ else if not .Error }}
+<p><a href="/ui/runs/{{ .ID }}/report">Full report</a></p>
+{{ end }}
+{{ end }}
+
+<h2>Progress</h2>
+<pre>{{ .Progress }}</pre>
+
+{{ with .Report }}
+<h2>Actions</h2>
+<table>
+  <tr>
+    <th class="label">Stage</th><th class="label">Action</th><th>Success</th><th>Failure</th><th>Error rate</th><th>Throughput (/s)</th>
+    <th>Mean (ms)</th><th>p50 (ms)</th><th>p95 (ms)</th><th>p99 (ms)</th><th>Max (ms)</th>
+  </tr>
+  {{ range $stage := .Stages }}{{ range .Actions }}
+  <tr>
+    <td class="label">{{ $stage.FullName }}</td><td class="label" title="{{ .URL }}">{{ .Name }}</td>
+    <td>{{ .NbSuccess }}</td><td>{{ .NbFailure }}</td><td>{{ percent .ErrorRate }}</td><td>{{ float .Throughput }}</td>
+    <td>{{ ms .Mean }}</td><td>{{ ms .P50 }}</td><td>{{ ms .P95 }}</td><td>{{ ms .P99 }}</td><td>{{ ms .Max }}</td>
+  </tr>
+  {{ end }}{{ end }}
+</table>
+{{ end }}
+
+{{ if .Report }}
+<h2>Evolution</h2>
+{{ .LatencyChart }}
+{{ .ThroughputChart }}
+{{ .ActiveChart }}
+{{ end }}
+</body>
+</html>
+{{ end }}
+`))
@@ -0,0 +1,95 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+// Console is a ResultSink writing a line for each finished action and each finished test run
+type Console struct {
+	Base
+	mutex  sync.Mutex
+	test   definition.Test
+	writer io.Writer
+}
+
+// NewConsole creates a new Console sink
+//
+// Params:
+//  - test: the Test that will be run
+//  - writer: where the lines are written, usually os.Stdout
+//
+// Return the new Console sink
+func NewConsole(test definition.Test, writer io.Writer) *Console {
+	return &Console{
+		test:   test,
+		writer: writer,
+	}
+}
+
+// ActionFinished writes the result of an action
+func (console *Console) ActionFinished(entry *db.ActionEntry) {
+
+	result := "success"
+	if !entry.Success {
+		result = fmt.Sprintf("failure (%s: %s)", entry.ErrorCategory.ToString(), entry.ErrorMessage)
+	}
+
+	stageName, actionName := GetNames(console.test, entry)
+
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	fmt.Fprintf(
+		console.writer,
+		"Action %v-%v-%v-%v %s / %s: %v in %v, status code: %v\n",
+		entry.TestIndex,
+		entry.StageIndex,
+		entry.TryNumber,
+		entry.ActionIndex,
+		stageName,
+		actionName,
+		result,
+		time.Duration(entry.DurationNano),
+		entry.StatusCode)
+}
+
+// TestFinished writes the duration of a test run
+func (console *Console) TestFinished(entry *db.TestEntry) {
+
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	fmt.Fprintf(
+		console.writer,
+		"Test %v: finished in %v\n",
+		entry.TestIndex,
+		time.Duration(entry.EndTimeNano-entry.StartTimeNano))
+}
+
+// GetNames returns the name of the stage and of the action of an entry
+//
+// Params:
+//  - test: the Test that is run
+//  - entry: the entry of the action
+//
+// Return the name of the stage, prefixed by its scenario if any, and the name of the action, empty if they are not
+// in the test
+func GetNames(test definition.Test, entry *db.ActionEntry) (string, string) {
+
+	if entry.StageIndex >= len(test.Stages) {
+		return "", ""
+	}
+
+	stage := test.Stages[entry.StageIndex]
+	if entry.ActionIndex >= len(stage.Actions) {
+		return stage.FullName(), ""
+	}
+
+	return stage.FullName(), stage.Actions[entry.ActionIndex].Name
+}
@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
+)
+
+// File is a ResultSink writing each finished action to a file, as a line of JSON (JSON Lines format), so that the
+// samples are available even if the test is interrupted. Once the file can not be written, for example because the
+// disk is full, the next results are ignored and the error is returned by Close.
+type File struct {
+	Base
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	err    error
+}
+
+// NewFile creates a new File sink. The file is created or truncated.
+//
+// Params:
+//  - fileName: the name of the file
+//
+// Return the new File sink or an error if the file can not be created
+func NewFile(fileName string) (*File, error) {
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+// ActionFinished writes the result of an action
+func (sink *File) ActionFinished(entry *db.ActionEntry) {
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("unable to convert the result to JSON due to %v", err)
+		return
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.err != nil {
+		return
+	}
+
+	if _, err := sink.writer.Write(data); err != nil {
+		sink.err = err
+	} else if err := sink.writer.WriteByte('\n'); err != nil {
+		sink.err = err
+	}
+
+	if sink.err != nil {
+		log.Errorf("unable to write the results to %v due to %v, the next results will not be written", sink.file.Name(), sink.err)
+	}
+}
+
+// Close writes the remaining results and closes the file
+//
+// Return the first error met while writing the file, if any
+func (sink *File) Close() error {
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.err == nil {
+		sink.err = sink.writer.Flush()
+	}
+
+	if err := sink.file.Close(); sink.err == nil {
+		sink.err = err
+	}
+
+	return sink.err
+}
@@ -0,0 +1,40 @@
+package sink
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/twuillemin/gargote/pkg/db"
+)
+
+// MemDB is a ResultSink storing the results in the in-memory database (pkg/db), from which the statistics and the
+// reports are computed. The database must be created before the test is run.
+type MemDB struct {
+	Base
+}
+
+// NewMemDB creates a new MemDB sink
+//
+// Return the new MemDB sink
+func NewMemDB() *MemDB {
+	return &MemDB{}
+}
+
+// TestStarted stores the start of a test run
+func (*MemDB) TestStarted(entry *db.TestEntry) {
+	if err := db.InsertTest(entry); err != nil {
+		log.Errorf("unable to save test start due to %v", err)
+	}
+}
+
+// StageTried stores all the actions of the stage try at once
+func (*MemDB) StageTried(_ int, _ int, _ int, entries []*db.ActionEntry, _ error) {
+	if err := db.Insert(entries); err != nil {
+		log.Errorf("unable to save stage results due to %v", err)
+	}
+}
+
+// TestFinished stores the end of a test run. The entry replaces the one stored at the start.
+func (*MemDB) TestFinished(entry *db.TestEntry) {
+	if err := db.InsertTest(entry); err != nil {
+		log.Errorf("unable to save test end due to %v", err)
+	}
+}
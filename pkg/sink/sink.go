@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"github.com/twuillemin/gargote/pkg/db"
+)
+
+// ResultSink receives the results of a Test while it is running. The functions are called concurrently by the running
+// tests, so they must be safe for concurrent use. The entries must not be modified.
+type ResultSink interface {
+
+	// TestStarted is called when a run of the test starts. The entry has no end time.
+	TestStarted(entry *db.TestEntry)
+
+	// ActionStarted is called when an action is about to be executed
+	ActionStarted(testIndex int, stageIndex int, tryNumber int, actionIndex int)
+
+	// ActionFinished is called when an action is finished, successfully or not
+	ActionFinished(entry *db.ActionEntry)
+
+	// StageTried is called at the end of each try of a stage, with the entries of all the actions executed during the
+	// try. The error is the one that made the try fail, nil if the try is successful. If the run is interrupted during
+	// the try, the entries are those of the actions completed before and the error is the one of the context.
+	StageTried(testIndex int, stageIndex int, tryNumber int, entries []*db.ActionEntry, err error)
+
+	// TestFinished is called when a run of the test is finished
+	TestFinished(entry *db.TestEntry)
+
+	// Close is called once all the runs of the test are finished. The sink must send or write its remaining results.
+	Close() error
+}
+
+// Base is a ResultSink ignoring all the results. It can be embedded by the sinks only interested in some of them.
+type Base struct{}
+
+// TestStarted does nothing
+func (Base) TestStarted(*db.TestEntry) {}
+
+// ActionStarted does nothing
+func (Base) ActionStarted(int, int, int, int) {}
+
+// ActionFinished does nothing
+func (Base) ActionFinished(*db.ActionEntry) {}
+
+// StageTried does nothing
+func (Base) StageTried(int, int, int, []*db.ActionEntry, error) {}
+
+// TestFinished does nothing
+func (Base) TestFinished(*db.TestEntry) {}
+
+// Close does nothing
+func (Base) Close() error { return nil }
+
+// Multi is a ResultSink sending the results to several sinks, in the order they were given
+type Multi struct {
+	sinks []ResultSink
+}
+
+// NewMulti creates a new Multi sink
+//
+// Params:
+//  - sinks: the sinks receiving the results
+//
+// Return the new Multi sink
+func NewMulti(sinks ...ResultSink) *Multi {
+	return &Multi{
+		sinks: sinks,
+	}
+}
+
+// TestStarted sends the start of a test run to all the sinks
+func (multi *Multi) TestStarted(entry *db.TestEntry) {
+	for _, sink := range multi.sinks {
+		sink.TestStarted(entry)
+	}
+}
+
+// ActionStarted sends the start of an action to all the sinks
+func (multi *Multi) ActionStarted(testIndex int, stageIndex int, tryNumber int, actionIndex int) {
+	for _, sink := range multi.sinks {
+		sink.ActionStarted(testIndex, stageIndex, tryNumber, actionIndex)
+	}
+}
+
+// ActionFinished sends the result of an action to all the sinks
+func (multi *Multi) ActionFinished(entry *db.ActionEntry) {
+	for _, sink := range multi.sinks {
+		sink.ActionFinished(entry)
+	}
+}
+
+// StageTried sends the result of a stage try to all the sinks
+func (multi *Multi) StageTried(testIndex int, stageIndex int, tryNumber int, entries []*db.ActionEntry, err error) {
+	for _, sink := range multi.sinks {
+		sink.StageTried(testIndex, stageIndex, tryNumber, entries, err)
+	}
+}
+
+// TestFinished sends the end of a test run to all the sinks
+func (multi *Multi) TestFinished(entry *db.TestEntry) {
+	for _, sink := range multi.sinks {
+		sink.TestFinished(entry)
+	}
+}
+
+// Close closes all the sinks, even if some of them fail to close
+//
+// Return the first error raised while closing the sinks
+func (multi *Multi) Close() error {
+
+	var firstErr error
+	for _, sink := range multi.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,359 @@
+package statistics
+
+import (
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/histogram"
+)
+
+// maximumFailureMessages is the maximum number of distinct failure messages kept by Statistics
+const maximumFailureMessages = 100
+
+// Statistics holds the statistics computed on a set of executions. The durations are only computed with the
+// successful executions. The failure breakdown is only available for the actions.
+type Statistics struct {
+	NbSuccess          int64
+	NbFailure          int64
+	FailuresByCategory map[db.ErrorCategory]int64
+	FailuresByMessage  map[string]int64
+	Min                time.Duration
+	Max                time.Duration
+	Mean               time.Duration
+	StdDev             time.Duration
+	P50                time.Duration
+	P90                time.Duration
+	P95                time.Duration
+	P99                time.Duration
+	P999               time.Duration
+	Throughput         float64
+	Histogram          *histogram.Histogram
+}
+
+// TimingStatistics holds the distribution of the duration of each phase of the HTTP requests. A phase is only
+// recorded when it occurred, so for example the DNS lookup and the connection are only recorded for new connections.
+type TimingStatistics struct {
+	DNS                 *histogram.Histogram
+	Connect             *histogram.Histogram
+	TLS                 *histogram.Histogram
+	TimeToFirstByte     *histogram.Histogram
+	Transfer            *histogram.Histogram
+	NbNewConnections    int64
+	NbReusedConnections int64
+}
+
+// ActionStatistics holds the statistics of all the executions of an Action
+type ActionStatistics struct {
+	Statistics
+	StageIndex  int
+	ActionIndex int
+	Name        string
+	URL         string
+	Timings     *TimingStatistics
+}
+
+// StageStatistics holds the statistics of all the tries of a Stage. The duration of a try is the sum of the durations
+// of its actions, so it does not include the delays.
+type StageStatistics struct {
+	Statistics
+	StageIndex int
+	Name       string
+	Scenario   string
+	Actions    []*ActionStatistics
+}
+
+// ScenarioStatistics holds the statistics of the runs of a Scenario, computed as for the test
+type ScenarioStatistics struct {
+	Statistics
+	Name   string
+	Weight uint
+}
+
+// Report holds all the statistics of a run. The statistics of the test are computed on the duration of each run of
+// the test, a run being successful if all its stages are successful. If the test has scenarios, the same statistics
+// are also computed for the runs of each scenario.
+type Report struct {
+	Statistics
+	TestName   string
+	Elapsed    time.Duration
+	AllActions Statistics
+	Stages     []*StageStatistics
+	Scenarios  []*ScenarioStatistics
+}
+
+// stageTryKey identifies a single try of a stage
+type stageTryKey struct {
+	testIndex  int
+	stageIndex int
+	tryNumber  int
+}
+
+// stageRunKey identifies all the tries of a stage for a single run of the test
+type stageRunKey struct {
+	testIndex  int
+	stageIndex int
+}
+
+// stageTry is the result of a single try of a stage
+type stageTry struct {
+	durationNano int64
+	success      bool
+	nbActions    int
+}
+
+// Compute computes the statistics of a run from the content of the database
+//
+// Params:
+//  - test: the Test that was run
+//  - elapsed: the total duration of the run, used for computing the throughput
+//
+// Return the Report or an error if the database can not be read
+func Compute(test definition.Test, elapsed time.Duration) (*Report, error) {
+
+	report := newReport(test, elapsed)
+
+	tries := make(map[stageTryKey]*stageTry)
+
+	err := db.ForEachAction(func(action *db.ActionEntry) {
+
+		if action.StageIndex >= len(report.Stages) || action.ActionIndex >= len(report.Stages[action.StageIndex].Actions) {
+			return
+		}
+
+		actionStatistics := report.Stages[action.StageIndex].Actions[action.ActionIndex]
+		actionStatistics.record(action.Success, int64(action.DurationNano))
+		report.AllActions.record(action.Success, int64(action.DurationNano))
+
+		if action.StatusCode > 0 {
+			actionStatistics.Timings.record(action.HTTPTimings)
+		}
+
+		if !action.Success {
+			actionStatistics.recordFailure(action.ErrorCategory, action.ErrorMessage)
+			report.AllActions.recordFailure(action.ErrorCategory, action.ErrorMessage)
+		}
+
+		key := stageTryKey{
+			testIndex:  action.TestIndex,
+			stageIndex: action.StageIndex,
+			tryNumber:  action.TryNumber,
+		}
+
+		try, ok := tries[key]
+		if !ok {
+			try = &stageTry{success: true}
+			tries[key] = try
+		}
+
+		try.durationNano += int64(action.DurationNano)
+		try.success = try.success && action.Success
+		try.nbActions++
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the tries by stage run, a stage run being successful if one of its try is successful
+	stageRuns := make(map[stageRunKey]bool)
+	testDurations := make(map[int]int64)
+
+	for key, try := range tries {
+
+		// A successful try interrupted before its last action only counts for its actions
+		if try.success && try.nbActions < len(report.Stages[key.stageIndex].Actions) {
+			continue
+		}
+
+		report.Stages[key.stageIndex].record(try.success, try.durationNano)
+
+		runKey := stageRunKey{
+			testIndex:  key.testIndex,
+			stageIndex: key.stageIndex,
+		}
+		stageRuns[runKey] = stageRuns[runKey] || try.success
+		testDurations[key.testIndex] += try.durationNano
+	}
+
+	// A test run is successful if all its stages are successful
+	testSuccesses := make(map[int]bool)
+	for runKey, success := range stageRuns {
+		previous, ok := testSuccesses[runKey.testIndex]
+		testSuccesses[runKey.testIndex] = success && (previous || !ok)
+	}
+
+	for testIndex, success := range testSuccesses {
+		report.record(success, testDurations[testIndex])
+	}
+
+	// The scenario of a test run is the scenario of its stages
+	if len(report.Scenarios) > 0 {
+		scenarioIndexes := make(map[string]int, len(report.Scenarios))
+		for scenarioIndex, scenario := range report.Scenarios {
+			scenarioIndexes[scenario.Name] = scenarioIndex
+		}
+
+		testScenarios := make(map[int]int)
+		for runKey := range stageRuns {
+			if scenarioIndex, ok := scenarioIndexes[report.Stages[runKey.stageIndex].Scenario]; ok {
+				testScenarios[runKey.testIndex] = scenarioIndex
+			}
+		}
+
+		for testIndex, success := range testSuccesses {
+			if scenarioIndex, ok := testScenarios[testIndex]; ok {
+				report.Scenarios[scenarioIndex].record(success, testDurations[testIndex])
+			}
+		}
+	}
+
+	// Compute all the values
+	report.finalize(elapsed)
+	report.AllActions.finalize(elapsed)
+	for _, scenario := range report.Scenarios {
+		scenario.finalize(elapsed)
+	}
+	for _, stage := range report.Stages {
+		stage.finalize(elapsed)
+		for _, action := range stage.Actions {
+			action.finalize(elapsed)
+		}
+	}
+
+	return report, nil
+}
+
+func newReport(test definition.Test, elapsed time.Duration) *Report {
+
+	report := &Report{
+		Statistics: newStatistics(),
+		TestName:   test.TestName,
+		Elapsed:    elapsed,
+		AllActions: newStatistics(),
+		Stages:     make([]*StageStatistics, len(test.Stages)),
+		Scenarios:  make([]*ScenarioStatistics, 0, len(test.Scenarios)),
+	}
+
+	for _, scenario := range test.Scenarios {
+		report.Scenarios = append(report.Scenarios, &ScenarioStatistics{
+			Statistics: newStatistics(),
+			Name:       scenario.Name,
+			Weight:     scenario.Weight,
+		})
+	}
+
+	for stageIndex, stage := range test.Stages {
+
+		stageStatistics := &StageStatistics{
+			Statistics: newStatistics(),
+			StageIndex: stageIndex,
+			Name:       stage.Name,
+			Scenario:   stage.Scenario,
+			Actions:    make([]*ActionStatistics, len(stage.Actions)),
+		}
+
+		for actionIndex, action := range stage.Actions {
+			stageStatistics.Actions[actionIndex] = &ActionStatistics{
+				Statistics:  newStatistics(),
+				StageIndex:  stageIndex,
+				ActionIndex: actionIndex,
+				Name:        action.Name,
+				URL:         action.Query.URL,
+				Timings: &TimingStatistics{
+					DNS:             histogram.New(),
+					Connect:         histogram.New(),
+					TLS:             histogram.New(),
+					TimeToFirstByte: histogram.New(),
+					Transfer:        histogram.New(),
+				},
+			}
+		}
+
+		report.Stages[stageIndex] = stageStatistics
+	}
+
+	return report
+}
+
+func newStatistics() Statistics {
+	return Statistics{
+		FailuresByCategory: make(map[db.ErrorCategory]int64),
+		FailuresByMessage:  make(map[string]int64),
+		Histogram:          histogram.New(),
+	}
+}
+
+// record adds the result of a single execution
+func (statistics *Statistics) record(success bool, durationNano int64) {
+	if success {
+		statistics.NbSuccess++
+		statistics.Histogram.Record(durationNano)
+	} else {
+		statistics.NbFailure++
+	}
+}
+
+// record adds the timings of a single HTTP request
+func (timings *TimingStatistics) record(httpTimings db.HTTPTimings) {
+
+	if httpTimings.ConnectionReused {
+		timings.NbReusedConnections++
+	} else {
+		timings.NbNewConnections++
+	}
+
+	recordPhase(timings.DNS, httpTimings.DNSNano)
+	recordPhase(timings.Connect, httpTimings.ConnectNano)
+	recordPhase(timings.TLS, httpTimings.TLSNano)
+	recordPhase(timings.TimeToFirstByte, httpTimings.TimeToFirstByteNano)
+	recordPhase(timings.Transfer, httpTimings.TransferNano)
+}
+
+func recordPhase(phase *histogram.Histogram, durationNano int) {
+	if durationNano > 0 {
+		phase.Record(int64(durationNano))
+	}
+}
+
+// recordFailure adds the reason of a failed execution to the failure breakdown
+func (statistics *Statistics) recordFailure(category db.ErrorCategory, message string) {
+
+	statistics.FailuresByCategory[category]++
+
+	if _, ok := statistics.FailuresByMessage[message]; ok || len(statistics.FailuresByMessage) < maximumFailureMessages {
+		statistics.FailuresByMessage[message]++
+	}
+}
+
+// finalize computes all the values from the histogram
+func (statistics *Statistics) finalize(elapsed time.Duration) {
+
+	statistics.Min = time.Duration(statistics.Histogram.Min())
+	statistics.Max = time.Duration(statistics.Histogram.Max())
+	statistics.Mean = time.Duration(statistics.Histogram.Mean())
+	statistics.StdDev = time.Duration(statistics.Histogram.StdDev())
+	statistics.P50 = time.Duration(statistics.Histogram.Percentile(50))
+	statistics.P90 = time.Duration(statistics.Histogram.Percentile(90))
+	statistics.P95 = time.Duration(statistics.Histogram.Percentile(95))
+	statistics.P99 = time.Duration(statistics.Histogram.Percentile(99))
+	statistics.P999 = time.Duration(statistics.Histogram.Percentile(99.9))
+
+	if elapsed > 0 {
+		statistics.Throughput = float64(statistics.NbSuccess+statistics.NbFailure) / elapsed.Seconds()
+	}
+}
+
+// FullName returns the name of the stage, prefixed by the name of its scenario if any
+func (stage *StageStatistics) FullName() string {
+	return definition.FullStageName(stage.Scenario, stage.Name)
+}
+
+// ErrorRate returns the ratio of failed executions, or 0 if nothing was executed
+func (statistics *Statistics) ErrorRate() float64 {
+	total := statistics.NbSuccess + statistics.NbFailure
+	if total == 0 {
+		return 0
+	}
+	return float64(statistics.NbFailure) / float64(total)
+}
@@ -0,0 +1,401 @@
+package store
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/export"
+)
+
+// DefaultDirectory is the directory where the runs are stored by default
+const DefaultDirectory = ".gargote/runs"
+
+const (
+	runSuffix     = ".json"
+	samplesSuffix = ".samples.jsonl"
+	reportSuffix  = ".html"
+)
+
+// Run is a run stored on disk. The samples are stored in a separate file so that the runs can be listed without
+// reading them. The AbortReason is only given for the runs stopped before their end.
+type Run struct {
+	ID             string          `json:"id"`
+	FileName       string          `json:"file_name"`
+	DefinitionHash string          `json:"definition_hash"`
+	StartTimeNano  int64           `json:"start_time_nano"`
+	EndTimeNano    int64           `json:"end_time_nano"`
+	Definition     definition.Test `json:"definition"`
+	Results        *export.Results `json:"results"`
+	AbortReason    string          `json:"abort_reason,omitempty"`
+}
+
+// Store keeps the runs in a directory. Each run is stored as a JSON file with its definition and its statistics, and
+// a JSON lines file with its samples.
+type Store struct {
+	directory string
+}
+
+// Open opens a store, creating its directory if needed
+//
+// Params:
+//  - directory: the directory of the store
+//
+// Return the Store or an error if the directory can not be created
+func Open(directory string) (*Store, error) {
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create the run store '%s' due to %v", directory, err)
+	}
+
+	return &Store{
+		directory: directory,
+	}, nil
+}
+
+// HashDefinition returns a hash identifying the definition of a test, so that the runs of the same test can be
+// recognized
+//
+// Params:
+//  - test: the definition of the test
+//
+// Return the hash, in hexadecimal
+func HashDefinition(test definition.Test) string {
+
+	// The definition is hashed once converted, so that the formatting of the file does not matter
+	data, err := json.Marshal(test)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Save stores a run and its samples. The ID of the run is generated from its start time if it is empty. The headers of
+// the queries that may hold credentials are redacted from the stored definition, its hash being kept.
+//
+// Params:
+//  - run: the run to store. Its samples, if any, are stored in a separate file.
+//
+// Return the ID of the run or an error if the run can not be written
+func (store *Store) Save(run *Run) (string, error) {
+
+	if len(run.ID) == 0 {
+		run.ID = store.NewID(time.Unix(0, run.StartTimeNano))
+	}
+
+	// The samples are not kept in the main file
+	results := *run.Results
+	samples := results.Samples
+	results.Samples = nil
+
+	stored := *run
+	stored.Results = &results
+	stored.Definition = redactDefinition(run.Definition)
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err = writeSamples(store.path(run.ID, samplesSuffix), samples); err != nil {
+		return "", err
+	}
+
+	if err = ioutil.WriteFile(store.path(run.ID, runSuffix), data, 0644); err != nil {
+		return "", err
+	}
+
+	return run.ID, nil
+}
+
+// redactDefinition returns a copy of the definition of a test in which the headers of the queries that may hold
+// credentials are redacted
+func redactDefinition(test definition.Test) definition.Test {
+
+	test.Stages = redactStages(test.Stages)
+
+	scenarios := make([]definition.Scenario, len(test.Scenarios))
+	for i, scenario := range test.Scenarios {
+		scenario.Stages = redactStages(scenario.Stages)
+		scenarios[i] = scenario
+	}
+	if test.Scenarios != nil {
+		test.Scenarios = scenarios
+	}
+
+	return test
+}
+
+func redactStages(stages []definition.Stage) []definition.Stage {
+
+	if stages == nil {
+		return nil
+	}
+
+	redacted := make([]definition.Stage, len(stages))
+	for i, stage := range stages {
+		if stage.Actions != nil {
+			actions := make([]definition.Action, len(stage.Actions))
+			for j, action := range stage.Actions {
+				action.Query.Headers = redactHeaders(action.Query.Headers)
+				actions[j] = action
+			}
+			stage.Actions = actions
+		}
+		redacted[i] = stage
+	}
+
+	return redacted
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+
+	if headers == nil {
+		return nil
+	}
+
+	values := make(map[string][]string, len(headers))
+	for name, value := range headers {
+		values[name] = []string{value}
+	}
+
+	redacted := make(map[string]string, len(headers))
+	for name, value := range db.RedactHeaders(values) {
+		redacted[name] = value[0]
+	}
+
+	return redacted
+}
+
+// List returns all the runs of the store, without their samples, from the oldest to the most recent
+//
+// Return the runs or an error if the store can not be read
+func (store *Store) List() ([]*Run, error) {
+
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*Run, 0, len(files))
+	for _, file := range files {
+
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, runSuffix) {
+			continue
+		}
+
+		run, err := store.Load(strings.TrimSuffix(name, runSuffix))
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartTimeNano < runs[j].StartTimeNano
+	})
+
+	return runs, nil
+}
+
+// Load reads a run, without its samples
+//
+// Params:
+//  - id: the ID of the run. "latest" is the most recent run and "previous" the one before it.
+//
+// Return the run or an error if the run does not exist
+func (store *Store) Load(id string) (*Run, error) {
+
+	id, err := store.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(store.path(id, runSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("the run '%s' does not exist", id)
+		}
+		return nil, err
+	}
+
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("the run '%s' can not be read due to %v", id, err)
+	}
+
+	return &run, nil
+}
+
+// LoadSamples reads the samples of a run
+//
+// Params:
+//  - id: the ID of the run
+//
+// Return the samples, in chronological order, or an error if they can not be read
+func (store *Store) LoadSamples(id string) ([]*db.ActionEntry, error) {
+
+	id, err := store.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(store.path(id, samplesSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	samples := make([]*db.ActionEntry, 0)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var sample db.ActionEntry
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			return nil, err
+		}
+		samples = append(samples, &sample)
+	}
+
+	return samples, scanner.Err()
+}
+
+// Delete removes a run and its samples
+//
+// Params:
+//  - id: the ID of the run
+//
+// Return an error if the run can not be removed
+func (store *Store) Delete(id string) error {
+
+	if err := os.Remove(store.path(id, runSuffix)); err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{samplesSuffix, reportSuffix} {
+		if err := os.Remove(store.path(id, suffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SaveReport stores the HTML report of a run
+//
+// Params:
+//  - id: the ID of the run
+//  - report: the HTML report
+//
+// Return an error if the report can not be written
+func (store *Store) SaveReport(id string, report []byte) error {
+	return ioutil.WriteFile(store.path(id, reportSuffix), report, 0644)
+}
+
+// LoadReport reads the HTML report of a run
+//
+// Params:
+//  - id: the ID of the run
+//
+// Return the HTML report or an error if the run has no report
+func (store *Store) LoadReport(id string) ([]byte, error) {
+
+	id, err := store.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(store.path(id, reportSuffix))
+}
+
+// resolve converts the aliases "latest" and "previous" to the ID of a run
+func (store *Store) resolve(id string) (string, error) {
+
+	position := 0
+	switch id {
+	case "latest":
+		position = 1
+	case "previous":
+		position = 2
+	default:
+		if strings.ContainsAny(id, `/\`) || len(id) == 0 {
+			return "", fmt.Errorf("the run ID '%s' is not valid", id)
+		}
+		return id, nil
+	}
+
+	runs, err := store.List()
+	if err != nil {
+		return "", err
+	}
+
+	if len(runs) < position {
+		return "", errors.New("there are not enough runs in the store to find the " + id + " one")
+	}
+
+	return runs[len(runs)-position].ID, nil
+}
+
+// NewID generates a new ID from the start time of a run, adding a suffix if needed so that it is unique
+//
+// Params:
+//  - start: the start time of the run
+//
+// Return the new ID
+func (store *Store) NewID(start time.Time) string {
+
+	base := start.UTC().Format("20060102-150405")
+
+	id := base
+	for i := 2; ; i++ {
+		if _, err := os.Stat(store.path(id, runSuffix)); os.IsNotExist(err) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func (store *Store) path(id string, suffix string) string {
+	return filepath.Join(store.directory, id+suffix)
+}
+
+func writeSamples(fileName string, samples []*db.ActionEntry) error {
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for _, sample := range samples {
+		if err := encoder.Encode(sample); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,163 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+const (
+	// influxUDPBatchSize is the maximum size of an UDP packet sent to InfluxDB, to avoid fragmentation
+	influxUDPBatchSize = 1400
+	// influxHTTPBatchSize is the maximum size of an HTTP query sent to InfluxDB
+	influxHTTPBatchSize = 512 * 1024
+)
+
+// InfluxSink pushes the result of each action to InfluxDB, in the line protocol, as soon as the action is finished.
+// Each result is a point of the measurement gargote_action, tagged with the test, the stage, the action, the result
+// and the failure reason.
+type InfluxSink struct {
+	sink.Base
+	test   definition.Test
+	sender *sender
+	close  func() error
+}
+
+// NewInfluxSink creates a new InfluxSink. The sink must then be given to the runner, usually through a
+// sink.Multi, and closed once the test is finished.
+//
+// Params:
+//  - test: the Test that will be run
+//  - address: the address of InfluxDB, either udp://host:port or the full URL of the HTTP write endpoint, for example
+//    http://localhost:8086/write?db=gargote
+//  - token: the token sent in the Authorization header of the HTTP queries, if any
+//
+// Return the new InfluxSink or an error if the address is not valid
+func NewInfluxSink(test definition.Test, address string, token string) (*InfluxSink, error) {
+
+	parsedURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("the InfluxDB address '%s' is not valid due to %v", address, err)
+	}
+
+	influx := &InfluxSink{
+		test: test,
+	}
+
+	switch parsedURL.Scheme {
+
+	case "udp":
+		conn, err := net.Dial("udp", parsedURL.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		influx.sender = newSender("InfluxDB", influxUDPBatchSize, func(batch []byte) error {
+			_, err := conn.Write(batch)
+			return err
+		})
+		influx.close = conn.Close
+
+	case "http", "https":
+		client := &http.Client{Timeout: 10 * time.Second}
+
+		influx.sender = newSender("InfluxDB", influxHTTPBatchSize, func(batch []byte) error {
+			return postInflux(client, address, token, batch)
+		})
+		influx.close = func() error { return nil }
+
+	default:
+		return nil, fmt.Errorf("the InfluxDB address '%s' is not valid, expected udp://host:port or an http(s) URL", address)
+	}
+
+	return influx, nil
+}
+
+func postInflux(client *http.Client, address string, token string, batch []byte) error {
+
+	req, err := http.NewRequest("POST", address, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("InfluxDB answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// ActionFinished pushes the result of a finished action
+//
+// Params:
+//  - entry: the result of the action
+func (influx *InfluxSink) ActionFinished(entry *db.ActionEntry) {
+
+	stageName, actionName := sink.GetNames(influx.test, entry)
+
+	result := "success"
+	if !entry.Success {
+		result = "failure"
+	}
+
+	line := fmt.Sprintf(
+		"gargote_action,test=%s,stage=%s,action=%s,result=%s,reason=%s duration_ns=%di,status_code=%di,test_index=%di,try_number=%di,dns_ns=%di,connect_ns=%di,tls_ns=%di,time_to_first_byte_ns=%di,transfer_ns=%di,connection_reused=%t %d",
+		escapeInfluxTag(influx.test.TestName),
+		escapeInfluxTag(stageName),
+		escapeInfluxTag(actionName),
+		result,
+		entry.ErrorCategory.ToString(),
+		entry.DurationNano,
+		entry.StatusCode,
+		entry.TestIndex,
+		entry.TryNumber,
+		entry.DNSNano,
+		entry.ConnectNano,
+		entry.TLSNano,
+		entry.TimeToFirstByteNano,
+		entry.TransferNano,
+		entry.ConnectionReused,
+		entry.TimeNano)
+
+	influx.sender.send(line)
+}
+
+// Close sends the remaining results and closes the connection
+//
+// Return an error if the connection can not be closed
+func (influx *InfluxSink) Close() error {
+	influx.sender.close()
+	return influx.close()
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "")
+
+// escapeInfluxTag escapes a tag value. As empty tag values are not allowed, they are replaced by "-".
+func escapeInfluxTag(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return influxTagEscaper.Replace(value)
+}
@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// queueSize is the number of lines that can wait to be sent. When the queue is full, new lines are dropped so
+	// that the tests are never slowed down by a slow destination.
+	queueSize = 10000
+	// flushInterval is the maximum time a line waits before being sent
+	flushInterval = 1 * time.Second
+)
+
+// sender sends lines of text to a destination in background. The lines are grouped in batches whose size does not
+// exceed maxBatchSize bytes (except if a single line is bigger).
+type sender struct {
+	name         string
+	lines        chan string
+	write        func(batch []byte) error
+	maxBatchSize int
+	dropped      int64
+	waitGroup    sync.WaitGroup
+}
+
+func newSender(name string, maxBatchSize int, write func(batch []byte) error) *sender {
+
+	s := &sender{
+		name:         name,
+		lines:        make(chan string, queueSize),
+		write:        write,
+		maxBatchSize: maxBatchSize,
+	}
+
+	s.waitGroup.Add(1)
+	go s.run()
+
+	return s
+}
+
+// send queues a line to be sent. The line must not end with a new line.
+func (s *sender) send(line string) {
+	select {
+	case s.lines <- line:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// close sends the remaining lines and stops the sender
+func (s *sender) close() {
+	close(s.lines)
+	s.waitGroup.Wait()
+
+	if dropped := atomic.LoadInt64(&s.dropped); dropped > 0 {
+		log.Warnf("%s: %v result(s) were dropped as the destination was too slow", s.name, dropped)
+	}
+}
+
+func (s *sender) run() {
+
+	defer s.waitGroup.Done()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+
+	flush := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		if err := s.write(batch.Bytes()); err != nil {
+			log.Warnf("%s: unable to send results due to %v", s.name, err)
+		}
+		batch.Reset()
+	}
+
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				flush()
+				return
+			}
+
+			if batch.Len() > 0 && batch.Len()+len(line)+1 > s.maxBatchSize {
+				flush()
+			}
+			batch.WriteString(line)
+			batch.WriteByte('\n')
+
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
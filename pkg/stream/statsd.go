@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+// statsDBatchSize is the maximum size of an UDP packet sent to StatsD, to avoid fragmentation
+const statsDBatchSize = 1400
+
+// StatsDSink pushes the result of each action to StatsD as soon as the action is finished. For each action, the
+// metrics are named prefix.test.stage.action and are:
+//  - duration: a timer with the duration of the action in milliseconds
+//  - success / failure: counters of the results
+//  - failure.reason: a counter by failure reason
+type StatsDSink struct {
+	sink.Base
+	test   definition.Test
+	prefix string
+	sender *sender
+	conn   net.Conn
+}
+
+// NewStatsDSink creates a new StatsDSink. The sink must then be given to the runner, usually through a
+// sink.Multi, and closed once the test is finished.
+//
+// Params:
+//  - test: the Test that will be run
+//  - address: the address of StatsD, for example localhost:8125
+//  - prefix: the prefix of the metrics
+//
+// Return the new StatsDSink or an error if the address is not valid
+func NewStatsDSink(test definition.Test, address string, prefix string) (*StatsDSink, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsDSink{
+		test:   test,
+		prefix: prefix,
+		conn:   conn,
+		sender: newSender("StatsD", statsDBatchSize, func(batch []byte) error {
+			_, err := conn.Write(batch)
+			return err
+		}),
+	}, nil
+}
+
+// ActionFinished pushes the result of a finished action
+//
+// Params:
+//  - entry: the result of the action
+func (statsD *StatsDSink) ActionFinished(entry *db.ActionEntry) {
+
+	stageName, actionName := sink.GetNames(statsD.test, entry)
+
+	name := strings.Join(
+		[]string{
+			sanitizeStatsD(statsD.test.TestName),
+			sanitizeStatsD(stageName),
+			sanitizeStatsD(actionName),
+		},
+		".")
+
+	if len(statsD.prefix) > 0 {
+		name = statsD.prefix + "." + name
+	}
+
+	durationMilli := float64(entry.DurationNano) / float64(time.Millisecond)
+	statsD.sender.send(fmt.Sprintf("%s.duration:%.3f|ms", name, durationMilli))
+
+	if entry.Success {
+		statsD.sender.send(fmt.Sprintf("%s.success:1|c", name))
+	} else {
+		statsD.sender.send(fmt.Sprintf("%s.failure:1|c", name))
+		statsD.sender.send(fmt.Sprintf("%s.failure.%s:1|c", name, entry.ErrorCategory.ToString()))
+	}
+}
+
+// Close sends the remaining results and closes the connection
+//
+// Return an error if the connection can not be closed
+func (statsD *StatsDSink) Close() error {
+	statsD.sender.close()
+	return statsD.conn.Close()
+}
+
+var statsDInvalidCharacters = regexp.MustCompile(`[^A-Za-z0-9_\-]+`)
+
+// sanitizeStatsD replaces all the characters that can not be used in a StatsD metric name
+func sanitizeStatsD(value string) string {
+	if len(value) == 0 {
+		return "_"
+	}
+	return statsDInvalidCharacters.ReplaceAllString(value, "_")
+}
@@ -0,0 +1,154 @@
+package stream
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+)
+
+// newTest creates a Test with a single action, whose names have to be escaped
+func newTest() definition.Test {
+	return definition.Test{
+		TestName: "my test",
+		Stages: []definition.Stage{
+			{
+				Name:    "stage,1",
+				Actions: []definition.Action{{Name: "get=user"}},
+			},
+		},
+	}
+}
+
+// newEntries creates a successful and a failed execution of the action of the test
+func newEntries() []*db.ActionEntry {
+	return []*db.ActionEntry{
+		{
+			TestIndex:    3,
+			DurationNano: int(12500 * time.Microsecond),
+			Success:      true,
+			StatusCode:   200,
+			TimeNano:     1500000000000000000,
+			HTTPTimings: db.HTTPTimings{
+				DNSNano:          100,
+				ConnectNano:      200,
+				ConnectionReused: false,
+			},
+		},
+		{
+			TestIndex:     4,
+			TryNumber:     1,
+			DurationNano:  int(2 * time.Millisecond),
+			Success:       false,
+			StatusCode:    500,
+			ErrorCategory: db.StatusError,
+			TimeNano:      1500000000000000001,
+			HTTPTimings: db.HTTPTimings{
+				ConnectionReused: true,
+			},
+		},
+	}
+}
+
+// listen starts an UDP listener on a random local port
+func listen(t *testing.T) net.PacketConn {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// receiveLines reads the packets received by the listener until the expected number of lines is received
+func receiveLines(t *testing.T, listener net.PacketConn, expected int) []string {
+
+	var lines []string
+	buffer := make([]byte, 65536)
+
+	for len(lines) < expected {
+		if err := listener.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("received %v line(s) out of %v: %v", len(lines), expected, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(buffer[:n])), "\n") {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+
+	listener := listen(t)
+	defer listener.Close()
+
+	influx, err := NewInfluxSink(newTest(), "udp://"+listener.LocalAddr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range newEntries() {
+		influx.ActionFinished(entry)
+	}
+	if err := influx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`gargote_action,test=my\ test,stage=stage\,1,action=get\=user,result=success,reason=none duration_ns=12500000i,status_code=200i,test_index=3i,try_number=0i,dns_ns=100i,connect_ns=200i,tls_ns=0i,time_to_first_byte_ns=0i,transfer_ns=0i,connection_reused=false 1500000000000000000`,
+		`gargote_action,test=my\ test,stage=stage\,1,action=get\=user,result=failure,reason=status duration_ns=2000000i,status_code=500i,test_index=4i,try_number=1i,dns_ns=0i,connect_ns=0i,tls_ns=0i,time_to_first_byte_ns=0i,transfer_ns=0i,connection_reused=true 1500000000000000001`,
+	}
+
+	lines := receiveLines(t, listener, len(expected))
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v lines, got %v: %v", len(expected), len(lines), lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("line %v:\nexpected %v\ngot      %v", i, expected[i], lines[i])
+		}
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+
+	listener := listen(t)
+	defer listener.Close()
+
+	statsD, err := NewStatsDSink(newTest(), listener.LocalAddr().String(), "gargote")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range newEntries() {
+		statsD.ActionFinished(entry)
+	}
+	if err := statsD.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"gargote.my_test.stage_1.get_user.duration:12.500|ms",
+		"gargote.my_test.stage_1.get_user.success:1|c",
+		"gargote.my_test.stage_1.get_user.duration:2.000|ms",
+		"gargote.my_test.stage_1.get_user.failure:1|c",
+		"gargote.my_test.stage_1.get_user.failure.status:1|c",
+	}
+
+	lines := receiveLines(t, listener, len(expected))
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v lines, got %v: %v", len(expected), len(lines), lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("line %v: expected %v, got %v", i, expected[i], lines[i])
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package threshold
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/histogram"
+	"github.com/twuillemin/gargote/pkg/sink"
+)
+
+// watched holds the results received so far for a threshold flagged with abort_on_fail
+type watched struct {
+	threshold *Threshold
+	// inScope tells, by stage index and action index, if the action is in the scope of the threshold
+	inScope   [][]bool
+	durations *histogram.Histogram
+	nbFailure int64
+}
+
+// Monitor checks, while a Test is running, the thresholds flagged with abort_on_fail. It receives the results as a
+// sink and must be given to the runner, usually through a sink.Multi. The results are added to the thresholds when
+// they are received, so that the check does not need the statistics of the whole run.
+type Monitor struct {
+	sink.Base
+	mutex   sync.Mutex
+	test    definition.Test
+	watched []*watched
+}
+
+// NewMonitor creates a new Monitor for the thresholds of a Test
+//
+// Params:
+//  - thresholds: the thresholds of the Test. Only the ones flagged with abort_on_fail are checked
+//  - test: the Test that will be run
+//
+// Return the new Monitor
+func NewMonitor(thresholds []*Threshold, test definition.Test) *Monitor {
+
+	monitor := &Monitor{
+		test: test,
+	}
+
+	// Without a maximum number of runs, no threshold can be breached before the end of the run
+	if test.Swarm.MaximumNumberOfRuns() == 0 {
+		return monitor
+	}
+
+	for _, threshold := range thresholds {
+
+		if !threshold.Definition.AbortOnFail {
+			continue
+		}
+
+		inScope := make([][]bool, len(test.Stages))
+		for stageIndex, stage := range test.Stages {
+			inScope[stageIndex] = make([]bool, len(stage.Actions))
+			for actionIndex, action := range stage.Actions {
+				inScope[stageIndex][actionIndex] = threshold.matches(stage.Scenario, stage.Name, action.Name)
+			}
+		}
+
+		monitor.watched = append(monitor.watched, &watched{
+			threshold: threshold,
+			inScope:   inScope,
+			durations: histogram.New(),
+		})
+	}
+
+	return monitor
+}
+
+// ActionFinished adds the result of an action to the thresholds in its scope
+func (monitor *Monitor) ActionFinished(entry *db.ActionEntry) {
+
+	if len(monitor.watched) == 0 {
+		return
+	}
+
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	for _, watched := range monitor.watched {
+
+		if entry.StageIndex >= len(watched.inScope) || entry.ActionIndex >= len(watched.inScope[entry.StageIndex]) || !watched.inScope[entry.StageIndex][entry.ActionIndex] {
+			continue
+		}
+
+		if entry.Success {
+			watched.durations.Record(int64(entry.DurationNano))
+		} else {
+			watched.nbFailure++
+		}
+	}
+}
+
+// Watch periodically checks, while a Test is running, the thresholds flagged with abort_on_fail. As soon as one of
+// them is irrecoverably breached, the onBreach function is called and the watch stops.
+//
+// Params:
+//  - ctx: the context of the run. The watch stops when the context is done
+//  - onBreach: the function called with the first breached threshold
+func (monitor *Monitor) Watch(ctx context.Context, onBreach func(Result)) {
+
+	if len(monitor.watched) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if breach := monitor.check(); breach != nil {
+				onBreach(*breach)
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check returns the first threshold irrecoverably breached by the results received so far, or nil
+func (monitor *Monitor) check() *Result {
+
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	for _, watched := range monitor.watched {
+		if breach := watched.threshold.isIrrecoverablyBreached(monitor.test, watched.durations, watched.nbFailure); breach != nil {
+			return breach
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,439 @@
+package threshold
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/histogram"
+	"github.com/twuillemin/gargote/pkg/statistics"
+)
+
+// kind is the family of a metric, which defines the unit of its limit
+type kind int
+
+const (
+	// latencyKind is for metrics expressed as a duration (min, max, mean, median, pXX)
+	latencyKind kind = iota
+	// errorRateKind is for metrics expressed as a ratio of failed actions
+	errorRateKind
+	// throughputKind is for metrics expressed as a number of actions by second
+	throughputKind
+)
+
+// Threshold is a definition.Threshold whose expression was parsed and is ready to be evaluated
+type Threshold struct {
+	Definition definition.Threshold
+	Metric     string
+	Operator   string
+	Limit      float64
+	kind       kind
+	percentile float64
+}
+
+// Result is the outcome of the evaluation of a single Threshold
+type Result struct {
+	Threshold *Threshold
+	Value     float64
+	HasValue  bool
+	Passed    bool
+}
+
+var expressionRegexp = regexp.MustCompile(`^\s*([a-z_]+|p\d+(?:\.\d+)?)\s*(<=|>=|<|>)\s*(.+?)\s*$`)
+
+// Parse parses the expression of a threshold
+//
+// Params:
+//  - threshold: the definition of the threshold
+//
+// Return the parsed Threshold or an error if the expression is not valid
+func Parse(threshold definition.Threshold) (*Threshold, error) {
+
+	matches := expressionRegexp.FindStringSubmatch(threshold.Expression)
+	if len(matches) != 4 {
+		return nil, fmt.Errorf("the threshold '%s' is not valid, expected an expression such as 'p95 < 300ms'", threshold.Expression)
+	}
+
+	result := &Threshold{
+		Definition: threshold,
+		Metric:     matches[1],
+		Operator:   matches[2],
+	}
+
+	switch {
+
+	case result.Metric == "min" || result.Metric == "max" || result.Metric == "mean" || result.Metric == "median":
+		result.kind = latencyKind
+
+	case strings.HasPrefix(result.Metric, "p"):
+		percentile, err := strconv.ParseFloat(result.Metric[1:], 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("the threshold '%s' is not valid, the percentile must be between 0 and 100", threshold.Expression)
+		}
+		result.kind = latencyKind
+		result.percentile = percentile
+
+	case result.Metric == "error_rate":
+		result.kind = errorRateKind
+
+	case result.Metric == "throughput":
+		result.kind = throughputKind
+
+	default:
+		return nil, fmt.Errorf("the threshold '%s' is not valid, the metric '%s' is unknown", threshold.Expression, result.Metric)
+	}
+
+	limit, err := parseLimit(result.kind, matches[3])
+	if err != nil {
+		return nil, fmt.Errorf("the threshold '%s' is not valid, %v", threshold.Expression, err)
+	}
+	result.Limit = limit
+
+	return result, nil
+}
+
+// ParseAll parses all the thresholds of a Test
+//
+// Params:
+//  - test: the Test
+//
+// Return the parsed thresholds or an error if one of them is not valid
+func ParseAll(test definition.Test) ([]*Threshold, error) {
+
+	thresholds := make([]*Threshold, 0, len(test.Thresholds))
+
+	for _, definitionThreshold := range test.Thresholds {
+
+		threshold, err := Parse(definitionThreshold)
+		if err != nil {
+			return nil, err
+		}
+
+		if !threshold.matchesAnyAction(test) {
+			return nil, fmt.Errorf("the threshold '%s' does not apply to any action of the test", definitionThreshold.Expression)
+		}
+
+		thresholds = append(thresholds, threshold)
+	}
+
+	return thresholds, nil
+}
+
+func parseLimit(metricKind kind, rawLimit string) (float64, error) {
+
+	limit := strings.Replace(rawLimit, " ", "", -1)
+
+	switch metricKind {
+
+	case latencyKind:
+		duration, err := time.ParseDuration(limit)
+		if err != nil {
+			return 0, fmt.Errorf("the limit '%s' is not a duration such as '300ms'", rawLimit)
+		}
+		return float64(duration.Nanoseconds()), nil
+
+	case errorRateKind:
+		if strings.HasSuffix(limit, "%") {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(limit, "%"), 64)
+			if err != nil {
+				return 0, fmt.Errorf("the limit '%s' is not a percentage such as '1%%'", rawLimit)
+			}
+			return value / 100.0, nil
+		}
+
+		value, err := strconv.ParseFloat(limit, 64)
+		if err != nil {
+			return 0, fmt.Errorf("the limit '%s' is not a percentage such as '1%%' or a ratio such as '0.01'", rawLimit)
+		}
+		return value, nil
+
+	default:
+		limit = strings.TrimSuffix(strings.TrimSuffix(limit, "rps"), "/s")
+		value, err := strconv.ParseFloat(limit, 64)
+		if err != nil {
+			return 0, fmt.Errorf("the limit '%s' is not a throughput such as '50rps'", rawLimit)
+		}
+		return value, nil
+	}
+}
+
+// String returns the original expression of the threshold, with its scope if any
+func (threshold *Threshold) String() string {
+
+	scope := ""
+	if len(threshold.Definition.Scenario) > 0 {
+		scope += fmt.Sprintf(" [scenario: %s]", threshold.Definition.Scenario)
+	}
+	if len(threshold.Definition.StageName) > 0 {
+		scope += fmt.Sprintf(" [stage: %s]", threshold.Definition.StageName)
+	}
+	if len(threshold.Definition.ActionName) > 0 {
+		scope += fmt.Sprintf(" [action: %s]", threshold.Definition.ActionName)
+	}
+
+	return strings.TrimSpace(threshold.Definition.Expression) + scope
+}
+
+// String returns a human readable description of the result
+func (result Result) String() string {
+
+	status := "PASSED"
+	if !result.Passed {
+		status = "FAILED"
+	}
+
+	if !result.HasValue {
+		return fmt.Sprintf("%s: %v (no value available)", status, result.Threshold)
+	}
+
+	return fmt.Sprintf("%s: %v (measured: %s)", status, result.Threshold, result.Threshold.formatValue(result.Value))
+}
+
+func (threshold *Threshold) formatValue(value float64) string {
+	switch threshold.kind {
+	case latencyKind:
+		return time.Duration(value).String()
+	case errorRateKind:
+		return fmt.Sprintf("%.2f%%", value*100.0)
+	default:
+		return fmt.Sprintf("%.2f rps", value)
+	}
+}
+
+// matches returns true if the threshold applies to the action with the given names
+func (threshold *Threshold) matches(scenarioName string, stageName string, actionName string) bool {
+
+	if len(threshold.Definition.Scenario) > 0 && threshold.Definition.Scenario != scenarioName {
+		return false
+	}
+
+	if len(threshold.Definition.StageName) > 0 && threshold.Definition.StageName != stageName {
+		return false
+	}
+
+	if len(threshold.Definition.ActionName) > 0 && threshold.Definition.ActionName != actionName {
+		return false
+	}
+
+	return true
+}
+
+// matchesAnyAction returns true if the threshold applies to at least one action of the test
+func (threshold *Threshold) matchesAnyAction(test definition.Test) bool {
+
+	for _, stage := range test.Stages {
+		for _, action := range stage.Actions {
+			if threshold.matches(stage.Scenario, stage.Name, action.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// maximumNumberOfMatchingActions returns the maximum number of executions, by run of the test, of the actions to
+// which the threshold applies. Each action is counted once by try of its stage. With scenarios, as each run executes
+// a single scenario, this is the maximum of the scenarios.
+func (threshold *Threshold) maximumNumberOfMatchingActions(test definition.Test) uint {
+
+	byScenario := make(map[string]uint)
+	for _, stage := range test.Stages {
+		for _, action := range stage.Actions {
+			if threshold.matches(stage.Scenario, stage.Name, action.Name) {
+				byScenario[stage.Scenario] += 1 + stage.MaximumRetries
+			}
+		}
+	}
+
+	var maximum uint
+	for _, count := range byScenario {
+		if count > maximum {
+			maximum = count
+		}
+	}
+
+	return maximum
+}
+
+// collect gathers the durations of the successful actions and the number of failed actions in the scope of the
+// threshold
+func (threshold *Threshold) collect(report *statistics.Report) (*histogram.Histogram, int64) {
+
+	durations := histogram.New()
+	var nbFailure int64
+
+	for _, stage := range report.Stages {
+		for _, action := range stage.Actions {
+
+			if !threshold.matches(stage.Scenario, stage.Name, action.Name) {
+				continue
+			}
+
+			durations.Merge(action.Histogram)
+			nbFailure += action.NbFailure
+		}
+	}
+
+	return durations, nbFailure
+}
+
+// compare returns true if the value respects the limit of the threshold
+func (threshold *Threshold) compare(value float64) bool {
+	switch threshold.Operator {
+	case "<":
+		return value < threshold.Limit
+	case "<=":
+		return value <= threshold.Limit
+	case ">":
+		return value > threshold.Limit
+	default:
+		return value >= threshold.Limit
+	}
+}
+
+// Evaluate evaluates the thresholds against the results of a run
+//
+// Params:
+//  - thresholds: the thresholds to evaluate
+//  - report: the statistics of the run
+//
+// Return the result of each threshold
+func Evaluate(thresholds []*Threshold, report *statistics.Report) []Result {
+
+	evaluated := make([]Result, 0, len(thresholds))
+
+	for _, threshold := range thresholds {
+
+		durations, nbFailure := threshold.collect(report)
+		total := durations.Count() + nbFailure
+
+		result := Result{
+			Threshold: threshold,
+		}
+
+		switch threshold.kind {
+
+		case latencyKind:
+			if durations.Count() > 0 {
+				result.Value = threshold.computeLatency(durations)
+				result.HasValue = true
+			}
+
+		case errorRateKind:
+			if total > 0 {
+				result.Value = float64(nbFailure) / float64(total)
+				result.HasValue = true
+			}
+
+		case throughputKind:
+			if report.Elapsed > 0 {
+				result.Value = float64(total) / report.Elapsed.Seconds()
+				result.HasValue = true
+			}
+		}
+
+		result.Passed = result.HasValue && threshold.compare(result.Value)
+		evaluated = append(evaluated, result)
+	}
+
+	return evaluated
+}
+
+func (threshold *Threshold) computeLatency(durations *histogram.Histogram) float64 {
+	switch threshold.Metric {
+	case "min":
+		return float64(durations.Min())
+	case "max":
+		return float64(durations.Max())
+	case "mean":
+		return durations.Mean()
+	case "median":
+		return float64(durations.Percentile(50))
+	default:
+		return float64(durations.Percentile(threshold.percentile))
+	}
+}
+
+// IsIrrecoverablyBreached checks, while the run is in progress, if the threshold is already failed whatever the
+// results of the remaining actions. This is only possible for upper limits on latencies and error rate. The final
+// number of actions is bounded by the maximum number of runs, each run executing all the tries of the matching
+// actions, so nothing is checked if the number of runs has no limit known in advance.
+//
+// Params:
+//  - test: the Test being run
+//  - report: the statistics of the run so far
+//
+// Return a Result if the threshold is irrecoverably breached, nil otherwise
+func (threshold *Threshold) IsIrrecoverablyBreached(test definition.Test, report *statistics.Report) *Result {
+
+	durations, nbFailure := threshold.collect(report)
+
+	return threshold.isIrrecoverablyBreached(test, durations, nbFailure)
+}
+
+// isIrrecoverablyBreached checks if the threshold is already failed given the durations of the successful actions and
+// the number of failed actions in its scope so far
+func (threshold *Threshold) isIrrecoverablyBreached(test definition.Test, durations *histogram.Histogram, nbFailure int64) *Result {
+
+	if threshold.Operator != "<" && threshold.Operator != "<=" {
+		return nil
+	}
+
+	// Without a maximum number of runs, as for virtual users running during a duration, nothing can be told
+	maximumRuns := test.Swarm.MaximumNumberOfRuns()
+	if maximumRuns == 0 {
+		return nil
+	}
+
+	maximumTotal := float64(maximumRuns) * float64(threshold.maximumNumberOfMatchingActions(test))
+
+	breached := false
+	value := 0.0
+
+	switch threshold.kind {
+
+	case errorRateKind:
+		// Even if all the remaining actions succeed, the error rate can not go down below this value
+		value = float64(nbFailure) / math.Max(maximumTotal, float64(durations.Count()+nbFailure))
+		breached = !threshold.compare(value)
+
+	case latencyKind:
+		if durations.Count() == 0 {
+			return nil
+		}
+
+		// Count the samples already above the limit
+		nbAbove := durations.CountAbove(int64(threshold.Limit))
+
+		switch threshold.Metric {
+		case "max":
+			breached = nbAbove > 0
+		case "median":
+			breached = float64(nbAbove) > 0.5*maximumTotal
+		case "min", "mean":
+			breached = false
+		default:
+			breached = float64(nbAbove) > (1.0-threshold.percentile/100.0)*maximumTotal
+		}
+
+		if breached {
+			value = threshold.computeLatency(durations)
+		}
+	}
+
+	if !breached {
+		return nil
+	}
+
+	return &Result{
+		Threshold: threshold,
+		Value:     value,
+		HasValue:  true,
+		Passed:    false,
+	}
+}
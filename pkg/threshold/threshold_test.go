@@ -0,0 +1,198 @@
+package threshold
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/twuillemin/gargote/pkg/db"
+	"github.com/twuillemin/gargote/pkg/definition"
+	"github.com/twuillemin/gargote/pkg/histogram"
+	"github.com/twuillemin/gargote/pkg/statistics"
+)
+
+// newTestWithRetries creates a Test of 10 runs of a single action, whose stage can be retried
+func newTestWithRetries(maximumRetries uint) definition.Test {
+	return definition.Test{
+		TestName: "test",
+		Stages: []definition.Stage{
+			{
+				Name:           "stage",
+				MaximumRetries: maximumRetries,
+				Actions:        []definition.Action{{Name: "action"}},
+			},
+		},
+		Swarm: definition.Swarm{
+			NumberOfRuns: 10,
+			CreationRate: 1,
+		},
+	}
+}
+
+// newReport creates the report of the single action of a Test
+func newReport(nbSuccess int, nbFailure int64) *statistics.Report {
+
+	durations := histogram.New()
+	for i := 0; i < nbSuccess; i++ {
+		durations.Record(int64(10 * time.Millisecond))
+	}
+
+	action := &statistics.ActionStatistics{Name: "action"}
+	action.Histogram = durations
+	action.NbSuccess = int64(nbSuccess)
+	action.NbFailure = nbFailure
+
+	return &statistics.Report{
+		Stages: []*statistics.StageStatistics{
+			{
+				Name:    "stage",
+				Actions: []*statistics.ActionStatistics{action},
+			},
+		},
+	}
+}
+
+func TestIsIrrecoverablyBreached(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		expression     string
+		maximumRetries uint
+		nbSuccess      int
+		nbFailure      int64
+		breached       bool
+	}{
+		// 5 runs failed their first try and succeeded the second one: the final error rate would be 5/15
+		{"retries can still lower the error rate", "error_rate < 50%", 1, 5, 5, false},
+		{"error rate without retries", "error_rate < 50%", 0, 0, 5, true},
+		{"error rate below the limit", "error_rate < 50%", 0, 5, 4, false},
+		{"error rate over all the tries", "error_rate < 50%", 1, 0, 10, true},
+		{"max", "max < 5ms", 1, 1, 0, true},
+		{"percentile without retries", "p50 < 5ms", 0, 6, 0, true},
+		{"percentile with retries", "p50 < 5ms", 1, 6, 0, false},
+		{"lower limit", "throughput > 1000", 0, 10, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			threshold, err := Parse(definition.Threshold{Expression: test.expression})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := threshold.IsIrrecoverablyBreached(newTestWithRetries(test.maximumRetries), newReport(test.nbSuccess, test.nbFailure))
+			if (result != nil) != test.breached {
+				t.Errorf("expected breached to be %v, got %v", test.breached, result)
+			}
+		})
+	}
+}
+
+func TestIsIrrecoverablyBreachedWithoutLimit(t *testing.T) {
+
+	threshold, err := Parse(definition.Threshold{Expression: "error_rate < 50%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The number of Poisson arrivals during a duration is random
+	test := newTestWithRetries(0)
+	test.Swarm = definition.Swarm{
+		CreationRate: 1,
+		Duration:     10,
+		Arrival:      definition.PoissonArrival,
+	}
+
+	if result := threshold.IsIrrecoverablyBreached(test, newReport(0, 10)); result != nil {
+		t.Errorf("expected no breach without a maximum number of runs, got %v", result)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+
+	test := newTestWithRetries(0)
+	test.Thresholds = []definition.Threshold{{Expression: "error_rate < 50%", AbortOnFail: true}}
+
+	thresholds, err := ParseAll(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 runs of a single action: the threshold is breached once 5 actions have failed
+	monitor := NewMonitor(thresholds, test)
+	for i := 0; i < 5; i++ {
+		if result := monitor.check(); result != nil {
+			t.Fatalf("expected no breach after %v failures, got %v", i, result)
+		}
+		monitor.ActionFinished(&db.ActionEntry{TestIndex: i})
+		monitor.ActionFinished(&db.ActionEntry{TestIndex: i, Success: true, DurationNano: int(10 * time.Millisecond)})
+	}
+
+	if result := monitor.check(); result == nil {
+		t.Errorf("expected a breach after 5 failures")
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		expression string
+		metric     string
+		operator   string
+		limit      float64
+		kind       kind
+		percentile float64
+	}{
+		{"p95 < 300ms", "p95", "<", float64(300 * time.Millisecond), latencyKind, 95},
+		{"p99.9<=1.5s", "p99.9", "<=", float64(1500 * time.Millisecond), latencyKind, 99.9},
+		{"  max < 2s  ", "max", "<", float64(2 * time.Second), latencyKind, 0},
+		{"median >= 10 ms", "median", ">=", float64(10 * time.Millisecond), latencyKind, 0},
+		{"mean < 250us", "mean", "<", float64(250 * time.Microsecond), latencyKind, 0},
+		{"error_rate < 1%", "error_rate", "<", 0.01, errorRateKind, 0},
+		{"error_rate <= 0.05", "error_rate", "<=", 0.05, errorRateKind, 0},
+		{"throughput > 50 rps", "throughput", ">", 50, throughputKind, 0},
+		{"throughput >= 12.5/s", "throughput", ">=", 12.5, throughputKind, 0},
+		{"throughput > 100", "throughput", ">", 100, throughputKind, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+
+			threshold, err := Parse(definition.Threshold{Expression: test.expression})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if threshold.Metric != test.metric || threshold.Operator != test.operator || threshold.kind != test.kind || threshold.percentile != test.percentile {
+				t.Errorf("expected %v %v (kind %v, percentile %v), got %v %v (kind %v, percentile %v)", test.metric, test.operator, test.kind, test.percentile, threshold.Metric, threshold.Operator, threshold.kind, threshold.percentile)
+			}
+			if math.Abs(threshold.Limit-test.limit) > 1e-9 {
+				t.Errorf("expected a limit of %v, got %v", test.limit, threshold.Limit)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+
+	expressions := []string{
+		"",
+		"p95",
+		"p95 300ms",
+		"p95 = 300ms",
+		"p0 < 300ms",
+		"p101 < 300ms",
+		"latency < 300ms",
+		"p95 < 300",
+		"error_rate < one%",
+		"error_rate < 1ms",
+		"throughput > fast",
+	}
+
+	for _, expression := range expressions {
+		if threshold, err := Parse(definition.Threshold{Expression: expression}); err == nil {
+			t.Errorf("expected an error for '%v', got %+v", expression, threshold)
+		}
+	}
+}